@@ -0,0 +1,153 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clients connecting with ?acks=1 acknowledge what they processed. Every
+// message built from a consumed record (one with a RecordID) is then sent with
+// an increasing Seq, and the client answers {"AckSeq": <Seq>}. A message not
+// acknowledged within acks.timeout seconds is sent again, up to acks.retries
+// times; after that, or when the client disconnects first, it is treated as
+// undelivered: kept in the outbox, or dead-lettered, like a failed write.
+// Under after_delivery the record's offset is committed only once the message
+// is acknowledged or stored.
+
+const (
+	defaultAckTimeout = 30 * time.Second
+	defaultAckRetries = 2
+)
+
+type AckConfig struct {
+	Timeout int `json:"timeout,omitempty"` // seconds
+	Retries int `json:"retries,omitempty"`
+}
+
+var (
+	ackTimeout = defaultAckTimeout
+	ackRetries = defaultAckRetries
+)
+
+var ackEvents = newCounterVec("wsapigw_ack_events_total",
+	"Acknowledged messages by outcome: acked, retried, expired after the last retry, or abandoned on disconnect.",
+	"route", "event")
+
+func initAcks(c AckConfig) {
+	if 0 != c.Timeout {
+		ackTimeout = time.Duration(c.Timeout) * time.Second
+	}
+	if 0 != c.Retries {
+		ackRetries = c.Retries
+	}
+}
+
+type pendingAck struct {
+	msg      *ClientMessage
+	sent     time.Time
+	attempts int
+}
+
+// clientAcks holds the messages sent to a client in ack mode that it hasn't
+// acknowledged yet. Messages are tracked by the writer and acknowledged from
+// the reader.
+type clientAcks struct {
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]*pendingAck
+}
+
+func newClientAcks() *clientAcks {
+	return &clientAcks{pending: make(map[uint64]*pendingAck)}
+}
+
+// track numbers msg and starts waiting for its ack. The message may be
+// shared with other clients, so a numbered copy is returned.
+func (a *clientAcks) track(msg *ClientMessage) *ClientMessage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seq++
+	m := *msg
+	m.Seq = a.seq
+	a.pending[m.Seq] = &pendingAck{msg: &m, sent: time.Now(), attempts: 1}
+	return &m
+}
+
+// ack stops waiting for seq and returns its message, or nil when seq isn't
+// pending.
+func (a *clientAcks) ack(seq uint64) *ClientMessage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p := a.pending[seq]
+	if nil == p {
+		return nil
+	}
+	delete(a.pending, seq)
+	return p.msg
+}
+
+// overdue returns the messages to send again and those that ran out of
+// retries, in Seq order.
+func (a *clientAcks) overdue(now time.Time) (retry []*ClientMessage, expired []*ClientMessage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for seq, p := range a.pending {
+		if now.Sub(p.sent) < ackTimeout {
+			continue
+		}
+		if p.attempts > ackRetries {
+			delete(a.pending, seq)
+			expired = append(expired, p.msg)
+			continue
+		}
+		p.attempts++
+		p.sent = now
+		retry = append(retry, p.msg)
+	}
+	bySeq := func(ms []*ClientMessage) {
+		sort.Slice(ms, func(i, j int) bool { return ms[i].Seq < ms[j].Seq })
+	}
+	bySeq(retry)
+	bySeq(expired)
+	return retry, expired
+}
+
+// abandon stops waiting for all pending messages and returns them.
+func (a *clientAcks) abandon() []*ClientMessage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	msgs := make([]*ClientMessage, 0, len(a.pending))
+	for seq, p := range a.pending {
+		msgs = append(msgs, p.msg)
+		delete(a.pending, seq)
+	}
+	return msgs
+}
+
+// acked handles a client's ack.
+func (c *Client) acked(seq uint64) {
+	msg := c.acks.ack(seq)
+	if nil == msg {
+		return
+	}
+	ackEvents.inc(c.route, "acked")
+	if msg.outboxed {
+		c.hub.ack(c, msg.RecordID)
+	}
+	msg.d.finish()
+}
+
+// undelivered handles a message the client never acknowledged.
+func (c *Client) undelivered(msg *ClientMessage, event string) {
+	ackEvents.inc(c.route, event)
+	wsLog.Info("message not acknowledged", "cid", c.cid, "seq", msg.Seq, "record", msg.RecordID, "event", event)
+	if nil != msg.d {
+		msg.d.fail(c)
+		return
+	}
+	// outbox messages are still stored; others are kept now if possible
+	if !msg.outboxed && !stash(msg, c.hub.recipientOf(c, msg)) {
+		droppedMessages.inc(dropUnacked)
+	}
+}
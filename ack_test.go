@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func withAckRetries(t *testing.T, retries int) {
+	ackTimeout, ackRetries = time.Second, retries
+	t.Cleanup(func() { ackTimeout, ackRetries = defaultAckTimeout, defaultAckRetries })
+}
+
+func TestAckSequence(t *testing.T) {
+	a := newClientAcks()
+	shared := &ClientMessage{RecordID: "employee.updates/0/1"}
+	for want := uint64(1); want <= 3; want++ {
+		if m := a.track(shared); want != m.Seq || shared.RecordID != m.RecordID {
+			t.Fatalf("tracked %+v, want Seq %d", m, want)
+		}
+	}
+	if 0 != shared.Seq {
+		t.Errorf("shared message numbered %d", shared.Seq)
+	}
+	if m := a.ack(2); nil == m || 2 != m.Seq {
+		t.Errorf("ack(2) returned %+v", m)
+	}
+	for _, seq := range []uint64{2, 4} {
+		if m := a.ack(seq); nil != m {
+			t.Errorf("ack(%d) returned %+v, want nil", seq, m)
+		}
+	}
+	if n := len(a.abandon()); 2 != n {
+		t.Errorf("abandoned %d messages, want 2", n)
+	}
+}
+
+func TestAckOverdue(t *testing.T) {
+	withAckRetries(t, 2)
+	a := newClientAcks()
+	for i := 0; i < 3; i++ {
+		a.track(&ClientMessage{})
+	}
+	start := time.Now()
+	a.ack(2)
+	seqs := func(ms []*ClientMessage) []uint64 {
+		s := []uint64{}
+		for _, m := range ms {
+			s = append(s, m.Seq)
+		}
+		return s
+	}
+	for _, tc := range []struct {
+		after          time.Duration
+		retry, expired int
+	}{
+		{0, 0, 0},
+		{ackTimeout, 2, 0},
+		// not a timeout after the retry yet
+		{ackTimeout + ackTimeout/2, 0, 0},
+		{2 * ackTimeout, 2, 0},
+		{3 * ackTimeout, 0, 2},
+		{4 * ackTimeout, 0, 0},
+	} {
+		retry, expired := a.overdue(start.Add(tc.after))
+		if tc.retry != len(retry) || tc.expired != len(expired) {
+			t.Fatalf("after %v: retry %v, expired %v; want %d and %d", tc.after, seqs(retry), seqs(expired), tc.retry, tc.expired)
+		}
+		if all := append(retry, expired...); 0 != len(all) && (1 != all[0].Seq || 3 != all[1].Seq) {
+			t.Errorf("after %v: Seq %v, want [1 3]", tc.after, seqs(all))
+		}
+	}
+}
+
+// A message the client never acknowledges is kept in the outbox, and an
+// outbox message it acknowledges is removed.
+func TestAckOutbox(t *testing.T) {
+	o := withOutbox(t)
+	h := newHub()
+	block := "block-9"
+	c := testClient(h, "c1", "RA")
+	c.acks = newClientAcks()
+
+	sent := c.acks.track(&ClientMessage{Payload: &Payload{Block: &block}, RecordID: "new.block.created/0/9"})
+	for _, msg := range c.acks.abandon() {
+		c.undelivered(msg, "abandoned")
+	}
+	pending := o.Pending("type:RA")
+	if 1 != len(pending) || sent.RecordID != pending[0].Message.RecordID {
+		t.Fatalf("outbox holds %+v, want the abandoned message", pending)
+	}
+
+	h.sendPending(c, "type:RA")
+	msg := c.acks.track(<-c.send)
+	c.acked(msg.Seq)
+	if n := len(o.Pending("type:RA")); 0 != n {
+		t.Errorf("outbox holds %d messages after the ack, want none", n)
+	}
+}
+
+// Acks are answered however fast they come; the message after them is within
+// the limit.
+func TestAckRateLimit(t *testing.T) {
+	limiter = &rateLimiter{
+		c:       RateLimitConfig{Endpoints: map[string]Limit{"/RA": {Rate: 0.001, Burst: 1}}, AbuseStrikes: 1},
+		window:  time.Minute,
+		buckets: make(map[string]*bucket),
+	}
+	t.Cleanup(func() { limiter = nil })
+	withDedup(t)
+	h, published := readyHub(t)
+	c := testClient(h, "c1", "RA")
+	c.codec = jsonCodec{}
+	c.limits = limiter.forClient(c.route, c.Type)
+	c.acks = newClientAcks()
+
+	for i := 0; i < 5; i++ {
+		if !c.receive([]byte(`{"AckSeq": 1}`)) {
+			t.Fatal("disconnected for acking")
+		}
+	}
+	if !c.receive([]byte(changeFP)) {
+		t.Fatal("disconnected for the first message")
+	}
+	select {
+	case msg := <-c.send:
+		t.Fatalf("answered %+v", msg.Error)
+	case msg := <-published:
+		if nil == msg.Payload {
+			t.Errorf("published %+v", msg)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("message not published")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type ClientInfo struct {
+	CID        string    `json:"CID"`
+	Type       string    `json:"Type"`
+	Username   string    `json:"Username,omitempty"`
+	RemoteAddr string    `json:"RemoteAddr"`
+	Transport  string    `json:"Transport"`
+	Since      time.Time `json:"ConnectedSince"`
+	QueueDepth int       `json:"QueueDepth"`
+}
+
+type BroadcastReq struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+type BroadcastResp struct {
+	Delivered int `json:"Delivered"`
+}
+
+func clientInfo(c *Client) ClientInfo {
+	return ClientInfo{
+		CID:        c.cid,
+		Type:       c.Type,
+		Username:   c.user,
+		RemoteAddr: c.addr,
+		Transport:  c.t.name(),
+		Since:      c.since,
+		QueueDepth: len(c.send),
+	}
+}
+
+// clientInfos returns a snapshot of the registered clients, optionally
+// filtered by client type.
+func (h *Hub) clientInfos(ctype string) []ClientInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	infos := make([]ClientInfo, 0, len(h.clients))
+	for _, c := range h.clients {
+		if "" == ctype || c.Type == ctype {
+			infos = append(infos, clientInfo(c))
+		}
+	}
+	return infos
+}
+
+// disconnect sends a close frame to the client and drops the connection.
+// The client's transport notices and unregisters the client.
+func (h *Hub) disconnect(c *Client, reason string) {
+	c.t.close(reason)
+}
+
+// broadcast queues an operator notice for every client of the given type,
+// or for every client when ctype is empty. It returns the number of clients
+// the notice was queued for.
+func (h *Hub) broadcast(ctype string, notice string) int {
+	msg := &ClientMessage{Type: ctype, Payload: &Payload{Notice: &notice}}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n := 0
+	for _, c := range h.clients {
+		if "" == ctype || c.Type == ctype {
+			h.deliver(c, msg)
+			n++
+		}
+	}
+	return n
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		adminLog.Warn("error writing response", "err", err)
+	}
+}
+
+func adminError(w http.ResponseWriter, status int, msg string) {
+	writeAdminJSON(w, status, map[string]string{"Error": msg})
+}
+
+// adminAuth rejects requests that don't carry the configured bearer token.
+func adminAuth(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := r.Header.Get("Authorization")
+		got := strings.TrimPrefix(h, "Bearer ")
+		if got == h || 1 != subtle.ConstantTimeCompare([]byte(got), []byte(token)) {
+			adminLog.Warn("unauthorized request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			adminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// serveClients handles
+//
+//	GET    /clients[?type=RA]  list connected clients
+//	GET    /clients/{cid}      fetch one client
+//	DELETE /clients/{cid}      forcibly disconnect a client
+func serveClients(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	cid := strings.Trim(strings.TrimPrefix(r.URL.Path, "/clients"), "/")
+	if "" == cid {
+		if http.MethodGet != r.Method {
+			adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, hub.clientInfos(r.URL.Query().Get("type")))
+		return
+	}
+
+	client := hub.client(cid)
+	if nil == client {
+		adminError(w, http.StatusNotFound, "client not found")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		hub.mu.RLock()
+		info := clientInfo(client)
+		hub.mu.RUnlock()
+		writeAdminJSON(w, http.StatusOK, info)
+	case http.MethodDelete:
+		adminLog.Info("disconnecting client", "cid", cid, "remote", r.RemoteAddr)
+		hub.disconnect(client, "disconnected by operator")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// serveBroadcast handles POST /broadcast with a BroadcastReq body.
+func serveBroadcast(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if http.MethodPost != r.Method {
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	req := &BroadcastReq{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || "" == req.Message {
+		adminError(w, http.StatusBadRequest, "body must be {\"Type\": ..., \"Message\": ...}")
+		return
+	}
+	n := hub.broadcast(req.Type, req.Message)
+	adminLog.Info("broadcast", "type", req.Type, "delivered", n, "remote", r.RemoteAddr)
+	writeAdminJSON(w, http.StatusOK, BroadcastResp{Delivered: n})
+}
+
+// serveAdmin runs the admin API on its own listener so it can be bound to a
+// private interface. It is disabled unless both an address and a token are
+// configured.
+func serveAdmin(hub *Hub, c AdminConfig) {
+	if "" == c.Addr || "" == c.Token {
+		adminLog.Warn("admin api disabled: admin addr and token must be set")
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", adminAuth(c.Token, func(w http.ResponseWriter, r *http.Request) {
+		serveClients(hub, w, r)
+	}))
+	mux.HandleFunc("/clients/", adminAuth(c.Token, func(w http.ResponseWriter, r *http.Request) {
+		serveClients(hub, w, r)
+	}))
+	mux.HandleFunc("/broadcast", adminAuth(c.Token, func(w http.ResponseWriter, r *http.Request) {
+		serveBroadcast(hub, w, r)
+	}))
+	adminLog.Info("admin api started", "addr", c.Addr)
+	err := http.ListenAndServe(c.Addr, mux)
+	if err != nil {
+		adminLog.Error("ListenAndServe", "err", err)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	next := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	for _, tc := range []struct {
+		header string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"s3cret", http.StatusUnauthorized},
+		{"Basic s3cret", http.StatusUnauthorized},
+		{"Bearer nope", http.StatusUnauthorized},
+		{"Bearer ", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusNoContent},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/clients", nil)
+		if "" != tc.header {
+			r.Header.Set("Authorization", tc.header)
+		}
+		w := httptest.NewRecorder()
+		adminAuth("s3cret", next)(w, r)
+		if tc.status != w.Code {
+			t.Errorf("authorization %q: status %d, want %d", tc.header, w.Code, tc.status)
+		}
+		if http.StatusUnauthorized == w.Code && "Bearer" != w.Header().Get("WWW-Authenticate") {
+			t.Errorf("authorization %q: no Bearer challenge", tc.header)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Admission control caps the websocket connections the gateway accepts, in
+// total, per endpoint, per remote IP and per authenticated user (see
+// auth.go). Anonymous connections count against the per-IP cap only. A slot
+// is taken before the upgrade and given back when the client unregisters.
+// Upgrades over a gateway-wide or endpoint limit are refused with 503, those
+// over a per-IP or per-user cap with 429. Zero means no limit.
+
+type AdmissionConfig struct {
+	MaxConnections int            `json:"max_connections,omitempty"`
+	Endpoints      map[string]int `json:"endpoints,omitempty"` // route -> max connections
+	PerIP          int            `json:"per_ip,omitempty"`
+	PerUser        int            `json:"per_user,omitempty"`
+}
+
+// seconds clients are asked to wait after a 503
+const admissionRetryAfter = 5
+
+// reasons an upgrade is refused
+const (
+	refuseTotal    = "max_connections"
+	refuseEndpoint = "endpoint"
+	refuseIP       = "per_ip"
+	refuseUser     = "per_user"
+)
+
+var rejectedUpgrades = newCounterVec("wsapigw_rejected_upgrades_total",
+	"Websocket upgrades refused by admission control.", "route", "reason")
+
+type admission struct {
+	c         AdmissionConfig
+	mu        sync.Mutex
+	total     int
+	endpoints map[string]int
+	ips       map[string]int
+	users     map[string]int
+}
+
+var admitter = newAdmission(AdmissionConfig{})
+
+func newAdmission(c AdmissionConfig) *admission {
+	return &admission{
+		c:         c,
+		endpoints: make(map[string]int),
+		ips:       make(map[string]int),
+		users:     make(map[string]int),
+	}
+}
+
+func initAdmission(c AdmissionConfig) {
+	admitter = newAdmission(c)
+}
+
+func remoteIP(r *http.Request) string {
+	return addrIP(r.RemoteAddr)
+}
+
+// addrIP returns the host of a remote address.
+func addrIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func over(limit int, n int) bool {
+	return limit > 0 && n >= limit
+}
+
+// admit takes a connection slot for the request, returning the function
+// that gives it back, or the reason it was refused.
+func (a *admission) admit(route string, ip string, user string) (func(), string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case over(a.c.MaxConnections, a.total):
+		return nil, refuseTotal
+	case over(a.c.Endpoints[route], a.endpoints[route]):
+		return nil, refuseEndpoint
+	case over(a.c.PerIP, a.ips[ip]):
+		return nil, refuseIP
+	case "" != user && over(a.c.PerUser, a.users[user]):
+		return nil, refuseUser
+	}
+	a.total++
+	a.endpoints[route]++
+	a.ips[ip]++
+	if "" != user {
+		a.users[user]++
+	}
+	var once sync.Once
+	return func() { once.Do(func() { a.release(route, ip, user) }) }, ""
+}
+
+func decrement(m map[string]int, k string) {
+	if m[k] <= 1 {
+		delete(m, k)
+	} else {
+		m[k]--
+	}
+}
+
+func (a *admission) release(route string, ip string, user string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.total--
+	decrement(a.endpoints, route)
+	decrement(a.ips, ip)
+	if "" != user {
+		decrement(a.users, user)
+	}
+}
+
+// refuseOverLimit answers the request of user, "" when anonymous, when
+// admission control turns it down. Otherwise it returns the function
+// releasing the connection slot.
+func refuseOverLimit(w http.ResponseWriter, r *http.Request, route string, user string) (func(), bool) {
+	ip := remoteIP(r)
+	release, reason := admitter.admit(route, ip, user)
+	if "" == reason {
+		return release, false
+	}
+	rejectedUpgrades.inc(route, reason)
+	wsLog.Warn("refusing upgrade", "route", route, "remote", ip, "reason", reason)
+	status := http.StatusTooManyRequests
+	if refuseTotal == reason || refuseEndpoint == reason {
+		status = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", strconv.Itoa(admissionRetryAfter))
+	}
+	http.Error(w, "connection limit reached: "+reason, status)
+	return nil, true
+}
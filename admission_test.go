@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAdmit(t *testing.T) {
+	type conn struct {
+		ip, user string
+		reason   string
+	}
+	for _, tc := range []struct {
+		name  string
+		c     AdmissionConfig
+		conns []conn
+	}{
+		{"per user across IPs", AdmissionConfig{PerUser: 2}, []conn{
+			{"10.0.0.1", "jdelacruz", ""},
+			{"10.0.0.2", "jdelacruz", ""},
+			{"10.0.0.3", "jdelacruz", refuseUser},
+			{"10.0.0.3", "msantos", ""},
+		}},
+		{"anonymous only per IP", AdmissionConfig{PerUser: 1, PerIP: 2}, []conn{
+			{"10.0.0.1", "", ""},
+			{"10.0.0.1", "", ""},
+			{"10.0.0.1", "", refuseIP},
+			{"10.0.0.2", "", ""},
+		}},
+		{"user over the per-IP cap", AdmissionConfig{PerUser: 5, PerIP: 1}, []conn{
+			{"10.0.0.1", "jdelacruz", ""},
+			{"10.0.0.1", "jdelacruz", refuseIP},
+		}},
+		{"total before the others", AdmissionConfig{MaxConnections: 1, PerUser: 1}, []conn{
+			{"10.0.0.1", "jdelacruz", ""},
+			{"10.0.0.1", "jdelacruz", refuseTotal},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newAdmission(tc.c)
+			var releases []func()
+			for i, c := range tc.conns {
+				release, reason := a.admit("/fpa", c.ip, c.user)
+				if reason != c.reason {
+					t.Fatalf("connection %d: refused for %q, want %q", i, reason, c.reason)
+				}
+				if nil != release {
+					releases = append(releases, release)
+				}
+			}
+			for _, release := range releases {
+				release()
+				release()
+			}
+			if 0 != a.total || 0 != len(a.ips) || 0 != len(a.users) || 0 != len(a.endpoints) {
+				t.Errorf("slots left after release: total %d, ips %v, users %v", a.total, a.ips, a.users)
+			}
+		})
+	}
+}
+
+// Frames well over a few hundred bytes go through; one over maxMessageSize
+// closes the connection.
+func TestReadLimit(t *testing.T) {
+	withDedup(t)
+	h, published := readyHub(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveRA(h, w, r)
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	big := strings.Replace(changeFP, `"k1"`, `"`+strings.Repeat("k", 4096)+`"`, 1)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(big)); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.After(3 * time.Second); ; {
+		select {
+		case m := <-published:
+			if nil == m.Payload {
+				continue
+			}
+		case <-deadline:
+			t.Fatal("4 KiB message not published")
+		}
+		break
+	}
+
+	conn.WriteMessage(websocket.TextMessage, make([]byte, maxMessageSize+1))
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if nil == err {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+			t.Errorf("read after the oversized frame: %v, want close code 1009", err)
+		}
+		return
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Clients connect anonymously unless they present one of the auth.tokens,
+// which maps each token to the user it authenticates:
+//
+//	Authorization: Bearer <token>
+//
+// or, since browsers can't set headers on websocket upgrades and
+// EventSource requests, the access_token query parameter. A request with a
+// token the gateway doesn't know, or another Authorization scheme, is refused
+// with 401. The user is the client's identity for the per-user rate limits,
+// connection caps and idempotency keys, and the only way to receive what the
+// outbox keeps for a user. The Username in a client's messages is just data.
+
+type AuthConfig struct {
+	Tokens map[string]string `json:"tokens,omitempty"` // token -> username
+}
+
+type authToken struct {
+	token []byte
+	user  string
+}
+
+var authTokens []authToken
+
+func initAuth(c AuthConfig) {
+	for token, user := range c.Tokens {
+		if "" == token || "" == user {
+			wsLog.Error("ignoring auth token without a username")
+			continue
+		}
+		authTokens = append(authTokens, authToken{token: []byte(token), user: user})
+	}
+}
+
+// authenticate returns the user a request authenticates as, "" for an
+// anonymous request, and false when its token is unknown or isn't sent as a
+// bearer token.
+func authenticate(r *http.Request) (string, bool) {
+	got := r.URL.Query().Get("access_token")
+	if h := r.Header.Get("Authorization"); "" != h {
+		got = strings.TrimPrefix(h, "Bearer ")
+		if got == h || "" == got {
+			return "", false
+		}
+	}
+	if "" == got {
+		return "", true
+	}
+	user := ""
+	for _, t := range authTokens {
+		if 1 == subtle.ConstantTimeCompare([]byte(got), t.token) {
+			user = t.user
+		}
+	}
+	return user, "" != user
+}
+
+// refuseUnauthenticated answers a request whose token is refused.
+// Otherwise it returns the request's user, "" when anonymous.
+func refuseUnauthenticated(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, ok := authenticate(r)
+	if ok {
+		return user, false
+	}
+	wsLog.Warn("unknown auth token", "route", r.URL.Path, "remote", r.RemoteAddr)
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return "", true
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	authTokens = nil
+	initAuth(AuthConfig{Tokens: map[string]string{"s3cret": "jdelacruz", "other": "msantos"}})
+	defer func() { authTokens = nil }()
+
+	for _, tc := range []struct {
+		name   string
+		url    string
+		header string
+		user   string
+		ok     bool
+	}{
+		{"anonymous", "/fpa", "", "", true},
+		{"bearer", "/fpa", "Bearer s3cret", "jdelacruz", true},
+		{"query", "/fpa?access_token=other", "", "msantos", true},
+		{"header wins", "/fpa?access_token=other", "Bearer s3cret", "jdelacruz", true},
+		{"unknown", "/fpa", "Bearer nope", "", false},
+		{"unknown query", "/fpa?access_token=nope", "", "", false},
+		{"bare token", "/fpa", "s3cret", "", false},
+		{"other scheme", "/fpa", "Basic s3cret", "", false},
+		{"empty bearer", "/fpa", "Bearer ", "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tc.url, nil)
+			if "" != tc.header {
+				r.Header.Set("Authorization", tc.header)
+			}
+			user, ok := authenticate(r)
+			if user != tc.user || ok != tc.ok {
+				t.Errorf("authenticate = %q, %v; want %q, %v", user, ok, tc.user, tc.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// Avro support for the schema registry wire format. The gateway's schema is
+// derived from the Go structs: records are named after the struct, fields after
+// their JSON names, pointers become unions with null. Records are decoded with
+// the writer's schema into generic values and then mapped onto ClientMessage by
+// field name, so fields added or removed by other producers are tolerated.
+
+const avroNamespace = "wsapigw"
+
+// avroSchema returns the Avro schema of the struct type t.
+func avroSchema(t reflect.Type) ([]byte, error) {
+	return json.Marshal(avroSchemaOf(t, map[string]bool{}))
+}
+
+func avroSchemaOf(t reflect.Type, defined map[string]bool) interface{} {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Uint64:
+		return "long"
+	case reflect.Ptr:
+		return []interface{}{"null", avroSchemaOf(t.Elem(), defined)}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": avroSchemaOf(t.Elem(), defined)}
+	case reflect.Struct:
+		if defined[t.Name()] {
+			return t.Name()
+		}
+		defined[t.Name()] = true
+		fields := make([]interface{}, 0, t.NumField())
+		for _, f := range avroFields(t) {
+			ft := t.Field(f.index).Type
+			field := map[string]interface{}{"name": f.name, "type": avroSchemaOf(ft, defined)}
+			switch ft.Kind() {
+			case reflect.String:
+				field["default"] = ""
+			case reflect.Uint64:
+				field["default"] = 0
+			case reflect.Ptr:
+				field["default"] = nil
+			case reflect.Slice:
+				field["default"] = []interface{}{}
+			}
+			fields = append(fields, field)
+		}
+		return map[string]interface{}{
+			"type":      "record",
+			"name":      t.Name(),
+			"namespace": avroNamespace,
+			"fields":    fields,
+		}
+	}
+	panic("avro: unsupported type " + t.String())
+}
+
+type avroField struct {
+	name  string
+	index int
+}
+
+// avroFields lists the exported fields of t under their JSON names.
+func avroFields(t reflect.Type) []avroField {
+	var fields []avroField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if "" != f.PkgPath {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if "-" == name {
+			continue
+		}
+		if "" == name {
+			name = f.Name
+		}
+		fields = append(fields, avroField{name, i})
+	}
+	return fields
+}
+
+func avroLong(buf *bytes.Buffer, n int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], n)])
+}
+
+func avroString(buf *bytes.Buffer, s string) {
+	avroLong(buf, int64(len(s)))
+	buf.WriteString(s)
+}
+
+// avroEncode writes v in the binary encoding of the schema avroSchemaOf
+// derives from its type.
+func avroEncode(buf *bytes.Buffer, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		avroString(buf, v.String())
+	case reflect.Uint64:
+		avroLong(buf, int64(v.Uint()))
+	case reflect.Ptr:
+		if v.IsNil() {
+			avroLong(buf, 0)
+			return
+		}
+		avroLong(buf, 1)
+		avroEncode(buf, v.Elem())
+	case reflect.Slice:
+		if 0 != v.Len() {
+			avroLong(buf, int64(v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				avroEncode(buf, v.Index(i))
+			}
+		}
+		avroLong(buf, 0)
+	case reflect.Struct:
+		for _, f := range avroFields(v.Type()) {
+			avroEncode(buf, v.Field(f.index))
+		}
+	}
+}
+
+// avroType is a parsed writer schema.
+type avroType struct {
+	kind    string // primitive name, "record", "enum", "array", "map", "union" or "fixed"
+	name    string
+	fields  []avroFieldType
+	symbols []string
+	items   *avroType   // array items and map values
+	union   []*avroType // union branches
+	size    int         // fixed
+}
+
+type avroFieldType struct {
+	name string
+	typ  *avroType
+}
+
+// parseAvro parses a writer schema as fetched from the registry.
+func parseAvro(schema string) (*avroType, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(schema), &v); err != nil {
+		return nil, err
+	}
+	return parseAvroType(v, "", map[string]*avroType{})
+}
+
+func avroFullName(name string, ns string) string {
+	if strings.Contains(name, ".") || "" == ns {
+		return name
+	}
+	return ns + "." + name
+}
+
+func parseAvroType(v interface{}, ns string, named map[string]*avroType) (*avroType, error) {
+	switch v := v.(type) {
+	case string:
+		switch v {
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			return &avroType{kind: v}, nil
+		}
+		if t, ok := named[avroFullName(v, ns)]; ok {
+			return t, nil
+		}
+		if t, ok := named[v]; ok {
+			return t, nil
+		}
+		return nil, fmt.Errorf("avro: unknown type %q", v)
+	case []interface{}:
+		t := &avroType{kind: "union"}
+		for _, b := range v {
+			bt, err := parseAvroType(b, ns, named)
+			if err != nil {
+				return nil, err
+			}
+			t.union = append(t.union, bt)
+		}
+		return t, nil
+	case map[string]interface{}:
+		kind, _ := v["type"].(string)
+		switch kind {
+		case "record", "error", "enum", "fixed":
+			name, _ := v["name"].(string)
+			if "" == name {
+				return nil, errors.New("avro: named type without a name")
+			}
+			if s, ok := v["namespace"].(string); ok {
+				ns = s
+			}
+			full := avroFullName(name, ns)
+			if i := strings.LastIndex(full, "."); i >= 0 {
+				ns = full[:i]
+			}
+			t := &avroType{kind: kind, name: full}
+			if "error" == kind {
+				t.kind = "record"
+			}
+			// registered before the fields are parsed so records can refer
+			// to themselves
+			named[full] = t
+			switch kind {
+			case "enum":
+				for _, s := range asList(v["symbols"]) {
+					sym, _ := s.(string)
+					t.symbols = append(t.symbols, sym)
+				}
+			case "fixed":
+				size, _ := v["size"].(float64)
+				t.size = int(size)
+			default:
+				for _, f := range asList(v["fields"]) {
+					fm, _ := f.(map[string]interface{})
+					fname, _ := fm["name"].(string)
+					ft, err := parseAvroType(fm["type"], ns, named)
+					if err != nil {
+						return nil, err
+					}
+					t.fields = append(t.fields, avroFieldType{fname, ft})
+				}
+			}
+			return t, nil
+		case "array":
+			items, err := parseAvroType(v["items"], ns, named)
+			if err != nil {
+				return nil, err
+			}
+			return &avroType{kind: "array", items: items}, nil
+		case "map":
+			values, err := parseAvroType(v["values"], ns, named)
+			if err != nil {
+				return nil, err
+			}
+			return &avroType{kind: "map", items: values}, nil
+		}
+		// {"type": "string", "logicalType": ...} and the like
+		return parseAvroType(v["type"], ns, named)
+	}
+	return nil, fmt.Errorf("avro: invalid schema %v", v)
+}
+
+func asList(v interface{}) []interface{} {
+	l, _ := v.([]interface{})
+	return l
+}
+
+var errAvroShort = errors.New("avro: unexpected end of data")
+
+type avroReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *avroReader) long() (int64, error) {
+	n, size := binary.Varint(r.data[r.pos:])
+	if size <= 0 {
+		return 0, errAvroShort
+	}
+	r.pos += size
+	return n, nil
+}
+
+func (r *avroReader) next(n int64) ([]byte, error) {
+	if n < 0 || int64(len(r.data)-r.pos) < n {
+		return nil, errAvroShort
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+// count reads the item count of an array or map block. Negative counts are
+// followed by the block's size in bytes.
+func (r *avroReader) count() (int64, error) {
+	n, err := r.long()
+	if err != nil || n >= 0 {
+		return n, err
+	}
+	if _, err := r.long(); err != nil {
+		return 0, err
+	}
+	return -n, nil
+}
+
+func (r *avroReader) read(t *avroType, depth int) (interface{}, error) {
+	if depth > protoMaxDepth {
+		return nil, errors.New("avro: nesting too deep")
+	}
+	switch t.kind {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := r.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return 0 != b[0], nil
+	case "int", "long":
+		return r.long()
+	case "float":
+		b, err := r.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+	case "double":
+		b, err := r.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	case "bytes", "string":
+		n, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.next(n)
+		return string(b), err
+	case "fixed":
+		b, err := r.next(int64(t.size))
+		return string(b), err
+	case "enum":
+		i, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(t.symbols)) {
+			return nil, fmt.Errorf("avro: enum index %d out of range", i)
+		}
+		return t.symbols[i], nil
+	case "union":
+		i, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(t.union)) {
+			return nil, fmt.Errorf("avro: union index %d out of range", i)
+		}
+		return r.read(t.union[i], depth+1)
+	case "record":
+		m := make(map[string]interface{}, len(t.fields))
+		for _, f := range t.fields {
+			v, err := r.read(f.typ, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			m[f.name] = v
+		}
+		return m, nil
+	case "array":
+		a := make([]interface{}, 0)
+		for {
+			n, err := r.count()
+			if err != nil {
+				return nil, err
+			}
+			if 0 == n {
+				return a, nil
+			}
+			for ; n > 0; n-- {
+				v, err := r.read(t.items, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				a = append(a, v)
+			}
+		}
+	case "map":
+		m := make(map[string]interface{})
+		for {
+			n, err := r.count()
+			if err != nil {
+				return nil, err
+			}
+			if 0 == n {
+				return m, nil
+			}
+			for ; n > 0; n-- {
+				l, err := r.long()
+				if err != nil {
+					return nil, err
+				}
+				k, err := r.next(l)
+				if err != nil {
+					return nil, err
+				}
+				v, err := r.read(t.items, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				m[string(k)] = v
+			}
+		}
+	}
+	return nil, fmt.Errorf("avro: unsupported type %q", t.kind)
+}
+
+// avroDecode decodes data written with the writer schema t into msg.
+func avroDecode(data []byte, t *avroType, msg *ClientMessage) error {
+	r := &avroReader{data: data}
+	v, err := r.read(t, 0)
+	if err != nil {
+		return err
+	}
+	if r.pos != len(data) {
+		return errors.New("avro: trailing data")
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, msg)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAvroRoundTrip(t *testing.T) {
+	schema, err := avroSchema(reflect.TypeOf(ClientMessage{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := parseAvro(string(schema))
+	if err != nil {
+		t.Fatalf("gateway schema doesn't parse: %v", err)
+	}
+	for name, msg := range testMessages() {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			avroEncode(&buf, reflect.ValueOf(msg).Elem())
+			got := &ClientMessage{}
+			if err := avroDecode(buf.Bytes(), writer, got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, msg) {
+				t.Errorf("got %+v, want %+v", got, msg)
+			}
+		})
+	}
+}
+
+// record is the schema of a ClientMessage record with the given fields.
+func record(fields ...string) string {
+	return `{"type": "record", "name": "ClientMessage", "namespace": "other", "fields": [` + strings.Join(fields, ", ") + `]}`
+}
+
+// Records written by other producers are decoded with their schema, and
+// mapped onto ClientMessage by field name.
+func TestAvroWriterSchemas(t *testing.T) {
+	cid := `{"name": "CID", "type": "string"}`
+	status := `{"name": "Status", "type": "string"}`
+	for _, tc := range []struct {
+		name   string
+		schema string
+		data   []byte
+		want   *ClientMessage
+		err    string
+	}{
+		{"added and removed fields", record(cid, `{"name": "Extra", "type": "long"}`, status),
+			[]byte{0x04, 'c', '1', 0x0a, 0x04, 'o', 'k'}, &ClientMessage{CID: "c1", Status: "ok"}, ""},
+		{"union", record(`{"name": "CID", "type": ["null", "string"]}`),
+			[]byte{0x02, 0x02, 'x'}, &ClientMessage{CID: "x"}, ""},
+		{"null union branch", record(`{"name": "CID", "type": ["null", "string"]}`),
+			[]byte{0x00}, &ClientMessage{}, ""},
+		{"enum", record(`{"name": "Status", "type": {"type": "enum", "name": "S", "symbols": ["PENDING", "ENROLLED"]}}`),
+			[]byte{0x02}, &ClientMessage{Status: "ENROLLED"}, ""},
+		{"logical type", record(`{"name": "At", "type": {"type": "long", "logicalType": "timestamp-millis"}}`, cid),
+			[]byte{0x80, 0x01, 0x02, 'x'}, &ClientMessage{CID: "x"}, ""},
+		{"map", record(`{"name": "Meta", "type": {"type": "map", "values": "string"}}`, cid),
+			[]byte{0x02, 0x02, 'k', 0x02, 'v', 0x00, 0x02, 'x'}, &ClientMessage{CID: "x"}, ""},
+		{"array block with size", record(`{"name": "Tags", "type": {"type": "array", "items": "string"}}`, cid),
+			[]byte{0x01, 0x04, 0x02, 'a', 0x00, 0x02, 'x'}, &ClientMessage{CID: "x"}, ""},
+		{"fixed, boolean, float and double", record(
+			`{"name": "F", "type": {"type": "fixed", "name": "Two", "size": 2}}`,
+			`{"name": "B", "type": "boolean"}`, `{"name": "S", "type": "float"}`, `{"name": "D", "type": "double"}`, cid),
+			[]byte{'a', 'b', 0x01, 0, 0, 0x80, 0x3f, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0x02, 'x'}, &ClientMessage{CID: "x"}, ""},
+		{"named type reference", record(
+			`{"name": "Error", "type": ["null", {"type": "record", "name": "E", "fields": [{"name": "Code", "type": "string"}]}]}`,
+			`{"name": "Payload", "type": ["null", {"type": "record", "name": "P", "fields": [{"name": "Notice", "type": ["null", "string"]}]}]}`,
+			`{"name": "Prev", "type": ["null", "other.E"]}`),
+			[]byte{0x02, 0x02, 'c', 0x02, 0x02, 0x02, 'n', 0x02, 0x02, 'd'},
+			&ClientMessage{Error: &ErrorInfo{Code: "c"}, Payload: &Payload{Notice: strp("n")}}, ""},
+		{"truncated", record(cid), []byte{0x04, 'c'}, nil, "unexpected end"},
+		{"trailing data", record(cid), []byte{0x02, 'c', 0x00}, nil, "trailing data"},
+		{"union index out of range", record(`{"name": "CID", "type": ["null", "string"]}`), []byte{0x04}, nil, "union index 2"},
+		{"enum index out of range", record(`{"name": "Status", "type": {"type": "enum", "name": "S", "symbols": ["A"]}}`),
+			[]byte{0x02}, nil, "enum index 1"},
+		{"unknown type", record(`{"name": "CID", "type": "uuid4"}`), nil, nil, `unknown type "uuid4"`},
+		{"named type without a name", record(`{"name": "CID", "type": {"type": "enum", "symbols": ["A"]}}`), nil, nil, "without a name"},
+		{"field of another type", record(`{"name": "CID", "type": "long"}`), []byte{0x02}, nil, "cannot unmarshal number"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			writer, err := parseAvro(tc.schema)
+			if nil == err {
+				got := &ClientMessage{}
+				if err = avroDecode(tc.data, writer, got); nil == err && "" == tc.err && !reflect.DeepEqual(got, tc.want) {
+					t.Errorf("got %+v, want %+v", got, tc.want)
+				}
+			}
+			if "" == tc.err {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if nil == err || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error %v, want one containing %q", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The hub talks to its message broker through Publisher and Subscriber, so
+// the gateway isn't tied to Kafka: broker.type picks Kafka (the default), the
+// in-memory stand-in (membroker.go) or Redis Streams (redis.go). Records are
+// addressed Kafka-style by topic, partition and offset; brokers without
+// partitions use partition 0 and map their own ids onto increasing offsets.
+
+// Record is a message written to or read from a broker topic.
+type Record struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte // nil for a tombstone
+	Headers   map[string]string
+	Timestamp time.Time
+	// broker specific id, for brokers whose offsets don't identify records
+	id string
+}
+
+// Publisher writes records to topics.
+type Publisher interface {
+	// Publish writes r to r.Topic and sets its partition and offset.
+	Publish(r *Record) error
+	Close() error
+}
+
+// Subscriber is a consumer group member receiving the records of the
+// gateway's topics.
+type Subscriber interface {
+	// Records is closed once the subscriber is.
+	Records() <-chan *Record
+	Errors() <-chan error
+	// Commit marks r as processed. A partition's records are committed in
+	// order, so brokers tracking a single position may commit up to r.
+	Commit(r *Record) error
+	Closed() bool
+	Close() error
+}
+
+var (
+	// errBrokerClosed is returned by publishers and subscribers whose
+	// connection is gone for good.
+	errBrokerClosed     = errors.New("broker connection closed")
+	errUnknownPartition = errors.New("unknown topic or partition")
+)
+
+var errConsumerClosed = errors.New("consumer group closed")
+
+const (
+	// Delay before the first reconnection attempt, doubled after each failure.
+	minBackoff = 1 * time.Second
+
+	// Upper bound for the reconnection delay.
+	maxBackoff = 30 * time.Second
+)
+
+// cluster answers what the gateway asks the brokers beyond producing and
+// consuming in its group.
+type cluster interface {
+	// highWaterMark returns the offset the next record of a partition gets.
+	highWaterMark(topic string, partition int32) (int64, error)
+	// checkBrokers and checkPartitions are readiness checks.
+	checkBrokers() string
+	checkPartitions(group string, topics []string) string
+	// readTopic passes every record of topic, from the oldest, to apply and
+	// follows the topic until stop is closed.
+	readTopic(topic string, stop <-chan struct{}, apply func(*Record)) error
+	close()
+}
+
+// brokerConn bundles the broker handles that are set up and torn down
+// together: Kafka and ZooKeeper, Redis, or the in-memory stand-in. Once fail
+// is called the connection is considered dead and maintainBroker replaces it.
+type brokerConn struct {
+	pub     Publisher
+	sub     Subscriber
+	cluster cluster
+	dead    chan struct{}
+	once    sync.Once
+	err     error
+	// cmu guards commits, the in-order commit state per partition used by
+	// the after_delivery commit mode
+	cmu     sync.Mutex
+	commits map[partitionKey]*partitionCommits
+}
+
+// brokerSystem names the broker in the messaging.system span attribute.
+func brokerSystem(c BrokerConfig) string {
+	if "" == c.Type {
+		return brokerKafka
+	}
+	return c.Type
+}
+
+// connectBroker connects to the broker broker.type names.
+func connectBroker(c *KafkaConfig, topics []string) (*brokerConn, error) {
+	switch c.Broker.Type {
+	case brokerMemory:
+		return connectMemory(c, topics), nil
+	case brokerRedis:
+		return connectRedis(c, topics)
+	}
+	return connectKafka(c, topics)
+}
+
+// fail marks the connection as dead. Only the first error is kept.
+func (k *brokerConn) fail(err error) {
+	k.once.Do(func() {
+		k.err = err
+		close(k.dead)
+	})
+}
+
+func (k *brokerConn) close() {
+	// stops whatever still follows the connection, like the outbox loader
+	k.fail(errConsumerClosed)
+	if err := k.pub.Close(); err != nil {
+		brokerLog.Warn("error closing producer", "err", err)
+	}
+	if err := k.sub.Close(); err != nil {
+		brokerLog.Warn("error closing consumer", "err", err)
+	}
+	k.cluster.close()
+}
+
+// jitter spreads reconnection attempts of several gateways over [d/2, d].
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// maintainBroker keeps the hub connected to its broker. It retries the initial
+// connection with exponential backoff, and once connected consumes until the
+// connection fails, then tears it down and starts over.
+func maintainBroker(h *Hub, c *KafkaConfig) {
+	backoff := minBackoff
+	for {
+		k, err := connectBroker(c, h.ctopics)
+		if err != nil {
+			wait := jitter(backoff)
+			brokerLog.Error("error connecting to broker", "retry_in", wait.String(), "err", err)
+			time.Sleep(wait)
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = minBackoff
+		brokerLog.Info("connected to broker")
+		h.setConn(k)
+		if o, ok := outbox.(*kafkaOutbox); ok {
+			go o.load(k)
+		}
+
+		err = consumeBroker(h, k)
+		brokerLog.Error("broker connection lost", "err", err)
+		h.setConn(nil)
+		k.close()
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// The echo plays the ledger: it answers every ledgertx.req record with a
+// reply carrying the request's CID and IdempotencyKey, produced to the reply
+// topic. Replies carry nothing else, so the gateway routes them by CID alone
+// and drops those whose client is gone. Records must be JSON, the default
+// codec.
+
+const (
+	requestTopic = "ledgertx.req"
+	echoGroup    = "wsapigw-bench"
+)
+
+var kafkaVersion = flag.String("kafka-version", "0.11.0.0", "Kafka protocol version of the kafka echo")
+
+type echoer struct {
+	forwarded int64
+	failed    int64
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closers   []func() error
+}
+
+// answer returns the reply to a request record.
+func (e *echoer) answer(value []byte) ([]byte, bool) {
+	var req struct {
+		CID            string
+		IdempotencyKey string
+	}
+	if err := json.Unmarshal(value, &req); err != nil || "" == req.CID {
+		atomic.AddInt64(&e.failed, 1)
+		return nil, false
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"CID":            req.CID,
+		"IdempotencyKey": req.IdempotencyKey,
+		"Status":         "echo",
+		"Payload":        map[string]interface{}{},
+	})
+	return b, true
+}
+
+// close stops the echo and returns how many replies it produced and how
+// many requests it failed to answer.
+func (e *echoer) close() (int, int) {
+	close(e.stop)
+	e.wg.Wait()
+	for _, c := range e.closers {
+		c()
+	}
+	return int(atomic.LoadInt64(&e.forwarded)), int(atomic.LoadInt64(&e.failed))
+}
+
+func startEcho(target string, topic string) (*echoer, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	e := &echoer{stop: make(chan struct{})}
+	switch u.Scheme {
+	case "kafka":
+		return e, e.kafka(strings.Split(u.Host, ","), topic)
+	case "http":
+		e.wg.Add(1)
+		go e.memory("http://"+u.Host, topic)
+		return e, nil
+	}
+	return nil, fmt.Errorf("unsupported echo target %q, want kafka:// or http://", target)
+}
+
+// kafka echoes from every partition of the request topic, from the newest
+// offset on.
+func (e *echoer) kafka(brokers []string, topic string) error {
+	config := sarama.NewConfig()
+	v, err := sarama.ParseKafkaVersion(*kafkaVersion)
+	if err != nil {
+		return err
+	}
+	config.Version = v
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		return err
+	}
+	e.closers = append(e.closers, producer.Close)
+	consumer, err := sarama.NewConsumer(brokers, config)
+	if err != nil {
+		return err
+	}
+	e.closers = append([]func() error{consumer.Close}, e.closers...)
+	partitions, err := consumer.Partitions(requestTopic)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for range producer.Errors() {
+			atomic.AddInt64(&e.failed, 1)
+			atomic.AddInt64(&e.forwarded, -1)
+		}
+	}()
+	for _, p := range partitions {
+		pc, err := consumer.ConsumePartition(requestTopic, p, sarama.OffsetNewest)
+		if err != nil {
+			return err
+		}
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			defer pc.Close()
+			for {
+				select {
+				case msg := <-pc.Messages():
+					reply, ok := e.answer(msg.Value)
+					if !ok {
+						continue
+					}
+					producer.Input() <- &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(reply)}
+					atomic.AddInt64(&e.forwarded, 1)
+				case <-e.stop:
+					return
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// memory echoes through the in-memory broker's HTTP API.
+func (e *echoer) memory(base string, topic string) {
+	defer e.wg.Done()
+	client := &http.Client{Timeout: time.Minute}
+	fetch := base + "/topics/" + url.PathEscape(requestTopic) + "?group=" + echoGroup + "&wait=1"
+	produce := base + "/topics/" + url.PathEscape(topic)
+	for {
+		select {
+		case <-e.stop:
+			return
+		default:
+		}
+		resp, err := client.Get(fetch)
+		if err != nil {
+			atomic.AddInt64(&e.failed, 1)
+			time.Sleep(time.Second)
+			continue
+		}
+		var records []struct{ Value string }
+		err = json.NewDecoder(resp.Body).Decode(&records)
+		resp.Body.Close()
+		if err != nil {
+			atomic.AddInt64(&e.failed, 1)
+			continue
+		}
+		for _, r := range records {
+			reply, ok := e.answer([]byte(r.Value))
+			if !ok {
+				continue
+			}
+			resp, err := client.Post(produce, "application/json", bytes.NewReader(reply))
+			if err != nil {
+				atomic.AddInt64(&e.failed, 1)
+				continue
+			}
+			resp.Body.Close()
+			if http.StatusOK != resp.StatusCode {
+				atomic.AddInt64(&e.failed, 1)
+				continue
+			}
+			atomic.AddInt64(&e.forwarded, 1)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+// Command wsapigw-bench load-tests a gateway. It opens -ra, -fpa and -fpb
+// concurrent websocket clients, each sending -rate messages per second drawn
+// from the -mix of ClientMessage kinds for -duration, and reports throughput,
+// round-trip latency percentiles and error counts.
+//
+//	wsapigw-bench -addr ws://127.0.0.1:3000 -ra 200 -fpa 100 -fpb 100 \
+//		-mix enroll=4,changefp=2,approve=3,invalid=1 -echo kafka://127.0.0.1:9092
+//
+// A round trip is a message published to ledgertx.req coming back to its
+// client. With -echo the tool plays the ledger itself, answering every
+// ledgertx.req record with a reply on -reply-topic that the gateway routes
+// back by CID; without it some other backend must answer with the request's
+// CID and IdempotencyKey. Messages of the invalid kind measure the gateway's
+// error frames instead. Give the gateway an admission.per_ip and rate limits
+// that admit the load, or the refusals are what gets measured.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	addr     = flag.String("addr", "ws://127.0.0.1:3000", "gateway websocket base URL")
+	nRA      = flag.Int("ra", 10, "RA clients")
+	nFPA     = flag.Int("fpa", 5, "FPA clients")
+	nFPB     = flag.Int("fpb", 5, "FPB clients")
+	rate     = flag.Float64("rate", 1, "messages per second each client sends")
+	duration = flag.Duration("duration", 30*time.Second, "how long clients send")
+	ramp     = flag.Float64("ramp", 100, "connections opened per second")
+	mixFlag  = flag.String("mix", "enroll=1,changefp=1,approve=1", "weights of the message kinds: "+strings.Join(kindNames(), ", "))
+	timeout  = flag.Duration("timeout", 10*time.Second, "how long to wait for a reply before counting it lost")
+	echo     = flag.String("echo", "", "answer requests by echoing ledgertx.req: kafka://host:port or the in-memory broker's http://host:port")
+	reply    = flag.String("reply-topic", "employee.updates", "topic -echo produces to; the gateway must consume it")
+	interval = flag.Duration("report", 5*time.Second, "progress report interval, 0 for none")
+	asJSON   = flag.Bool("json", false, "print the final report as JSON")
+)
+
+// error code of the invalid kind's messages
+const invalidCode = "invalid_payload"
+
+// kind is a ClientMessage the clients of some types send.
+type kind struct {
+	types   []string
+	payload func(c *client, n int) interface{}
+	// messages the gateway rejects, answered with an error frame
+	invalid bool
+}
+
+type obj = map[string]interface{}
+
+func person(id string) obj {
+	return obj{"ID": id, "FirstName": "Bench", "LastName": "Client"}
+}
+
+func fpInfo(code string) obj {
+	return obj{"FPCode": code, "FPName": code + " Fund"}
+}
+
+var kinds = map[string]kind{
+	"enroll": {types: []string{"RA"}, payload: func(c *client, n int) interface{} {
+		return obj{"EnrollmentReq": obj{"EmployeeData": person(c.empID(n)), "FPInfo": fpInfo("FPA")}}
+	}},
+	"changefp": {types: []string{"RA"}, payload: func(c *client, n int) interface{} {
+		return obj{"ChangeFPReq": obj{"EmpID": c.empID(n), "CurrFPCode": "FPA", "NewFPInfo": fpInfo("FPB")}}
+	}},
+	"approve": {types: []string{"FPA", "FPB"}, payload: func(c *client, n int) interface{} {
+		return obj{"EnrollmentApproval": obj{"EmployeeData": person(c.empID(n)), "FPInfo": fpInfo(c.ctype),
+			"Approvals": obj{"FPApproval": obj{"Status": "APPROVED"}}}}
+	}},
+	"changeapprove": {types: []string{"FPA", "FPB"}, payload: func(c *client, n int) interface{} {
+		return obj{"ChangeFPApproval": obj{"EmployeeData": c.empID(n), "FPInfo": fpInfo("FPA"), "NewFPInfo": fpInfo("FPB"),
+			"Approvals": obj{"FPApproval": obj{"Status": "APPROVED"}}}}
+	}},
+	"invalid": {types: []string{"RA", "FPA", "FPB"}, invalid: true, payload: func(c *client, n int) interface{} {
+		return obj{"EnrollmentReq": obj{"EmployeeData": obj{"ID": c.empID(n)}}}
+	}},
+}
+
+func kindNames() []string {
+	return []string{"enroll", "changefp", "approve", "changeapprove", "invalid"}
+}
+
+// mix is the weighted choice of kinds for one client type.
+type mix struct {
+	names   []string
+	weights []int
+	total   int
+}
+
+func (m *mix) pick(r *rand.Rand) string {
+	n := r.Intn(m.total)
+	for i, w := range m.weights {
+		if n < w {
+			return m.names[i]
+		}
+		n -= w
+	}
+	return m.names[len(m.names)-1]
+}
+
+// parseMix returns the mix of every client type that has kinds in it.
+func parseMix(s string) (map[string]*mix, error) {
+	mixes := make(map[string]*mix)
+	for _, part := range strings.Split(s, ",") {
+		name, w := part, 1
+		if i := strings.Index(part, "="); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("-mix: bad weight in %q", part)
+			}
+			name, w = part[:i], n
+		}
+		k, ok := kinds[name]
+		if !ok {
+			return nil, fmt.Errorf("-mix: unknown kind %q", name)
+		}
+		if 0 == w {
+			continue
+		}
+		for _, t := range k.types {
+			m := mixes[t]
+			if nil == m {
+				m = &mix{}
+				mixes[t] = m
+			}
+			m.names = append(m.names, name)
+			m.weights = append(m.weights, w)
+			m.total += w
+		}
+	}
+	return mixes, nil
+}
+
+// frame is what clients look at in the messages they receive.
+type frame struct {
+	IdempotencyKey string
+	Status         string
+	Error          *struct{ Code string }
+}
+
+type client struct {
+	id     int
+	ctype  string
+	conn   *websocket.Conn
+	stats  *stats
+	mix    *mix
+	rand   *rand.Rand
+	mu     sync.Mutex
+	sent   map[string]time.Time // IdempotencyKey -> send time of awaited replies
+	errors []time.Time          // send times of awaited error frames, in order
+}
+
+func (c *client) empID(n int) string {
+	return fmt.Sprintf("B-%s-%d-%d", c.ctype, c.id, n)
+}
+
+func (c *client) key(n int) string {
+	return fmt.Sprintf("%s-%d-%d", c.ctype, c.id, n)
+}
+
+func (c *client) dial(endpoint string) error {
+	start := time.Now()
+	conn, resp, err := websocket.DefaultDialer.Dial(*addr+endpoint, nil)
+	if err != nil {
+		reason := err.Error()
+		if nil != resp {
+			reason = "http " + strconv.Itoa(resp.StatusCode)
+		}
+		c.stats.connectFailed(reason)
+		return err
+	}
+	c.conn = conn
+	c.stats.connected(time.Since(start))
+	return nil
+}
+
+func (c *client) read(done chan<- struct{}) {
+	defer close(done)
+	for {
+		_, b, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		var f frame
+		if err := json.Unmarshal(b, &f); err != nil {
+			c.stats.received("undecodable")
+			continue
+		}
+		c.mu.Lock()
+		switch {
+		case nil != f.Error:
+			var rtt time.Duration
+			// valid messages can be rejected too, by rate limits for one
+			if invalidCode == f.Error.Code && 0 != len(c.errors) {
+				rtt = now.Sub(c.errors[0])
+				c.errors = c.errors[1:]
+			}
+			c.mu.Unlock()
+			c.stats.errorFrame(f.Error.Code, rtt)
+		case "" != f.IdempotencyKey && !c.sent[f.IdempotencyKey].IsZero():
+			rtt := now.Sub(c.sent[f.IdempotencyKey])
+			delete(c.sent, f.IdempotencyKey)
+			c.mu.Unlock()
+			if "duplicate" == f.Status {
+				c.stats.received("duplicate")
+			} else {
+				c.stats.replied(c.ctype, rtt)
+			}
+		default:
+			c.mu.Unlock()
+			c.stats.received("other")
+		}
+	}
+}
+
+// run sends until stop is closed, then waits up to -timeout for what is
+// still awaited.
+func (c *client) run(stop <-chan struct{}) {
+	done := make(chan struct{})
+	go c.read(done)
+	defer c.conn.Close()
+
+	period := time.Duration(float64(time.Second) / *rate)
+	// spread the clients' sends over the period
+	time.Sleep(time.Duration(c.rand.Int63n(int64(period) + 1)))
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for n := 0; ; n++ {
+		name := c.mix.pick(c.rand)
+		k := kinds[name]
+		msg := obj{"Type": c.ctype, "Payload": k.payload(c, n)}
+		key := c.key(n)
+		c.mu.Lock()
+		if k.invalid {
+			c.errors = append(c.errors, time.Now())
+		} else {
+			msg["IdempotencyKey"] = key
+			c.sent[key] = time.Now()
+		}
+		c.mu.Unlock()
+		if err := c.conn.WriteJSON(msg); err != nil {
+			c.stats.disconnected()
+			c.stats.lost(c.awaited())
+			return
+		}
+		c.stats.sentOne(name)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			c.drain(done)
+			return
+		case <-done:
+			c.stats.disconnected()
+			c.stats.lost(c.awaited())
+			return
+		}
+	}
+}
+
+// awaited returns how many replies and error frames are still awaited.
+func (c *client) awaited() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sent) + len(c.errors)
+}
+
+func (c *client) drain(done <-chan struct{}) {
+	deadline := time.NewTimer(*timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(10 * time.Millisecond)
+	defer poll.Stop()
+wait:
+	for 0 != c.awaited() {
+		select {
+		case <-poll.C:
+		case <-deadline.C:
+			break wait
+		case <-done:
+			c.stats.disconnected()
+			break wait
+		}
+	}
+	c.stats.lost(c.awaited())
+	c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+func main() {
+	flag.Parse()
+	if *rate <= 0 || *ramp <= 0 {
+		fmt.Fprintln(os.Stderr, "-rate and -ramp must be positive")
+		os.Exit(2)
+	}
+	mixes, err := parseMix(*mixFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	counts := map[string]int{"RA": *nRA, "FPA": *nFPA, "FPB": *nFPB}
+	for _, t := range []string{"RA", "FPA", "FPB"} {
+		if 0 != counts[t] && nil == mixes[t] {
+			fmt.Fprintf(os.Stderr, "-mix has nothing %s clients send, not starting them\n", t)
+			counts[t] = 0
+		}
+	}
+
+	var e *echoer
+	if "" != *echo {
+		if e, err = startEcho(*echo, *reply); err != nil {
+			fmt.Fprintln(os.Stderr, "echo:", err)
+			os.Exit(2)
+		}
+	}
+
+	st := newStats()
+	stop := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+		case <-time.After(*duration + time.Duration(float64(total(counts))/(*ramp)*float64(time.Second))):
+		}
+		close(stop)
+	}()
+	if 0 != *interval {
+		go st.progress(*interval, stop)
+	}
+
+	var wg sync.WaitGroup
+	opening := time.NewTicker(time.Duration(float64(time.Second) / *ramp))
+	id := 0
+open:
+	for _, t := range []string{"RA", "FPA", "FPB"} {
+		for i := 0; i < counts[t]; i++ {
+			select {
+			case <-opening.C:
+			case <-stop:
+				break open
+			}
+			id++
+			c := &client{
+				id:    id,
+				ctype: t,
+				stats: st,
+				mix:   mixes[t],
+				rand:  rand.New(rand.NewSource(time.Now().UnixNano() + int64(id))),
+				sent:  make(map[string]time.Time),
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := c.dial("/" + strings.ToLower(c.ctype)); err != nil {
+					return
+				}
+				c.run(stop)
+			}()
+		}
+	}
+	opening.Stop()
+	wg.Wait()
+
+	r := st.report()
+	if nil != e {
+		r.Echoed, r.EchoFailed = e.close()
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(r)
+		return
+	}
+	r.print(os.Stdout)
+}
+
+func total(counts map[string]int) int {
+	n := 0
+	for _, c := range counts {
+		n += c
+	}
+	return n
+}
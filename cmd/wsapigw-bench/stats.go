@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stats collects what the clients measure. Latency samples are all kept, so
+// percentiles are exact.
+type stats struct {
+	mu        sync.Mutex
+	start     time.Time
+	connects  []time.Duration
+	refused   map[string]int // reason -> failed connects
+	sent      map[string]int // kind -> messages
+	rtts      map[string][]time.Duration
+	errors    map[string]int // code -> error frames
+	errorRTTs []time.Duration
+	other     map[string]int
+	lostN     int
+	drops     int
+}
+
+func newStats() *stats {
+	return &stats{
+		start:   time.Now(),
+		refused: make(map[string]int),
+		sent:    make(map[string]int),
+		rtts:    make(map[string][]time.Duration),
+		errors:  make(map[string]int),
+		other:   make(map[string]int),
+	}
+}
+
+func (s *stats) connected(d time.Duration) {
+	s.mu.Lock()
+	s.connects = append(s.connects, d)
+	s.mu.Unlock()
+}
+
+func (s *stats) connectFailed(reason string) {
+	s.mu.Lock()
+	s.refused[reason]++
+	s.mu.Unlock()
+}
+
+func (s *stats) sentOne(kind string) {
+	s.mu.Lock()
+	s.sent[kind]++
+	s.mu.Unlock()
+}
+
+func (s *stats) replied(ctype string, rtt time.Duration) {
+	s.mu.Lock()
+	s.rtts[ctype] = append(s.rtts[ctype], rtt)
+	s.mu.Unlock()
+}
+
+// errorFrame counts an error frame, and its round trip unless 0.
+func (s *stats) errorFrame(code string, rtt time.Duration) {
+	s.mu.Lock()
+	s.errors[code]++
+	if 0 != rtt {
+		s.errorRTTs = append(s.errorRTTs, rtt)
+	}
+	s.mu.Unlock()
+}
+
+func (s *stats) received(what string) {
+	s.mu.Lock()
+	s.other[what]++
+	s.mu.Unlock()
+}
+
+func (s *stats) lost(n int) {
+	s.mu.Lock()
+	s.lostN += n
+	s.mu.Unlock()
+}
+
+// disconnected counts a client the gateway disconnected.
+func (s *stats) disconnected() {
+	s.mu.Lock()
+	s.drops++
+	s.mu.Unlock()
+}
+
+func sum(m map[string]int) int {
+	n := 0
+	for _, v := range m {
+		n += v
+	}
+	return n
+}
+
+func (s *stats) counts() (sent int, replies int, errors int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.rtts {
+		replies += len(r)
+	}
+	return sum(s.sent), replies, sum(s.errors)
+}
+
+// progress prints the rates of the last interval until stop is closed.
+func (s *stats) progress(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var sent, replies, errors int
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		s.mu.Lock()
+		conns, refused, drops := len(s.connects), sum(s.refused), s.drops
+		s.mu.Unlock()
+		ns, nr, ne := s.counts()
+		secs := interval.Seconds()
+		fmt.Printf("%6.0fs  clients %d (refused %d, dropped %d)  sent %.1f/s  replies %.1f/s  errors %.1f/s\n",
+			time.Since(s.start).Seconds(), conns-drops, refused, drops,
+			float64(ns-sent)/secs, float64(nr-replies)/secs, float64(ne-errors)/secs)
+		sent, replies, errors = ns, nr, ne
+	}
+}
+
+// Latency summarizes latency samples, in milliseconds.
+type Latency struct {
+	Count int     `json:"Count"`
+	Mean  float64 `json:"Mean"`
+	P50   float64 `json:"P50"`
+	P90   float64 `json:"P90"`
+	P99   float64 `json:"P99"`
+	Max   float64 `json:"Max"`
+}
+
+func ms(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+func latency(samples []time.Duration) Latency {
+	if 0 == len(samples) {
+		return Latency{}
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	at := func(p float64) float64 {
+		i := int(p*float64(len(sorted))+0.5) - 1
+		if i < 0 {
+			i = 0
+		}
+		return ms(sorted[i])
+	}
+	return Latency{
+		Count: len(sorted),
+		Mean:  ms(total / time.Duration(len(sorted))),
+		P50:   at(0.50),
+		P90:   at(0.90),
+		P99:   at(0.99),
+		Max:   ms(sorted[len(sorted)-1]),
+	}
+}
+
+// Report is the final result of a run.
+type Report struct {
+	Elapsed       float64            `json:"Elapsed"` // seconds
+	Clients       int                `json:"Clients"`
+	Refused       map[string]int     `json:"Refused"`
+	Dropped       int                `json:"Dropped"`
+	Connect       Latency            `json:"Connect"`
+	Sent          map[string]int     `json:"Sent"`
+	Replies       int                `json:"Replies"`
+	Lost          int                `json:"Lost"`
+	SendRate      float64            `json:"SendRate"`  // messages per second
+	ReplyRate     float64            `json:"ReplyRate"` // replies per second
+	RoundTrip     Latency            `json:"RoundTrip"`
+	RoundTripType map[string]Latency `json:"RoundTripByType"`
+	Errors        map[string]int     `json:"Errors"`
+	ErrorFrame    Latency            `json:"ErrorFrame"`
+	Other         map[string]int     `json:"Other"`
+	Echoed        int                `json:"Echoed,omitempty"`
+	EchoFailed    int                `json:"EchoFailed,omitempty"`
+}
+
+func (s *stats) report() *Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elapsed := time.Since(s.start).Seconds()
+	r := &Report{
+		Elapsed:       elapsed,
+		Clients:       len(s.connects),
+		Refused:       s.refused,
+		Dropped:       s.drops,
+		Connect:       latency(s.connects),
+		Sent:          s.sent,
+		Lost:          s.lostN,
+		RoundTripType: make(map[string]Latency),
+		Errors:        s.errors,
+		ErrorFrame:    latency(s.errorRTTs),
+		Other:         s.other,
+	}
+	var all []time.Duration
+	for t, rtts := range s.rtts {
+		r.RoundTripType[t] = latency(rtts)
+		all = append(all, rtts...)
+	}
+	r.Replies = len(all)
+	r.RoundTrip = latency(all)
+	r.SendRate = float64(sum(s.sent)) / elapsed
+	r.ReplyRate = float64(r.Replies) / elapsed
+	return r
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func counted(m map[string]int) string {
+	if 0 == len(m) {
+		return "none"
+	}
+	var parts []string
+	for _, k := range sortedKeys(m) {
+		parts = append(parts, fmt.Sprintf("%s=%d", k, m[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l Latency) String() string {
+	if 0 == l.Count {
+		return "no samples"
+	}
+	return fmt.Sprintf("n=%d mean=%.1fms p50=%.1fms p90=%.1fms p99=%.1fms max=%.1fms",
+		l.Count, l.Mean, l.P50, l.P90, l.P99, l.Max)
+}
+
+func (r *Report) print(w io.Writer) {
+	fmt.Fprintf(w, "elapsed      %.1fs\n", r.Elapsed)
+	fmt.Fprintf(w, "clients      %d connected, %d dropped by the gateway, refused: %s\n", r.Clients, r.Dropped, counted(r.Refused))
+	fmt.Fprintf(w, "connect      %s\n", r.Connect)
+	fmt.Fprintf(w, "sent         %d (%.1f/s): %s\n", sum(r.Sent), r.SendRate, counted(r.Sent))
+	fmt.Fprintf(w, "replies      %d (%.1f/s), %d lost\n", r.Replies, r.ReplyRate, r.Lost)
+	fmt.Fprintf(w, "round trip   %s\n", r.RoundTrip)
+	types := make([]string, 0, len(r.RoundTripType))
+	for t := range r.RoundTripType {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Fprintf(w, "  %-10s %s\n", t, r.RoundTripType[t])
+	}
+	fmt.Fprintf(w, "error frames %s\n", counted(r.Errors))
+	fmt.Fprintf(w, "  invalid    %s\n", r.ErrorFrame)
+	fmt.Fprintf(w, "other frames %s\n", counted(r.Other))
+	if 0 != r.Echoed || 0 != r.EchoFailed {
+		fmt.Fprintf(w, "echo         %d replies produced, %d requests not answered\n", r.Echoed, r.EchoFailed)
+	}
+}
@@ -0,0 +1,548 @@
+// Command wsapigw-redis is an in-memory stand-in for Redis, implementing just
+// the stream commands the gateway's redis broker uses (XADD, XGROUP CREATE,
+// XREADGROUP, XACK, XREAD, XRANGE, XLEN) plus PING and AUTH, which accepts any
+// password. Streams are lost on exit.
+//
+//	wsapigw-redis -addr 127.0.0.1:6379
+//
+// and in the gateway's config.json:
+//
+//	"broker": {"type": "redis", "addr": "127.0.0.1:6379"}
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reply types besides int64, []interface{} and nil, the null array
+type (
+	simple  string
+	bulk    string
+	respErr string
+)
+
+type streamID struct {
+	ms, seq uint64
+}
+
+func (id streamID) String() string { return fmt.Sprintf("%d-%d", id.ms, id.seq) }
+
+func (id streamID) less(o streamID) bool {
+	return id.ms < o.ms || (id.ms == o.ms && id.seq < o.seq)
+}
+
+// parseID parses a full or milliseconds-only id; def is the sequence of the
+// latter.
+func parseID(s string, def uint64) (streamID, error) {
+	parts := strings.SplitN(s, "-", 2)
+	ms, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return streamID{}, errors.New("ERR Invalid stream ID specified as stream command argument")
+	}
+	seq := def
+	if 2 == len(parts) {
+		if seq, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+			return streamID{}, errors.New("ERR Invalid stream ID specified as stream command argument")
+		}
+	}
+	return streamID{ms, seq}, nil
+}
+
+type entry struct {
+	id     streamID
+	fields []string
+}
+
+type group struct {
+	last    streamID
+	pending map[streamID]string // entry -> consumer
+}
+
+type stream struct {
+	entries []entry
+	last    streamID
+	groups  map[string]*group
+}
+
+// after returns the entries following id, at most count of them unless
+// count is 0.
+func (s *stream) after(id streamID, count int) []entry {
+	var out []entry
+	for _, e := range s.entries {
+		if id.less(e.id) {
+			out = append(out, e)
+			if len(out) == count {
+				break
+			}
+		}
+	}
+	return out
+}
+
+type server struct {
+	mu      sync.Mutex
+	streams map[string]*stream
+	// closed and replaced whenever an entry is added
+	grown chan struct{}
+}
+
+func newServer() *server {
+	return &server{streams: make(map[string]*stream), grown: make(chan struct{})}
+}
+
+func (s *server) stream(key string, create bool) *stream {
+	st := s.streams[key]
+	if nil == st && create {
+		st = &stream{groups: make(map[string]*group)}
+		s.streams[key] = st
+	}
+	return st
+}
+
+func entryReply(e entry) []interface{} {
+	fields := make([]interface{}, len(e.fields))
+	for i, f := range e.fields {
+		fields[i] = bulk(f)
+	}
+	return []interface{}{bulk(e.id.String()), fields}
+}
+
+func entriesReply(entries []entry) []interface{} {
+	out := make([]interface{}, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, entryReply(e))
+	}
+	return out
+}
+
+func (s *server) xadd(args []string) interface{} {
+	if len(args) < 4 || 0 != (len(args)-2)%2 {
+		return respErr("ERR wrong number of arguments for 'xadd' command")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stream(args[0], true)
+	var id streamID
+	if "*" == args[1] {
+		id = streamID{uint64(time.Now().UnixNano() / int64(time.Millisecond)), 0}
+		if !st.last.less(id) {
+			id = streamID{st.last.ms, st.last.seq + 1}
+		}
+	} else {
+		var err error
+		if id, err = parseID(args[1], 0); err != nil {
+			return respErr(err.Error())
+		}
+		if !st.last.less(id) {
+			return respErr("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+		}
+	}
+	st.entries = append(st.entries, entry{id, append([]string(nil), args[2:]...)})
+	st.last = id
+	close(s.grown)
+	s.grown = make(chan struct{})
+	return bulk(id.String())
+}
+
+func (s *server) xgroup(args []string) interface{} {
+	if len(args) < 4 || "CREATE" != strings.ToUpper(args[0]) {
+		return respErr("ERR only XGROUP CREATE <key> <group> <id> [MKSTREAM] is supported")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mkstream := 5 == len(args) && "MKSTREAM" == strings.ToUpper(args[4])
+	st := s.stream(args[1], mkstream)
+	if nil == st {
+		return respErr("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	}
+	if nil != st.groups[args[2]] {
+		return respErr("BUSYGROUP Consumer Group name already exists")
+	}
+	last := st.last
+	if "$" != args[3] {
+		var err error
+		if last, err = parseID(args[3], 0); err != nil {
+			return respErr(err.Error())
+		}
+	}
+	st.groups[args[2]] = &group{last: last, pending: make(map[streamID]string)}
+	return simple("OK")
+}
+
+// readOptions parses [COUNT n] [BLOCK ms] [NOACK] STREAMS key... id...
+func readOptions(args []string) (count int, block time.Duration, blocking bool, keys []string, ids []string, err error) {
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT", "BLOCK":
+			if i+1 == len(args) {
+				return 0, 0, false, nil, nil, errors.New("ERR syntax error")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				return 0, 0, false, nil, nil, errors.New("ERR value is not an integer or out of range")
+			}
+			if "COUNT" == strings.ToUpper(args[i]) {
+				count = n
+			} else {
+				block, blocking = time.Duration(n)*time.Millisecond, true
+			}
+			i++
+		case "NOACK":
+		case "STREAMS":
+			rest := args[i+1:]
+			if 0 == len(rest) || 0 != len(rest)%2 {
+				return 0, 0, false, nil, nil, errors.New("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+			}
+			return count, block, blocking, rest[:len(rest)/2], rest[len(rest)/2:], nil
+		default:
+			return 0, 0, false, nil, nil, errors.New("ERR syntax error")
+		}
+	}
+	return 0, 0, false, nil, nil, errors.New("ERR syntax error")
+}
+
+// wait blocks until an entry is added or the deadline passes; without
+// blocking it returns false at once. It is called with s.mu held.
+func (s *server) wait(blocking bool, deadline time.Time, block time.Duration) bool {
+	if !blocking {
+		return false
+	}
+	grown := s.grown
+	s.mu.Unlock()
+	defer s.mu.Lock()
+	if 0 == block {
+		<-grown
+		return true
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-grown:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (s *server) xread(args []string) interface{} {
+	count, block, blocking, keys, ids, err := readOptions(args)
+	if err != nil {
+		return respErr(err.Error())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from := make([]streamID, len(keys))
+	for i, key := range keys {
+		if "$" == ids[i] {
+			if st := s.stream(key, false); nil != st {
+				from[i] = st.last
+			}
+			continue
+		}
+		if from[i], err = parseID(ids[i], 0); err != nil {
+			return respErr(err.Error())
+		}
+	}
+	deadline := time.Now().Add(block)
+	for {
+		var out []interface{}
+		for i, key := range keys {
+			st := s.stream(key, false)
+			if nil == st {
+				continue
+			}
+			if entries := st.after(from[i], count); 0 != len(entries) {
+				out = append(out, []interface{}{bulk(key), entriesReply(entries)})
+			}
+		}
+		if 0 != len(out) {
+			return out
+		}
+		if !s.wait(blocking, deadline, block) {
+			return nil
+		}
+	}
+}
+
+func (s *server) xreadgroup(args []string) interface{} {
+	if len(args) < 3 || "GROUP" != strings.ToUpper(args[0]) {
+		return respErr("ERR syntax error")
+	}
+	name, consumer := args[1], args[2]
+	count, block, blocking, keys, ids, err := readOptions(args[3:])
+	if err != nil {
+		return respErr(err.Error())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	groups := make([]*group, len(keys))
+	for i, key := range keys {
+		st := s.stream(key, false)
+		if nil != st {
+			groups[i] = st.groups[name]
+		}
+		if nil == groups[i] {
+			return respErr(fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", key, name))
+		}
+		if ">" == ids[i] {
+			continue
+		}
+		// reading pending entries never blocks
+		blocking = false
+		if _, err := parseID(ids[i], 0); err != nil {
+			return respErr(err.Error())
+		}
+	}
+	deadline := time.Now().Add(block)
+	for {
+		var out []interface{}
+		found := false
+		for i, key := range keys {
+			st, g := s.stream(key, false), groups[i]
+			if ">" != ids[i] {
+				// the consumer's pending entries after the id
+				from, _ := parseID(ids[i], 0)
+				var entries []entry
+				for _, e := range st.after(from, 0) {
+					if consumer == g.pending[e.id] {
+						entries = append(entries, e)
+						if len(entries) == count {
+							break
+						}
+					}
+				}
+				out = append(out, []interface{}{bulk(key), entriesReply(entries)})
+				found = true
+				continue
+			}
+			entries := st.after(g.last, count)
+			if 0 == len(entries) {
+				continue
+			}
+			for _, e := range entries {
+				g.pending[e.id] = consumer
+			}
+			g.last = entries[len(entries)-1].id
+			out = append(out, []interface{}{bulk(key), entriesReply(entries)})
+			found = true
+		}
+		if found {
+			return out
+		}
+		if !s.wait(blocking, deadline, block) {
+			return nil
+		}
+	}
+}
+
+func (s *server) xack(args []string) interface{} {
+	if len(args) < 3 {
+		return respErr("ERR wrong number of arguments for 'xack' command")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stream(args[0], false)
+	if nil == st || nil == st.groups[args[1]] {
+		return int64(0)
+	}
+	g := st.groups[args[1]]
+	var n int64
+	for _, a := range args[2:] {
+		id, err := parseID(a, 0)
+		if err != nil {
+			return respErr(err.Error())
+		}
+		if _, ok := g.pending[id]; ok {
+			delete(g.pending, id)
+			n++
+		}
+	}
+	return n
+}
+
+func (s *server) xrange(args []string) interface{} {
+	if 3 != len(args) && 5 != len(args) {
+		return respErr("ERR wrong number of arguments for 'xrange' command")
+	}
+	count := 0
+	if 5 == len(args) {
+		n, err := strconv.Atoi(args[4])
+		if err != nil || "COUNT" != strings.ToUpper(args[3]) {
+			return respErr("ERR syntax error")
+		}
+		count = n
+	}
+	start, end := streamID{}, streamID{^uint64(0), ^uint64(0)}
+	var err error
+	if "-" != args[1] {
+		if start, err = parseID(args[1], 0); err != nil {
+			return respErr(err.Error())
+		}
+	}
+	if "+" != args[2] {
+		if end, err = parseID(args[2], ^uint64(0)); err != nil {
+			return respErr(err.Error())
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]interface{}, 0)
+	st := s.stream(args[0], false)
+	if nil == st {
+		return out
+	}
+	for _, e := range st.entries {
+		if e.id.less(start) || end.less(e.id) {
+			continue
+		}
+		out = append(out, entryReply(e))
+		if len(out) == count {
+			break
+		}
+	}
+	return out
+}
+
+func (s *server) xlen(args []string) interface{} {
+	if 1 != len(args) {
+		return respErr("ERR wrong number of arguments for 'xlen' command")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st := s.stream(args[0], false); nil != st {
+		return int64(len(st.entries))
+	}
+	return int64(0)
+}
+
+func (s *server) exec(cmd []string) interface{} {
+	args := cmd[1:]
+	switch strings.ToUpper(cmd[0]) {
+	case "PING":
+		if 1 == len(args) {
+			return bulk(args[0])
+		}
+		return simple("PONG")
+	case "AUTH", "SELECT", "CLIENT":
+		return simple("OK")
+	case "XADD":
+		return s.xadd(args)
+	case "XGROUP":
+		return s.xgroup(args)
+	case "XREAD":
+		return s.xread(args)
+	case "XREADGROUP":
+		return s.xreadgroup(args)
+	case "XACK":
+		return s.xack(args)
+	case "XRANGE":
+		return s.xrange(args)
+	case "XLEN":
+		return s.xlen(args)
+	}
+	return respErr(fmt.Sprintf("ERR unknown command '%s'", cmd[0]))
+}
+
+// readCommand reads an array of bulk strings, or an inline command.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, errors.New("invalid multibulk length")
+	}
+	cmd := make([]string, n)
+	for i := range cmd {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimRight(line, "\r\n")[1:])
+		if err != nil || !strings.HasPrefix(line, "$") {
+			return nil, errors.New("expected bulk string")
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		cmd[i] = string(b[:size])
+	}
+	return cmd, nil
+}
+
+func writeReply(w *bufio.Writer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		w.WriteString("*-1\r\n")
+	case simple:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case respErr:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case bulk:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(w, e)
+		}
+	}
+}
+
+func (s *server) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		cmd, err := readCommand(r)
+		if err != nil {
+			if io.EOF != err {
+				log.Printf("%s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if 0 == len(cmd) {
+			continue
+		}
+		writeReply(w, s.exec(cmd))
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:6379", "address to listen on")
+	flag.Parse()
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("redis stand-in listening on %s", *addr)
+	s := newServer()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go s.serve(conn)
+	}
+}
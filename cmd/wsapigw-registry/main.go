@@ -0,0 +1,158 @@
+// Command wsapigw-registry is an in-memory stand-in for the Confluent Schema
+// Registry, implementing just the endpoints the gateway uses plus a few for
+// inspection. Schemas are lost on exit.
+//
+//	wsapigw-registry -addr 127.0.0.1:8081
+//
+// and in the gateway's config.json:
+//
+//	"registry": {"url": "http://127.0.0.1:8081", "format": "avro"}
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type schema struct {
+	ID         int    `json:"id"`
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType,omitempty"`
+}
+
+type version struct {
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+	schema
+}
+
+type registry struct {
+	mu       sync.Mutex
+	schemas  []schema         // by ID - 1
+	subjects map[string][]int // subject -> schema IDs, one per version
+	byText   map[string]int   // schema type and text -> ID
+}
+
+func newRegistry() *registry {
+	return &registry{
+		subjects: make(map[string][]int),
+		byText:   make(map[string]int),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code int, msg string) {
+	writeJSON(w, status, map[string]interface{}{"error_code": code, "message": msg})
+}
+
+// register adds a schema version to subject, or returns the ID of the
+// identical schema when it is already registered.
+func (r *registry) register(subject string, s schema) int {
+	if "" == s.SchemaType {
+		s.SchemaType = "AVRO"
+	}
+	key := s.SchemaType + "\x00" + s.Schema
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id, ok := r.byText[key]
+	if !ok {
+		id = len(r.schemas) + 1
+		s.ID = id
+		r.schemas = append(r.schemas, s)
+		r.byText[key] = id
+		log.Printf("registered schema %d (%s)", id, s.SchemaType)
+	}
+	for _, v := range r.subjects[subject] {
+		if id == v {
+			return id
+		}
+	}
+	r.subjects[subject] = append(r.subjects[subject], id)
+	log.Printf("subject %s version %d is schema %d", subject, len(r.subjects[subject]), id)
+	return id
+}
+
+func (r *registry) serveSchema(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/schemas/ids/"))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil || id < 1 || id > len(r.schemas) {
+		writeError(w, http.StatusNotFound, 40403, "Schema not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, r.schemas[id-1])
+}
+
+func (r *registry) serveSubjects(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/subjects"), "/"), "/")
+	if 1 == len(parts) && "" == parts[0] {
+		r.mu.Lock()
+		names := make([]string, 0, len(r.subjects))
+		for s := range r.subjects {
+			names = append(names, s)
+		}
+		r.mu.Unlock()
+		writeJSON(w, http.StatusOK, names)
+		return
+	}
+	if len(parts) < 2 || "versions" != parts[1] {
+		writeError(w, http.StatusNotFound, 404, "Not found")
+		return
+	}
+	subject := parts[0]
+	if "POST" == req.Method && 2 == len(parts) {
+		var s schema
+		if err := json.NewDecoder(req.Body).Decode(&s); err != nil || "" == s.Schema {
+			writeError(w, http.StatusUnprocessableEntity, 42201, "Invalid schema")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"id": r.register(subject, s)})
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids, ok := r.subjects[subject]
+	if !ok {
+		writeError(w, http.StatusNotFound, 40401, "Subject not found")
+		return
+	}
+	if 2 == len(parts) {
+		versions := make([]int, len(ids))
+		for i := range ids {
+			versions[i] = i + 1
+		}
+		writeJSON(w, http.StatusOK, versions)
+		return
+	}
+	v := len(ids)
+	if "latest" != parts[2] {
+		n, err := strconv.Atoi(parts[2])
+		if err != nil || n < 1 || n > len(ids) {
+			writeError(w, http.StatusNotFound, 40402, "Version not found")
+			return
+		}
+		v = n
+	}
+	writeJSON(w, http.StatusOK, version{Subject: subject, Version: v, schema: r.schemas[ids[v-1]-1]})
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8081", "listen address")
+	flag.Parse()
+	r := newRegistry()
+	http.HandleFunc("/schemas/ids/", r.serveSchema)
+	http.HandleFunc("/subjects", r.serveSubjects)
+	http.HandleFunc("/subjects/", r.serveSubjects)
+	log.Printf("schema registry stand-in listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// The ledger's records, as in the gateway's payload.go.
+
+type Approval struct {
+	Status string `json:"Status"`
+	Date   string `json:"Date,omitempty"`
+}
+
+type Approvals struct {
+	RAApproval Approval `json:"RAApproval,omitempty"`
+	FPApproval Approval `json:"FPApproval,omitempty"`
+}
+
+type FPInfo struct {
+	FPName       string `json:"FPName"`
+	FPCode       string `json:"FPCode"`
+	FPProgram    string `json:"FPProgram"`
+	CurrInvstAmt string `json:"CurrInvstAmt,omitempty"`
+	Currency     string `json:"Currency,omitempty"`
+}
+
+type EmpData struct {
+	ID         string `json:"ID"`
+	FirstName  string `json:"FirstName"`
+	MiddleName string `json:"MiddleName"`
+	LastName   string `json:"LastName"`
+	Birthday   string `json:"Birthday"`
+	Age        string `json:"Age"`
+	Address    string `json:"Address"`
+	Email      string `json:"Email"`
+	ContactNo  string `json:"ContactNo"`
+	TaxID      string `json:"TaxID"`
+	Employer   string `json:"Employer"`
+}
+
+type Employee struct {
+	ObjectType       string    `json:"docType"`
+	TxID             string    `json:"TxID"`
+	EmployeeData     EmpData   `json:"EmployeeData"`
+	FPInfo           FPInfo    `json:"FPInfo"`
+	EnrollmentStatus string    `json:"EnrollmentStatus"`
+	NewFPInfo        FPInfo    `json:"NewFPInfo,omitempty"`
+	Approvals        Approvals `json:"Approvals,omitempty"`
+}
+
+// request is a ledgertx.req record.
+type request struct {
+	CID            string
+	Type           string
+	IdempotencyKey string
+	CorrelationID  string
+	ReplyTo        string
+	Payload        *struct {
+		EnrollmentReq *struct {
+			EmployeeData EmpData
+			FPInfo       FPInfo
+		}
+		EnrollmentApproval *struct {
+			EmployeeData EmpData
+			Approvals    Approvals
+		}
+		ChangeFPReq *struct {
+			EmpID      string
+			CurrFPCode string
+			NewFPInfo  FPInfo
+		}
+		ChangeFPApproval *struct {
+			EmployeeData string
+			Approvals    Approvals
+		}
+	}
+}
+
+// variant returns the request's payload variant and the employee it is about.
+func (r *request) variant() (string, string) {
+	p := r.Payload
+	switch {
+	case nil == p:
+	case nil != p.EnrollmentReq:
+		return "EnrollmentReq", p.EnrollmentReq.EmployeeData.ID
+	case nil != p.EnrollmentApproval:
+		return "EnrollmentApproval", p.EnrollmentApproval.EmployeeData.ID
+	case nil != p.ChangeFPReq:
+		return "ChangeFPReq", p.ChangeFPReq.EmpID
+	case nil != p.ChangeFPApproval:
+		return "ChangeFPApproval", p.ChangeFPApproval.EmployeeData
+	}
+	return "", ""
+}
+
+// approval is the status of the approval the request carries.
+func (r *request) approval() string {
+	var a Approvals
+	switch {
+	case nil != r.Payload.EnrollmentApproval:
+		a = r.Payload.EnrollmentApproval.Approvals
+	case nil != r.Payload.ChangeFPApproval:
+		a = r.Payload.ChangeFPApproval.Approvals
+	}
+	if "" != a.FPApproval.Status {
+		return a.FPApproval.Status
+	}
+	return a.RAApproval.Status
+}
+
+// message is what the simulator produces, a ClientMessage.
+type message struct {
+	CID            string      `json:"CID,omitempty"`
+	Type           string      `json:"Type,omitempty"`
+	Status         string      `json:"Status,omitempty"`
+	IdempotencyKey string      `json:"IdempotencyKey,omitempty"`
+	CorrelationID  string      `json:"CorrelationID,omitempty"`
+	Payload        interface{} `json:"Payload"`
+	Error          *errorInfo  `json:"Error,omitempty"`
+}
+
+type errorInfo struct {
+	Code    string `json:"Code"`
+	Message string `json:"Message"`
+}
+
+// script is the state machine the simulator runs.
+type script struct {
+	// milliseconds between consuming a request and producing its records
+	Delay int `json:"delay"`
+	// take employees named by change-FP requests but never enrolled as
+	// enrolled with the request's CurrFPCode
+	Adopt bool `json:"adopt"`
+	// topic requests no transition applies to are answered on
+	RejectTopic string `json:"reject_topic"`
+	// employees known from the start
+	Employees   []Employee   `json:"employees,omitempty"`
+	Transitions []transition `json:"transitions"`
+}
+
+// transition moves an employee in one of the From statuses ("" for one the
+// ledger doesn't know) to To when a request with the On payload variant comes
+// in, and produces the Emit records.
+type transition struct {
+	On   string   `json:"on"`
+	From []string `json:"from"`
+	// "fp" or "new_fp": the sender's Type must be the employee's current or
+	// requested FP code
+	By string `json:"by,omitempty"`
+	// the approval status the request must carry
+	Approval string `json:"approval,omitempty"`
+	To       string `json:"to"`
+	// "adopt" makes the requested FP the current one, "drop" forgets it
+	NewFP string `json:"new_fp,omitempty"`
+	Emit  []emit `json:"emit"`
+	// announce the transaction on new.block.created
+	Block bool `json:"block,omitempty"`
+}
+
+// emit is a record produced by a transition, carrying the employee.
+type emit struct {
+	Topic string `json:"topic"`
+	// "sender" or "requester", who started the flow: the client the record
+	// is addressed to; without it the gateway routes by FP code and Type
+	CID  string `json:"cid,omitempty"`
+	Type string `json:"type,omitempty"`
+	// "new": the record shows the requested FP as the employee's FPInfo, so
+	// it is routed to that FP's clients
+	FP string `json:"fp,omitempty"`
+}
+
+var variants = []string{"EnrollmentReq", "EnrollmentApproval", "ChangeFPReq", "ChangeFPApproval"}
+
+func oneOf(s string, values ...string) bool {
+	for _, v := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *script) validate() error {
+	if s.Delay < 0 {
+		return fmt.Errorf("delay: %d is negative", s.Delay)
+	}
+	for i, e := range s.Employees {
+		if "" == e.EmployeeData.ID {
+			return fmt.Errorf("employees[%d]: EmployeeData.ID is empty", i)
+		}
+	}
+	for i, t := range s.Transitions {
+		where := fmt.Sprintf("transitions[%d]", i)
+		switch {
+		case !oneOf(t.On, variants...):
+			return fmt.Errorf("%s: on is %q, want one of %s", where, t.On, strings.Join(variants, ", "))
+		case 0 == len(t.From):
+			return fmt.Errorf("%s: from is empty", where)
+		case "" == t.To:
+			return fmt.Errorf("%s: to is empty", where)
+		case !oneOf(t.By, "", "fp", "new_fp"):
+			return fmt.Errorf("%s: by is %q, want fp or new_fp", where, t.By)
+		case !oneOf(t.NewFP, "", "adopt", "drop"):
+			return fmt.Errorf("%s: new_fp is %q, want adopt or drop", where, t.NewFP)
+		}
+		for j, e := range t.Emit {
+			where := fmt.Sprintf("%s.emit[%d]", where, j)
+			switch {
+			case "" == e.Topic:
+				return fmt.Errorf("%s: topic is empty", where)
+			case !oneOf(e.CID, "", "sender", "requester"):
+				return fmt.Errorf("%s: cid is %q, want sender or requester", where, e.CID)
+			case !oneOf(e.FP, "", "new"):
+				return fmt.Errorf("%s: fp is %q, want new", where, e.FP)
+			}
+		}
+	}
+	return nil
+}
+
+// defaultScript runs the enrollment and change-FP flows: the FP asked to
+// approve gets the employee on the approval request topic, the requester is
+// told where the flow stands, and every approval or rejection is a block.
+const defaultScript = `{
+  "delay": 200,
+  "adopt": true,
+  "reject_topic": "employee.updates",
+  "transitions": [
+    {"on": "EnrollmentReq", "from": ["", "REJECTED"], "to": "PENDING",
+     "emit": [{"topic": "employee.enrollment.approval.req"}, {"topic": "employee.updates", "cid": "sender"}]},
+    {"on": "EnrollmentApproval", "from": ["PENDING"], "by": "fp", "approval": "APPROVED", "to": "ENROLLED", "block": true,
+     "emit": [{"topic": "employee.updates", "cid": "requester"}, {"topic": "employee.updates", "cid": "sender"}]},
+    {"on": "EnrollmentApproval", "from": ["PENDING"], "by": "fp", "approval": "REJECTED", "to": "REJECTED", "block": true,
+     "emit": [{"topic": "employee.updates", "cid": "requester"}, {"topic": "employee.updates", "cid": "sender"}]},
+    {"on": "ChangeFPReq", "from": ["ENROLLED"], "to": "CHANGE_FP_PENDING",
+     "emit": [{"topic": "employee.changefp.req"}, {"topic": "employee.updates", "cid": "sender"}]},
+    {"on": "ChangeFPApproval", "from": ["CHANGE_FP_PENDING"], "by": "fp", "approval": "APPROVED", "to": "CHANGE_FP_APPROVED_BY_CURRENT", "block": true,
+     "emit": [{"topic": "employee.changefp.req", "fp": "new"}, {"topic": "employee.updates", "cid": "sender"}]},
+    {"on": "ChangeFPApproval", "from": ["CHANGE_FP_PENDING"], "by": "fp", "approval": "REJECTED", "to": "ENROLLED", "new_fp": "drop", "block": true,
+     "emit": [{"topic": "employee.updates", "cid": "requester"}, {"topic": "employee.updates", "cid": "sender"}]},
+    {"on": "ChangeFPApproval", "from": ["CHANGE_FP_APPROVED_BY_CURRENT"], "by": "new_fp", "approval": "APPROVED", "to": "ENROLLED", "new_fp": "adopt", "block": true,
+     "emit": [{"topic": "employee.updates", "type": "RA"}]},
+    {"on": "ChangeFPApproval", "from": ["CHANGE_FP_APPROVED_BY_CURRENT"], "by": "new_fp", "approval": "REJECTED", "to": "ENROLLED", "new_fp": "drop", "block": true,
+     "emit": [{"topic": "employee.updates", "cid": "requester"}, {"topic": "employee.updates", "cid": "sender"}]}
+  ]
+}
+`
+
+func parseScript(b []byte) (*script, error) {
+	s := &script{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	if "" == s.RejectTopic {
+		s.RejectTopic = "employee.updates"
+	}
+	return s, nil
+}
+
+// record is a record to produce.
+type record struct {
+	topic string
+	value []byte
+}
+
+// ledger is the simulated ledger's state.
+type ledger struct {
+	mu         sync.Mutex
+	script     *script
+	employees  map[string]*Employee
+	requesters map[string]string // employee ID -> CID that started its flow
+	txs        int
+	blocks     int
+	lastHash   string
+}
+
+func newLedger(s *script) *ledger {
+	l := &ledger{
+		script:     s,
+		employees:  make(map[string]*Employee),
+		requesters: make(map[string]string),
+	}
+	for i := range s.Employees {
+		e := s.Employees[i]
+		if "" == e.ObjectType {
+			e.ObjectType = "Employee"
+		}
+		l.employees[e.EmployeeData.ID] = &e
+	}
+	return l
+}
+
+func (l *ledger) status(id string) string {
+	if e, ok := l.employees[id]; ok {
+		return e.EnrollmentStatus
+	}
+	return ""
+}
+
+// match returns the transition that applies to req, or why none does.
+func (l *ledger) match(req *request, on string, id string) (*transition, error) {
+	status := l.status(id)
+	var reasons []string
+	for i := range l.script.Transitions {
+		t := &l.script.Transitions[i]
+		if on != t.On || !oneOf(status, t.From...) {
+			continue
+		}
+		if "" != t.By {
+			e := l.employees[id]
+			want := ""
+			if nil != e {
+				want = e.FPInfo.FPCode
+				if "new_fp" == t.By {
+					want = e.NewFPInfo.FPCode
+				}
+			}
+			if want != req.Type {
+				reason := fmt.Sprintf("%s must be approved by %s, not %s", id, want, req.Type)
+				if !oneOf(reason, reasons...) {
+					reasons = append(reasons, reason)
+				}
+				continue
+			}
+		}
+		if "" != t.Approval && !strings.EqualFold(t.Approval, req.approval()) {
+			reason := fmt.Sprintf("approval is %q, not %q", req.approval(), t.Approval)
+			if !oneOf(reason, reasons...) {
+				reasons = append(reasons, reason)
+			}
+			continue
+		}
+		return t, nil
+	}
+	if 0 != len(reasons) {
+		return nil, fmt.Errorf("no %s transition for %s: %s", on, id, strings.Join(reasons, "; "))
+	}
+	if "" == status {
+		return nil, fmt.Errorf("no %s transition for %s, which the ledger doesn't know", on, id)
+	}
+	return nil, fmt.Errorf("no %s transition for %s in %s", on, id, status)
+}
+
+// step is what handling one request produced.
+type step struct {
+	records []record
+	// the transaction to announce in a block, if any
+	tx string
+	// what happened, for the log
+	note string
+}
+
+// handle runs the state machine on a ledgertx.req record.
+func (l *ledger) handle(value []byte) (*step, error) {
+	req := &request{}
+	if err := json.Unmarshal(value, req); err != nil {
+		return nil, err
+	}
+	on, id := req.variant()
+	if "" == on {
+		return nil, fmt.Errorf("request %s has no payload the ledger handles", req.CID)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cfp := req.Payload.ChangeFPReq; nil != cfp && l.script.Adopt && "" == l.status(id) && "" != cfp.CurrFPCode {
+		l.employees[id] = &Employee{
+			ObjectType:       "Employee",
+			EmployeeData:     EmpData{ID: id},
+			FPInfo:           FPInfo{FPCode: cfp.CurrFPCode},
+			EnrollmentStatus: "ENROLLED",
+		}
+	}
+	t, err := l.match(req, on, id)
+	if err != nil {
+		if "" == req.CID {
+			return nil, err
+		}
+		notice := err.Error()
+		r := l.reply(req, "", message{
+			CID:     req.CID,
+			Status:  "REJECTED",
+			Payload: map[string]interface{}{"Notice": notice},
+			Error:   &errorInfo{Code: "invalid_transition", Message: notice},
+		})
+		return &step{records: []record{r}}, err
+	}
+
+	e := l.employees[id]
+	if nil == e {
+		e = &Employee{ObjectType: "Employee"}
+		l.employees[id] = e
+	}
+	switch p := req.Payload; {
+	case nil != p.EnrollmentReq:
+		e.EmployeeData = p.EnrollmentReq.EmployeeData
+		e.FPInfo = p.EnrollmentReq.FPInfo
+		e.NewFPInfo = FPInfo{}
+		e.Approvals = Approvals{}
+	case nil != p.ChangeFPReq:
+		e.NewFPInfo = p.ChangeFPReq.NewFPInfo
+		e.Approvals = Approvals{}
+	case nil != p.EnrollmentApproval:
+		e.Approvals = p.EnrollmentApproval.Approvals
+	case nil != p.ChangeFPApproval:
+		e.Approvals = p.ChangeFPApproval.Approvals
+	}
+	if oneOf(on, "EnrollmentReq", "ChangeFPReq") {
+		l.requesters[id] = req.CID
+	}
+	switch t.NewFP {
+	case "adopt":
+		e.FPInfo, e.NewFPInfo = e.NewFPInfo, FPInfo{}
+	case "drop":
+		e.NewFPInfo = FPInfo{}
+	}
+	from := e.EnrollmentStatus
+	e.EnrollmentStatus = t.To
+	l.txs++
+	e.TxID = txID(l.txs, value)
+
+	if "" == from {
+		from = "new"
+	}
+	st := &step{note: fmt.Sprintf("%s %s from %s: %s -> %s", on, id, req.Type, from, t.To)}
+	if t.Block {
+		st.tx = e.TxID
+	}
+	for _, em := range t.Emit {
+		emp := *e
+		if "new" == em.FP && "" != emp.NewFPInfo.FPCode {
+			emp.FPInfo = emp.NewFPInfo
+		}
+		m := message{Type: em.Type, Status: t.To, Payload: map[string]interface{}{"Employee": emp}}
+		switch em.CID {
+		case "sender":
+			m.CID = req.CID
+		case "requester":
+			m.CID = l.requesters[id]
+		}
+		st.records = append(st.records, l.reply(req, em.Topic, m))
+	}
+	return st, nil
+}
+
+// reply produces m to topic; messages to the sender answer its request,
+// carrying its IdempotencyKey and CorrelationID, and go to its ReplyTo topic
+// if it has one.
+func (l *ledger) reply(req *request, topic string, m message) record {
+	if "" != m.CID && req.CID == m.CID {
+		m.IdempotencyKey = req.IdempotencyKey
+		m.CorrelationID = req.CorrelationID
+		if "" != req.ReplyTo {
+			topic = req.ReplyTo
+		}
+	}
+	if "" == topic {
+		topic = l.script.RejectTopic
+	}
+	b, _ := json.Marshal(m)
+	return record{topic, b}
+}
+
+func txID(n int, value []byte) string {
+	sum := sha256.Sum256(append([]byte(fmt.Sprintf("%d:", n)), value...))
+	return hex.EncodeToString(sum[:])
+}
+
+// block returns the new.block.created record announcing tx, chained to the
+// previous block. Blocks are numbered in the order they are produced.
+func (l *ledger) block(tx string) record {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.blocks++
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%s:%s", l.blocks, l.lastHash, tx)))
+	hash := hex.EncodeToString(sum[:])
+	b, _ := json.Marshal(map[string]interface{}{
+		"Number":       l.blocks,
+		"Hash":         hash,
+		"PreviousHash": l.lastHash,
+		"TxIDs":        []string{tx},
+	})
+	l.lastHash = hash
+	block := string(b)
+	m, _ := json.Marshal(message{Payload: map[string]interface{}{"Block": block}})
+	return record{"new.block.created", m}
+}
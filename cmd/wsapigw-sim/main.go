@@ -0,0 +1,266 @@
+// Command wsapigw-sim simulates the ledger behind the gateway, so the UI can
+// be exercised without the blockchain services. It consumes ledgertx.req,
+// runs each request through a scriptable state machine over the employee's
+// EnrollmentStatus, and produces the resulting Employee records to the topics
+// the gateway consumes (employee.enrollment.approval.req,
+// employee.changefp.req, employee.updates), announcing transactions on
+// new.block.created.
+//
+//	wsapigw-sim -broker kafka://localhost:9092
+//	wsapigw-sim -broker http://127.0.0.1:9093 -script flows.json
+//
+// -broker is Kafka or the HTTP API of the gateway's in-memory broker. Without
+// -script the built-in enrollment and change-FP flows run; -print-script
+// prints them as a starting point for a script. State is lost on exit.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+const requestTopic = "ledgertx.req"
+
+var (
+	brokerURL    = flag.String("broker", "kafka://localhost:9092", "kafka://host:port[,host:port] or the in-memory broker's http://host:port")
+	scriptPath   = flag.String("script", "", "state machine script, JSON; the built-in flows by default")
+	printScript  = flag.Bool("print-script", false, "print the built-in script and exit")
+	group        = flag.String("group", "wsapigw-sim", "consumer group on the in-memory broker")
+	kafkaVersion = flag.String("kafka-version", "0.11.0.0", "Kafka protocol version")
+)
+
+// broker is where the simulator consumes requests and produces records.
+type broker interface {
+	// consume calls handle with every request until stop is closed
+	consume(handle func([]byte), stop <-chan struct{})
+	produce(topic string, value []byte) error
+	close()
+}
+
+func openBroker(target string) (broker, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "kafka":
+		return openKafka(strings.Split(u.Host, ","))
+	case "http":
+		return &memoryBroker{
+			base:   "http://" + u.Host,
+			client: &http.Client{Timeout: time.Minute},
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported broker %q, want kafka:// or http://", target)
+}
+
+type kafkaBroker struct {
+	producer sarama.SyncProducer
+	consumer sarama.Consumer
+}
+
+func openKafka(brokers []string) (*kafkaBroker, error) {
+	config := sarama.NewConfig()
+	v, err := sarama.ParseKafkaVersion(*kafkaVersion)
+	if err != nil {
+		return nil, err
+	}
+	config.Version = v
+	config.Producer.Return.Successes = true
+	producer, err := sarama.NewSyncProducer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := sarama.NewConsumer(brokers, config)
+	if err != nil {
+		producer.Close()
+		return nil, err
+	}
+	return &kafkaBroker{producer, consumer}, nil
+}
+
+// consume reads every partition of the request topic from the newest offset
+// on.
+func (k *kafkaBroker) consume(handle func([]byte), stop <-chan struct{}) {
+	partitions, err := k.consumer.Partitions(requestTopic)
+	if err != nil {
+		log.Printf("%s: %v", requestTopic, err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, p := range partitions {
+		pc, err := k.consumer.ConsumePartition(requestTopic, p, sarama.OffsetNewest)
+		if err != nil {
+			log.Printf("%s/%d: %v", requestTopic, p, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer pc.Close()
+			for {
+				select {
+				case msg := <-pc.Messages():
+					handle(msg.Value)
+				case err := <-pc.Errors():
+					log.Print(err)
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (k *kafkaBroker) produce(topic string, value []byte) error {
+	_, _, err := k.producer.SendMessage(&sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(value)})
+	return err
+}
+
+func (k *kafkaBroker) close() {
+	k.consumer.Close()
+	k.producer.Close()
+}
+
+// memoryBroker uses the in-memory broker's HTTP API.
+type memoryBroker struct {
+	base   string
+	client *http.Client
+}
+
+func (m *memoryBroker) consume(handle func([]byte), stop <-chan struct{}) {
+	fetch := m.base + "/topics/" + url.PathEscape(requestTopic) + "?group=" + url.QueryEscape(*group) + "&wait=1"
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		resp, err := m.client.Get(fetch)
+		if err != nil {
+			log.Printf("%s: %v", requestTopic, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		var records []struct{ Value string }
+		err = json.NewDecoder(resp.Body).Decode(&records)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("%s: %v", requestTopic, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, r := range records {
+			handle([]byte(r.Value))
+		}
+	}
+}
+
+func (m *memoryBroker) produce(topic string, value []byte) error {
+	resp, err := m.client.Post(m.base+"/topics/"+url.PathEscape(topic), "application/json", bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if http.StatusOK != resp.StatusCode {
+		return fmt.Errorf("producing to %s: %s", topic, resp.Status)
+	}
+	return nil
+}
+
+func (m *memoryBroker) close() {}
+
+// due is a step to produce once its time comes.
+type due struct {
+	at time.Time
+	*step
+}
+
+// produce produces the steps in order, each after its delay, followed by
+// its block.
+func produce(b broker, l *ledger, steps <-chan due) {
+	for d := range steps {
+		time.Sleep(time.Until(d.at))
+		for _, r := range d.records {
+			if err := b.produce(r.topic, r.value); err != nil {
+				log.Print(err)
+			}
+		}
+		if "" != d.tx {
+			r := l.block(d.tx)
+			if err := b.produce(r.topic, r.value); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	if *printScript {
+		fmt.Print(defaultScript)
+		return
+	}
+	src, name := []byte(defaultScript), "built-in script"
+	if "" != *scriptPath {
+		b, err := ioutil.ReadFile(*scriptPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		src, name = b, *scriptPath
+	}
+	s, err := parseScript(src)
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+	l := newLedger(s)
+
+	b, err := openBroker(*brokerURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	delay := time.Duration(s.Delay) * time.Millisecond
+	steps := make(chan due, 1024)
+	produced := make(chan struct{})
+	go func() {
+		produce(b, l, steps)
+		close(produced)
+	}()
+
+	stop := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		<-sig
+		close(stop)
+	}()
+	log.Printf("simulating the ledger on %s with the %s, %d transitions", *brokerURL, name, len(s.Transitions))
+	b.consume(func(value []byte) {
+		st, err := l.handle(value)
+		if err != nil {
+			log.Printf("rejected: %v", err)
+		} else {
+			log.Print(st.note)
+		}
+		if nil != st {
+			steps <- due{time.Now().Add(delay), st}
+		}
+	}, stop)
+	close(steps)
+	<-produced
+	b.close()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/websocket"
+)
+
+// A Codec encodes ClientMessages for the websocket and for Kafka. Clients pick
+// one by requesting the matching websocket subprotocol ("wsapigw.msgpack");
+// without one they get the codec configured for their endpoint. Records are
+// encoded and decoded with the codec configured for their topic.
+type Codec interface {
+	Name() string
+	Marshal(msg *ClientMessage) ([]byte, error)
+	Unmarshal(data []byte, msg *ClientMessage) error
+	// websocket.TextMessage or websocket.BinaryMessage
+	FrameType() int
+}
+
+const (
+	defaultCodec      = "json"
+	subprotocolPrefix = "wsapigw."
+)
+
+type CodecConfig struct {
+	Endpoints map[string]string `json:"endpoints,omitempty"` // route -> codec
+	Topics    map[string]string `json:"topics,omitempty"`    // topic -> codec
+}
+
+var codecs = map[string]Codec{
+	"json":     jsonCodec{},
+	"msgpack":  msgpackCodec{},
+	"protobuf": protobufCodec{},
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(msg *ClientMessage) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Unmarshal(data []byte, msg *ClientMessage) error {
+	return json.Unmarshal(data, msg)
+}
+
+func (jsonCodec) FrameType() int { return websocket.TextMessage }
+
+// subprotocols lists the codec subprotocols offered during the upgrade, JSON
+// first so it wins when a client offers several.
+func subprotocols() []string {
+	names := make([]string, 0, len(codecs))
+	for n := range codecs {
+		if defaultCodec != n {
+			names = append(names, subprotocolPrefix+n)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{subprotocolPrefix + defaultCodec}, names...)
+}
+
+// codecs configured per endpoint and per topic; anything not listed uses JSON
+var (
+	endpointCodecs = map[string]Codec{}
+	topicCodecs    = map[string]Codec{}
+)
+
+func initCodecs(c CodecConfig) {
+	endpointCodecs = codecMap(c.Endpoints)
+	topicCodecs = codecMap(c.Topics)
+}
+
+// codecMap resolves the codec names of a route or topic mapping. Unknown names
+// are logged and left out, so those keys fall back to JSON.
+func codecMap(names map[string]string) map[string]Codec {
+	m := make(map[string]Codec, len(names))
+	for k, n := range names {
+		c, ok := codecs[n]
+		if !ok {
+			rootLog.Error("unknown codec, using json", "codec", n, "for", k)
+			continue
+		}
+		m[k] = c
+	}
+	return m
+}
+
+func pickCodec(m map[string]Codec, key string) Codec {
+	if c, ok := m[key]; ok {
+		return c
+	}
+	return codecs[defaultCodec]
+}
+
+// topicCodec returns the codec of a Kafka topic. With a schema registry every
+// topic uses the registry wire format.
+func topicCodec(topic string) Codec {
+	if nil != registry {
+		return registry.codec(topic)
+	}
+	return pickCodec(topicCodecs, topic)
+}
+
+// negotiateCodec returns the codec for the subprotocol agreed on during the
+// upgrade, or the endpoint's codec when none was.
+func negotiateCodec(conn *websocket.Conn, r *http.Request) Codec {
+	if p := conn.Subprotocol(); "" != p {
+		if c, ok := codecs[p[len(subprotocolPrefix):]]; ok {
+			return c
+		}
+	}
+	return pickCodec(endpointCodecs, r.URL.Path)
+}
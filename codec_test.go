@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func strp(s string) *string { return &s }
+
+// testMessages covers every kind of field a codec has to carry.
+func testMessages() map[string]*ClientMessage {
+	employees := []Employee{
+		{ObjectType: "Employee", EmployeeData: EmpData{ID: "E-1", FirstName: "Juan"}, FPInfo: FPInfo{FPCode: "FPA"}},
+		{ObjectType: "Employee", EmployeeData: EmpData{ID: "E-2", FirstName: "María"}, FPInfo: FPInfo{FPCode: "FPB"}},
+	}
+	return map[string]*ClientMessage{
+		"empty": {},
+		"scalars": {
+			Version: "1", CID: "c1", Username: "jdelacruz", Type: "RA", OrgCode: "RA",
+			Status: "ENROLLED", IdempotencyKey: "k1", RecordID: "employee.updates/0/7",
+			Seq: 300, AckSeq: 1 << 40, CorrelationID: "corr", ReplyTo: "replies",
+		},
+		"nested payload": {Type: "RA", Payload: &Payload{EnrollmentReq: &EnrollmentReq{
+			EmployeeData: EmpData{ID: "E-1", FirstName: "Juan", LastName: "Dela Cruz", Email: "juan@example.com"},
+			FPInfo:       FPInfo{FPName: "FPA Fund", FPCode: "FPA", FPProgram: "retirement"},
+		}}},
+		"approvals": {Type: "FPA", Payload: &Payload{ChangeFPApproval: &ChangeFPApproval{
+			EmployeeData: "E-2", FPInfo: FPInfo{FPCode: "FPA"}, NewFPInfo: FPInfo{FPCode: "FPB"},
+			Approvals: Approvals{RAApproval: Approval{Status: "APPROVED", Date: "2026-10-19"}, FPApproval: Approval{Status: "PENDING"}},
+		}}},
+		"string pointers": {Payload: &Payload{Block: strp("block-7"), Notice: strp("")}},
+		"list":            {Payload: &Payload{Employees: &employees}},
+		"error":           {CID: "c1", Error: &ErrorInfo{Code: errInvalidPayload, Message: "missing fields", Fields: []string{"A.B", "C"}}},
+		"long strings":    {Status: string(make([]byte, 70000)), Ack: "ü \x00"},
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{jsonCodec{}, msgpackCodec{}, protobufCodec{}} {
+		for name, msg := range testMessages() {
+			t.Run(codec.Name()+"/"+name, func(t *testing.T) {
+				b, err := codec.Marshal(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := &ClientMessage{}
+				if err := codec.Unmarshal(b, got); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, msg) {
+					t.Errorf("got %+v, want %+v", got, msg)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// By default a consumed record's offset is committed as soon as the record is
+// read, so a crash before the record reaches the websocket loses it. With
+// consumer.commit set to "after_delivery" the offset is committed only once
+// every client the record was routed to has had it written to its socket
+// (at-least-once). A record that could not be written is kept in the outbox
+// for those clients, or else sent to the dead letter topic, so the mode needs
+// one of them configured. If both fail the connection is failed, and the
+// partition is consumed again from the last committed offset once the gateway
+// has reconnected. Records that don't decode or have no recipient are
+// committed after the outbox or dead letter attempt either way, as in the
+// default mode.
+
+const (
+	commitOnReceive     = "on_receive"
+	commitAfterDelivery = "after_delivery"
+)
+
+var errUndeliverable = errors.New("record neither delivered, stored nor dead-lettered")
+
+type ConsumerConfig struct {
+	Commit string `json:"commit,omitempty"` // "on_receive" (default) or "after_delivery"
+}
+
+// delivery tracks the socket writes of one consumed record. It holds one
+// reference for the dispatch itself and one per client the record is queued
+// for; the record's offset can be committed once all are released.
+type delivery struct {
+	h       *Hub
+	cmsg    *ConsumerMessage
+	record  *Record
+	out     *ClientMessage // set by dispatch once decoded
+	part    *partitionCommits
+	pending int32
+	// fmu guards failed, the clients the record could not be written to
+	fmu    sync.Mutex
+	failed []*Client
+	done   bool // guarded by part.mu
+}
+
+// add takes a reference for a client the record is about to be queued for.
+func (d *delivery) add() {
+	if nil == d {
+		return
+	}
+	atomic.AddInt32(&d.pending, 1)
+}
+
+// finish releases a reference.
+func (d *delivery) finish() {
+	if nil == d || 0 != atomic.AddInt32(&d.pending, -1) {
+		return
+	}
+	d.fmu.Lock()
+	failed := d.failed
+	d.fmu.Unlock()
+	if 0 != len(failed) && !d.stash(failed) && !d.h.deadLetter(d.cmsg, dropUndelivered, spanContext{}) {
+		brokerLog.Error("record neither delivered nor stored, reconsuming from the last committed offset",
+			"topic", d.record.Topic, "partition", d.record.Partition, "offset", d.record.Offset)
+		// the partition's later offsets can't be committed past this one
+		d.part.k.fail(errUndeliverable)
+		return
+	}
+	d.part.complete(d)
+}
+
+// fail releases the reference taken for a client the record could not be
+// written to.
+func (d *delivery) fail(c *Client) {
+	if nil == d {
+		return
+	}
+	d.fmu.Lock()
+	d.failed = append(d.failed, c)
+	d.fmu.Unlock()
+	d.finish()
+}
+
+// stash keeps the record in the outbox for every client it could not be
+// written to, reporting whether all of them were stored.
+func (d *delivery) stash(failed []*Client) bool {
+	if nil == outbox || nil == d.out {
+		return false
+	}
+	seen := make(map[string]bool)
+	for _, c := range failed {
+		r := d.h.recipientOf(c, d.out)
+		if seen[r] {
+			continue
+		}
+		if !stash(d.out, r) {
+			return false
+		}
+		seen[r] = true
+	}
+	return true
+}
+
+// partitionCommits commits a partition's records in order as they complete.
+type partitionCommits struct {
+	k     *brokerConn
+	mu    sync.Mutex
+	queue []*delivery
+}
+
+func (p *partitionCommits) complete(d *delivery) {
+	p.mu.Lock()
+	d.done = true
+	var completed []*delivery
+	for 0 != len(p.queue) && p.queue[0].done {
+		completed = append(completed, p.queue[0])
+		p.queue = p.queue[1:]
+	}
+	p.mu.Unlock()
+	// one by one, for brokers acknowledging single records
+	for _, d := range completed {
+		if err := p.k.sub.Commit(d.record); err != nil {
+			brokerLog.Error("error committing offset", "topic", d.record.Topic, "partition", d.record.Partition, "err", err)
+		}
+	}
+}
+
+// track starts tracking the delivery of a record consumed on k.
+func (k *brokerConn) track(h *Hub, msg *Record, cmsg *ConsumerMessage) *delivery {
+	k.cmu.Lock()
+	key := partitionKey{msg.Topic, msg.Partition}
+	p := k.commits[key]
+	if nil == p {
+		p = &partitionCommits{k: k}
+		k.commits[key] = p
+	}
+	k.cmu.Unlock()
+	d := &delivery{h: h, cmsg: cmsg, record: msg, part: p, pending: 1}
+	p.mu.Lock()
+	p.queue = append(p.queue, d)
+	p.mu.Unlock()
+	return d
+}
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
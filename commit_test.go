@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPartitionCommits(t *testing.T) {
+	type rec struct {
+		partition int32
+		offset    int64
+		clients   int // references taken besides the dispatch's
+	}
+	for _, tc := range []struct {
+		name    string
+		records []rec
+		finish  []int // records released, by index, in order
+		want    []int64
+	}{
+		{"in order", []rec{{0, 0, 0}, {0, 1, 0}, {0, 2, 0}}, []int{0, 1, 2}, []int64{0, 1, 2}},
+		{"reverse order", []rec{{0, 0, 0}, {0, 1, 0}, {0, 2, 0}}, []int{2, 1, 0}, []int64{0, 1, 2}},
+		{"held back by an earlier record", []rec{{0, 0, 0}, {0, 1, 0}, {0, 2, 0}}, []int{0, 2}, []int64{0}},
+		{"nothing before the first", []rec{{0, 0, 0}, {0, 1, 0}}, []int{1}, nil},
+		{"partitions are independent", []rec{{0, 0, 0}, {0, 1, 0}, {1, 10, 0}, {1, 11, 0}}, []int{1, 2, 3}, []int64{10, 11}},
+		{"waits for every client", []rec{{0, 0, 2}, {0, 1, 0}}, []int{1, 0, 0}, nil},
+		{"after the last client", []rec{{0, 0, 2}, {0, 1, 0}}, []int{1, 0, 0, 0}, []int64{0, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sub := &commitRecorder{}
+			k := testConn(sub)
+			h := newHub()
+			var ds []*delivery
+			for _, r := range tc.records {
+				record := &Record{Topic: "employee.updates", Partition: r.partition, Offset: r.offset}
+				d := k.track(h, record, &ConsumerMessage{Topic: record.Topic, Partition: r.partition, Offset: r.offset})
+				for i := 0; i < r.clients; i++ {
+					d.add()
+				}
+				ds = append(ds, d)
+			}
+			for _, i := range tc.finish {
+				ds[i].finish()
+			}
+			if got := sub.offsets(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("committed %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// A record neither delivered, stored nor dead-lettered fails the connection
+// instead of holding back its partition's commits for good.
+func TestUndeliverableFailsConnection(t *testing.T) {
+	sub := &commitRecorder{}
+	k := testConn(sub)
+	h := newHub()
+	first := k.track(h, &Record{Topic: "employee.updates", Offset: 0}, &ConsumerMessage{Topic: "employee.updates"})
+	second := k.track(h, &Record{Topic: "employee.updates", Offset: 1}, &ConsumerMessage{Topic: "employee.updates", Offset: 1})
+
+	first.add()
+	first.finish()
+	first.fail(testClient(h, "c1", "FPA"))
+	second.finish()
+
+	select {
+	case <-k.dead:
+	default:
+		t.Fatal("connection not failed")
+	}
+	if errUndeliverable != k.err {
+		t.Errorf("connection failed with %v, want %v", k.err, errUndeliverable)
+	}
+	if got := sub.offsets(); 0 != len(got) {
+		t.Errorf("committed %v past an undelivered record", got)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// The config is layered: the file (config.json, or -config), then WSAPIGW_*
+// environment variables, then the -ip and -port flags. Every setting has an
+// environment variable named after its path in the file, e.g.
+// WSAPIGW_KAFKA or WSAPIGW_ADMISSION_PER_IP. Lists are comma-separated, maps
+// are given as JSON.
+
+const envPrefix = "WSAPIGW_"
+
+const (
+	defaultIP   = "0.0.0.0"
+	defaultPort = 3000
+)
+
+var (
+	configPath  = flag.String("config", "config.json", "config file, "+envPrefix+"CONFIG if not given")
+	printConfig = flag.Bool("print-config", false, "print the effective config, secrets masked, and exit")
+)
+
+type ServerConfig struct {
+	IP   string `json:"ip,omitempty"`
+	Port int    `json:"port,omitempty"`
+}
+
+// configSource is where the effective config came from.
+type configSource struct {
+	File string
+	Env  []string // variables that overrode the file
+}
+
+// initConfig loads, merges and validates the config, exiting if it is
+// unusable. With -print-config it prints the effective config and exits.
+func initConfig() (*KafkaConfig, configSource) {
+	c, src, err := loadConfig()
+	if err != nil {
+		rootLog.Error("error loading config", "file", src.File, "err", err)
+		os.Exit(2)
+	}
+	err = c.validate()
+	if *printConfig {
+		b, _ := json.MarshalIndent(c.redacted(), "", "  ")
+		fmt.Println(string(b))
+	}
+	if err != nil {
+		rootLog.Error("invalid config", "file", src.File, "err", err)
+		os.Exit(2)
+	}
+	if *printConfig {
+		os.Exit(0)
+	}
+	return c, src
+}
+
+// flagSet tells whether a flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if name == f.Name {
+			set = true
+		}
+	})
+	return set
+}
+
+func loadConfig() (*KafkaConfig, configSource, error) {
+	src := configSource{File: *configPath}
+	if p := os.Getenv(envPrefix + "CONFIG"); "" != p && !flagSet("config") {
+		src.File = p
+	}
+	b, err := ioutil.ReadFile(src.File)
+	if err != nil {
+		return nil, src, err
+	}
+	c := &KafkaConfig{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	// a misspelt key is an error rather than a setting left empty
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, src, jsonError(b, err)
+	}
+	if src.Env, err = applyEnv(reflect.ValueOf(c).Elem(), envPrefix); err != nil {
+		return nil, src, err
+	}
+	if flagSet("ip") {
+		c.Server.IP = *ip
+	}
+	if flagSet("port") {
+		c.Server.Port = *port
+	}
+	if "" == c.Server.IP {
+		c.Server.IP = defaultIP
+	}
+	if 0 == c.Server.Port {
+		c.Server.Port = defaultPort
+	}
+	return c, src, nil
+}
+
+// jsonError adds the line and column of a decoding error, when it has an
+// offset.
+func jsonError(b []byte, err error) error {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+		if "" != e.Field {
+			err = fmt.Errorf("%s: got %s, want %s", e.Field, e.Value, e.Type)
+		}
+	default:
+		return err
+	}
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	line := 1 + bytes.Count(b[:offset], []byte("\n"))
+	col := int(offset) - bytes.LastIndexByte(b[:offset], '\n')
+	return fmt.Errorf("line %d, column %d: %v", line, col, err)
+}
+
+// applyEnv overrides the fields of the struct v from the environment
+// variables named after their JSON keys under prefix, and returns the
+// variables it used.
+func applyEnv(v reflect.Value, prefix string) ([]string, error) {
+	var used []string
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if "" == key || "-" == key {
+			continue
+		}
+		name := prefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+		f := v.Field(i)
+		if reflect.Struct == f.Kind() {
+			nested, err := applyEnv(f, name+"_")
+			if err != nil {
+				return nil, err
+			}
+			used = append(used, nested...)
+			continue
+		}
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(f, s); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		used = append(used, name)
+	}
+	return used, nil
+}
+
+func setField(f reflect.Value, s string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", s)
+		}
+		f.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", s)
+		}
+		f.SetBool(b)
+	case reflect.Ptr:
+		p := reflect.New(f.Type().Elem())
+		if err := setField(p.Elem(), s); err != nil {
+			return err
+		}
+		f.Set(p)
+	case reflect.Slice:
+		if reflect.String != f.Type().Elem().Kind() {
+			return setJSON(f, s)
+		}
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); "" != item {
+				list = append(list, item)
+			}
+		}
+		f.Set(reflect.ValueOf(list))
+	default:
+		return setJSON(f, s)
+	}
+	return nil
+}
+
+func setJSON(f reflect.Value, s string) error {
+	p := reflect.New(f.Type())
+	if err := json.Unmarshal([]byte(s), p.Interface()); err != nil {
+		return fmt.Errorf("not JSON of the setting's type: %v", err)
+	}
+	f.Set(p.Elem())
+	return nil
+}
+
+// validate checks the settings the gateway can't run without, and values
+// it would otherwise ignore or replace with defaults. It reports every
+// problem at once.
+func (c *KafkaConfig) validate() error {
+	var problems []string
+	bad := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	oneOf := func(key string, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		bad("%s is %q, want one of %q", key, value, allowed)
+	}
+	notNegative := func(key string, n int) {
+		if n < 0 {
+			bad("%s is %d, must not be negative", key, n)
+		}
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		bad("server.port is %d, want 1-65535", c.Server.Port)
+	}
+	if 0 == len(c.Topics.Consume) {
+		bad("topics.consume is empty")
+	}
+	for _, t := range c.Topics.Consume {
+		if "" == t {
+			bad("topics.consume has an empty topic")
+		}
+	}
+	if "" == c.Cgroup {
+		bad("cgroup is empty")
+	}
+
+	oneOf("broker.type", c.Broker.Type, "", brokerKafka, brokerMemory, brokerRedis)
+	notNegative("broker.partitions", c.Broker.Partitions)
+	switch c.Broker.Type {
+	case "", brokerKafka:
+		if "" == c.KafkaAddr {
+			bad("kafka is empty")
+		}
+		if "" == c.ZookeeperAddr {
+			bad("zookeeper is empty")
+		}
+		if "" != c.Version {
+			if _, err := sarama.ParseKafkaVersion(c.Version); err != nil {
+				bad("version: %v", err)
+			}
+		}
+	case brokerRedis:
+		if "" == c.Broker.Addr {
+			bad("broker.addr is empty, the redis broker needs it")
+		}
+	}
+
+	oneOf("log.level", strings.ToLower(c.Log.Level), "", "debug", "info", "warn", "warning", "error")
+	oneOf("trace.exporter", c.Trace.Exporter, "", "stdout", "otlp")
+	oneOf("registry.format", c.Registry.Format, "", "avro", "protobuf")
+	oneOf("consumer.commit", c.Consumer.Commit, "", commitOnReceive, commitAfterDelivery)
+	if commitAfterDelivery == c.Consumer.Commit && "" == c.Topics.DeadLetter && "" == c.Outbox.Store {
+		bad("consumer.commit %q needs topics.deadletter or outbox.store for records it can't deliver", commitAfterDelivery)
+	}
+	oneOf("outbox.store", c.Outbox.Store, "", "kafka", "memory")
+	for _, section := range []struct {
+		key string
+		m   map[string]string
+	}{{"codecs.endpoints", c.Codecs.Endpoints}, {"codecs.topics", c.Codecs.Topics}} {
+		for k, name := range section.m {
+			if _, ok := codecs[name]; !ok {
+				bad("%s[%q] is the unknown codec %q", section.key, k, name)
+			}
+		}
+	}
+	for _, user := range c.Auth.Tokens {
+		if "" == user {
+			bad("auth.tokens has a token without a username")
+			break
+		}
+	}
+	for _, identity := range c.Ingest.Tokens {
+		if "" == identity.Type {
+			bad("ingest.tokens has a token without a type")
+			break
+		}
+	}
+	if "" != c.Ingest.ReplyTo && !stringIn(c.Ingest.ReplyTo, c.Topics.Consume) {
+		bad("ingest.reply_to %q is not in topics.consume", c.Ingest.ReplyTo)
+	}
+
+	notNegative("admission.max_connections", c.Admission.MaxConnections)
+	notNegative("admission.per_ip", c.Admission.PerIP)
+	notNegative("admission.per_user", c.Admission.PerUser)
+	notNegative("idempotency.window", c.Idempotency.Window)
+	notNegative("idempotency.max_keys", c.Idempotency.MaxKeys)
+	notNegative("acks.timeout", c.Acks.Timeout)
+	notNegative("acks.retries", c.Acks.Retries)
+	notNegative("outbox.ttl", c.Outbox.TTL)
+	notNegative("ingest.max_wait", c.Ingest.MaxWait)
+	notNegative("ratelimit.abuse_strikes", c.RateLimit.AbuseStrikes)
+	notNegative("ratelimit.abuse_window", c.RateLimit.AbuseWindow)
+
+	if 0 == len(problems) {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+func stringIn(s string, list []string) bool {
+	for _, l := range list {
+		if s == l {
+			return true
+		}
+	}
+	return false
+}
+
+// redacted returns a copy of c with tokens and passwords masked.
+func (c *KafkaConfig) redacted() *KafkaConfig {
+	r := *c
+	r.Admin.Token = mask(r.Admin.Token)
+	if 0 != len(c.Auth.Tokens) {
+		tokens := make([]string, 0, len(c.Auth.Tokens))
+		for t := range c.Auth.Tokens {
+			tokens = append(tokens, t)
+		}
+		sort.Strings(tokens)
+		r.Auth.Tokens = make(map[string]string, len(tokens))
+		for i, t := range tokens {
+			r.Auth.Tokens[fmt.Sprintf("%s %d", redacted, i+1)] = c.Auth.Tokens[t]
+		}
+	}
+	r.GRPC.Token = mask(r.GRPC.Token)
+	r.Broker.Password = mask(r.Broker.Password)
+	r.Registry.Password = mask(r.Registry.Password)
+	if 0 != len(c.Ingest.Tokens) {
+		tokens := make([]string, 0, len(c.Ingest.Tokens))
+		for t := range c.Ingest.Tokens {
+			tokens = append(tokens, t)
+		}
+		sort.Strings(tokens)
+		r.Ingest.Tokens = make(map[string]IngestIdentity, len(tokens))
+		for i, t := range tokens {
+			r.Ingest.Tokens[fmt.Sprintf("%s %d", redacted, i+1)] = c.Ingest.Tokens[t]
+		}
+	}
+	return &r
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testConfig is the checked-in config.json, decoded as the gateway does.
+func testConfig(t *testing.T) *KafkaConfig {
+	t.Helper()
+	b, err := ioutil.ReadFile("config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &KafkaConfig{}
+	if err := json.Unmarshal(b, c); err != nil {
+		t.Fatal(jsonError(b, err))
+	}
+	return c
+}
+
+func TestApplyEnv(t *testing.T) {
+	c := testConfig(t)
+	env := map[string]string{
+		"WSAPIGW_KAFKA":            "broker-1:9092",
+		"WSAPIGW_SERVER_PORT":      "8080",
+		"WSAPIGW_ADMISSION_PER_IP": "5",
+		"WSAPIGW_LOG_REDACT":       "false",
+		"WSAPIGW_TOPICS_CONSUME":   " a, b,,c ",
+		"WSAPIGW_RATELIMIT_USERS":  `{"jdelacruz": {"rate": 1, "burst": 2}}`,
+		"WSAPIGW_AUTH_TOKENS":      `{"s3cret": "jdelacruz"}`,
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	used, err := applyEnv(reflect.ValueOf(c).Elem(), envPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(env) != len(used) {
+		t.Errorf("used %q, want every variable set", used)
+	}
+	for _, name := range used {
+		if _, ok := env[name]; !ok {
+			t.Errorf("used %s, which isn't set", name)
+		}
+	}
+	if "broker-1:9092" != c.KafkaAddr {
+		t.Errorf("kafka %q", c.KafkaAddr)
+	}
+	if 8080 != c.Server.Port || "0.0.0.0" != c.Server.IP {
+		t.Errorf("server %+v, want the port replaced and the ip kept", c.Server)
+	}
+	if 5 != c.Admission.PerIP || 10 != c.Admission.PerUser {
+		t.Errorf("admission %+v, want per_ip replaced and per_user kept", c.Admission)
+	}
+	if nil == c.Log.Redact || *c.Log.Redact {
+		t.Errorf("log.redact %v, want false", c.Log.Redact)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(c.Topics.Consume, want) {
+		t.Errorf("topics.consume %q, want %q", c.Topics.Consume, want)
+	}
+	if want := map[string]Limit{"jdelacruz": {Rate: 1, Burst: 2}}; !reflect.DeepEqual(c.RateLimit.Users, want) {
+		t.Errorf("ratelimit.users %v, want the JSON to replace the map", c.RateLimit.Users)
+	}
+	if want := map[string]string{"s3cret": "jdelacruz"}; !reflect.DeepEqual(c.Auth.Tokens, want) {
+		t.Errorf("auth.tokens %v", c.Auth.Tokens)
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		value string
+		err   string
+	}{
+		{"WSAPIGW_SERVER_PORT", "http", `WSAPIGW_SERVER_PORT: "http" is not an integer`},
+		{"WSAPIGW_LOG_REDACT", "maybe", `WSAPIGW_LOG_REDACT: "maybe" is not a boolean`},
+		{"WSAPIGW_RATELIMIT_USERS", `{"*": 5}`, "WSAPIGW_RATELIMIT_USERS: not JSON of the setting's type"},
+		{"WSAPIGW_GRPC_TYPES", "SVC", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(tc.name, tc.value)
+			_, err := applyEnv(reflect.ValueOf(testConfig(t)).Elem(), envPrefix)
+			if "" == tc.err {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if nil == err || !strings.HasPrefix(err.Error(), tc.err) {
+				t.Errorf("error %v, want one starting %q", err, tc.err)
+			}
+		})
+	}
+}
+
+// Positions are those just after the offending token, where the decoder
+// stopped.
+func TestJSONError(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		doc  string
+		err  string
+	}{
+		{"syntax", "{\n  \"cgroup\": \"a\",\n  \"kafka\" 1\n}", "line 3, column 12: invalid character '1'"},
+		{"type", "{\n  \"server\": {\"port\": \"80\"}\n}", "line 2, column 26: server.port: got string, want int"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := []byte(tc.doc)
+			err := jsonError(b, json.Unmarshal(b, &KafkaConfig{}))
+			if nil == err || !strings.HasPrefix(err.Error(), tc.err) {
+				t.Errorf("error %v, want one starting %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := testConfig(t).validate(); err != nil {
+		t.Fatalf("config.json: %v", err)
+	}
+	for _, tc := range []struct {
+		name   string
+		change func(c *KafkaConfig)
+		want   string
+	}{
+		{"port", func(c *KafkaConfig) { c.Server.Port = 70000 }, "server.port is 70000, want 1-65535"},
+		{"no topics", func(c *KafkaConfig) { c.Topics.Consume = nil }, "topics.consume is empty"},
+		{"empty topic", func(c *KafkaConfig) { c.Topics.Consume = []string{"a", ""} }, "topics.consume has an empty topic"},
+		{"no cgroup", func(c *KafkaConfig) { c.Cgroup = "" }, "cgroup is empty"},
+		{"kafka without brokers", func(c *KafkaConfig) { c.KafkaAddr, c.ZookeeperAddr = "", "" },
+			"kafka is empty; zookeeper is empty"},
+		{"memory needs no brokers", func(c *KafkaConfig) {
+			c.Broker.Type, c.KafkaAddr, c.ZookeeperAddr, c.Version = brokerMemory, "", "", "bad"
+		}, ""},
+		{"version", func(c *KafkaConfig) { c.Version = "0.11" }, "version: "},
+		{"redis without addr", func(c *KafkaConfig) { c.Broker.Type, c.Broker.Addr = brokerRedis, "" },
+			"broker.addr is empty, the redis broker needs it"},
+		{"broker type", func(c *KafkaConfig) { c.Broker.Type = "nats" }, `broker.type is "nats", want one of`},
+		{"log level in any case", func(c *KafkaConfig) { c.Log.Level = "WARN" }, ""},
+		{"log level", func(c *KafkaConfig) { c.Log.Level = "trace" }, `log.level is "trace"`},
+		{"trace exporter", func(c *KafkaConfig) { c.Trace.Exporter = "jaeger" }, `trace.exporter is "jaeger"`},
+		{"registry format", func(c *KafkaConfig) { c.Registry.Format = "json" }, `registry.format is "json"`},
+		{"after delivery", func(c *KafkaConfig) { c.Consumer.Commit = commitAfterDelivery },
+			`consumer.commit "after_delivery" needs topics.deadletter or outbox.store`},
+		{"after delivery with a dead-letter topic", func(c *KafkaConfig) {
+			c.Consumer.Commit, c.Topics.DeadLetter = commitAfterDelivery, "wsapigw.dlq"
+		}, ""},
+		{"after delivery with an outbox", func(c *KafkaConfig) {
+			c.Consumer.Commit, c.Outbox.Store = commitAfterDelivery, "memory"
+		}, ""},
+		{"outbox store", func(c *KafkaConfig) { c.Outbox.Store = "redis" }, `outbox.store is "redis"`},
+		{"codec", func(c *KafkaConfig) { c.Codecs.Topics = map[string]string{"employee.updates": "xml"} },
+			`codecs.topics["employee.updates"] is the unknown codec "xml"`},
+		{"auth token without a user", func(c *KafkaConfig) { c.Auth.Tokens = map[string]string{"s3cret": ""} },
+			"auth.tokens has a token without a username"},
+		{"ingest token without a type", func(c *KafkaConfig) {
+			c.Ingest.Tokens = map[string]IngestIdentity{"s3cret": {Username: "svc"}}
+		}, "ingest.tokens has a token without a type"},
+		{"reply topic not consumed", func(c *KafkaConfig) { c.Ingest.ReplyTo = "replies" },
+			`ingest.reply_to "replies" is not in topics.consume`},
+		{"negative", func(c *KafkaConfig) { c.Acks.Retries = -1 }, "acks.retries is -1, must not be negative"},
+		{"every problem", func(c *KafkaConfig) { c.Cgroup, c.Admission.PerIP = "", -2 },
+			"cgroup is empty; admission.per_ip is -2, must not be negative"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := testConfig(t)
+			tc.change(c)
+			err := c.validate()
+			if "" == tc.want {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if nil == err || !strings.HasPrefix(err.Error(), tc.want) {
+				t.Errorf("error %v, want one starting %q", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clients may tag a message with an IdempotencyKey. Within the dedup window a
+// second message with the same key from the same user (or, for anonymous
+// clients, the same connection or ingestion token) is not published again;
+// the client gets a frame with Status "duplicate" instead. Keys are forgotten
+// when the publish fails so the client can retry.
+
+const statusDuplicate = "duplicate"
+
+const (
+	defaultDedupWindow  = 10 * time.Minute
+	defaultDedupMaxKeys = 100000
+)
+
+type IdempotencyConfig struct {
+	Window  int `json:"window,omitempty"` // seconds
+	MaxKeys int `json:"max_keys,omitempty"`
+}
+
+var duplicateMessages = newCounterVec("wsapigw_duplicate_messages_total",
+	"Client messages not published because their idempotency key was seen within the dedup window.", "route")
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+// dedupCache remembers keys in arrival order so expired ones are dropped
+// from the front.
+type dedupCache struct {
+	window  time.Duration
+	maxKeys int
+	mu      sync.Mutex
+	seen    map[string]time.Time
+	order   []dedupEntry
+}
+
+var dedup = newDedupCache(IdempotencyConfig{})
+
+func newDedupCache(c IdempotencyConfig) *dedupCache {
+	d := &dedupCache{
+		window:  time.Duration(c.Window) * time.Second,
+		maxKeys: c.MaxKeys,
+		seen:    make(map[string]time.Time),
+	}
+	if 0 == d.window {
+		d.window = defaultDedupWindow
+	}
+	if 0 == d.maxKeys {
+		d.maxKeys = defaultDedupMaxKeys
+	}
+	return d
+}
+
+func initIdempotency(c IdempotencyConfig) {
+	dedup = newDedupCache(c)
+}
+
+// dedupKey scopes a message's idempotency key to its sender.
+func dedupKey(c *Client, msg *ClientMessage) string {
+	if "" == msg.IdempotencyKey {
+		return ""
+	}
+	if user := c.hub.user(c); "" != user {
+		return c.Type + "/" + user + "/" + msg.IdempotencyKey
+	}
+	if "" != c.scope {
+		return c.scope + "/" + msg.IdempotencyKey
+	}
+	return c.cid + "/" + msg.IdempotencyKey
+}
+
+// first records key and reports whether it was not seen within the window.
+func (d *dedupCache) first(key string) bool {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire(now)
+	if _, ok := d.seen[key]; ok {
+		return false
+	}
+	d.seen[key] = now
+	d.order = append(d.order, dedupEntry{key, now})
+	return true
+}
+
+// expire drops keys older than the window, and the oldest keys past maxKeys.
+func (d *dedupCache) expire(now time.Time) {
+	i := 0
+	for ; i < len(d.order); i++ {
+		e := d.order[i]
+		if now.Sub(e.seen) < d.window && len(d.order)-i <= d.maxKeys {
+			break
+		}
+		// a forgotten and re-added key has a newer entry further on
+		if seen, ok := d.seen[e.key]; ok && seen.Equal(e.seen) {
+			delete(d.seen, e.key)
+		}
+	}
+	// append moves the live entries to a new array once the old one fills
+	d.order = d.order[i:]
+}
+
+// forget removes key so the message can be sent again.
+func (d *dedupCache) forget(key string) {
+	if "" == key {
+		return
+	}
+	d.mu.Lock()
+	delete(d.seen, key)
+	d.mu.Unlock()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupCache(t *testing.T) {
+	type step struct {
+		op    string // first, forget or wait
+		key   string
+		first bool
+	}
+	first := func(key string, want bool) step { return step{"first", key, want} }
+	forget := step{"forget", "a", false}
+	wait := step{"wait", "", false}
+	for _, tc := range []struct {
+		name    string
+		window  time.Duration
+		maxKeys int
+		steps   []step
+	}{
+		{"duplicate", time.Minute, 10, []step{first("a", true), first("a", false), first("b", true), first("a", false)}},
+		{"expired", 20 * time.Millisecond, 10, []step{first("a", true), wait, first("a", true), first("a", false)}},
+		{"forgotten", time.Minute, 10, []step{first("a", true), forget, first("a", true), first("a", false)}},
+		{"forgotten, then expired", 20 * time.Millisecond, 10, []step{first("a", true), forget, first("a", true), wait, first("a", true)}},
+		{"past max keys", time.Minute, 2, []step{first("a", true), first("b", true), first("c", true), first("a", true), first("c", false)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newDedupCache(IdempotencyConfig{})
+			d.window, d.maxKeys = tc.window, tc.maxKeys
+			for i, s := range tc.steps {
+				switch s.op {
+				case "wait":
+					time.Sleep(2 * tc.window)
+				case "forget":
+					d.forget(s.key)
+				default:
+					if got := d.first(s.key); s.first != got {
+						t.Errorf("step %d: first(%q) %v, want %v", i, s.key, got, s.first)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDedupKey(t *testing.T) {
+	h := newHub()
+	client := func(cid string, user string, scope string) *Client {
+		c := testClient(h, cid, "RA")
+		c.user, c.scope = user, scope
+		return c
+	}
+	msg := &ClientMessage{IdempotencyKey: "k1"}
+	for _, tc := range []struct {
+		name string
+		a, b *Client
+		same bool
+	}{
+		{"same user, different connections", client("c1", "jdelacruz", ""), client("c2", "jdelacruz", ""), true},
+		{"different users", client("c1", "jdelacruz", ""), client("c1", "msantos", ""), false},
+		{"anonymous, same connection", client("c1", "", ""), client("c1", "", ""), true},
+		{"anonymous, different connections", client("c1", "", ""), client("c2", "", ""), false},
+		{"same ingestion token, different requests", client("c1", "", "ingest/ab"), client("c2", "", "ingest/ab"), true},
+		{"different ingestion tokens", client("c1", "", "ingest/ab"), client("c1", "", "ingest/cd"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := dedupKey(tc.a, msg), dedupKey(tc.b, msg)
+			if (a == b) != tc.same {
+				t.Errorf("keys %q and %q, want the same: %v", a, b, tc.same)
+			}
+		})
+	}
+	if k := dedupKey(client("c1", "jdelacruz", ""), &ClientMessage{}); "" != k {
+		t.Errorf("message without an IdempotencyKey has key %q", k)
+	}
+}
+
+// A message the broker didn't take can be sent again with the same key.
+func TestDedupForgetOnPublishFailure(t *testing.T) {
+	withDedup(t)
+	h := newHub()
+	msg := &ClientMessage{CID: "c1", IdempotencyKey: "k1", dkey: "c1/k1", result: make(chan error, 1)}
+	if !dedup.first(msg.dkey) {
+		t.Fatal("key seen before the first message")
+	}
+	// there is no broker
+	h.publishClient(msg)
+	if err := <-msg.result; errBrokerUnavailable != err {
+		t.Fatalf("publish: %v, want errBrokerUnavailable", err)
+	}
+	if !dedup.first(msg.dkey) {
+		t.Error("key still remembered after the publish failed")
+	}
+}
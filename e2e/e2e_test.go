@@ -0,0 +1,429 @@
+// Package e2e holds the gateway's end-to-end tests. TestMain builds the
+// gateway and starts it against its in-memory broker, served over HTTP, and
+// the tests play both sides of the system around it: scripted RA, FPA and FPB
+// websocket clients, and the ledger backend that consumes ledgertx.req and
+// produces the approval request, update and block topics. Each scenario drives
+// a flow through the gateway and asserts on what every client receives.
+//
+//	go test ./e2e
+//
+// The gateway runs in a temporary directory with a config.json derived from
+// -config. Its log is printed when a test fails, or with -v. -short skips the
+// end-to-end tests.
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	backendGroup = "wsapigw-e2e"
+	adminToken   = "e2e"
+	startTimeout = 15 * time.Second
+)
+
+var (
+	gateway = flag.String("gateway", "", "gateway binary to test, built from the parent directory if not given")
+	base    = flag.String("config", "../config.json", "config the gateway's is derived from")
+	wait    = flag.Duration("wait", 3*time.Second, "how long to wait for an expected message")
+	quiet   = flag.Duration("quiet", 300*time.Millisecond, "how long a client must receive nothing to count as not routed to")
+)
+
+// env is a running gateway and the addresses of its listeners.
+type env struct {
+	dir    string
+	cmd    *exec.Cmd
+	exited chan struct{}
+	addr   string // websocket endpoints
+	broker string // in-memory broker's HTTP API
+	admin  string
+	http   *http.Client
+}
+
+func freeAddr() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
+
+// config derives the gateway's config from the base one: the in-memory
+// broker over HTTP, the admin API on, an in-memory outbox and quieter logs.
+func config(brokerAddr string, adminAddr string) ([]byte, error) {
+	b, err := ioutil.ReadFile(*base)
+	if err != nil {
+		return nil, err
+	}
+	c := make(map[string]interface{})
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", *base, err)
+	}
+	c["broker"] = map[string]interface{}{"type": "memory", "partitions": 2, "listen": brokerAddr}
+	c["admin"] = map[string]interface{}{"addr": adminAddr, "token": adminToken}
+	c["outbox"] = map[string]interface{}{"store": "memory", "ttl": 600}
+	c["log"] = map[string]interface{}{"level": "warn"}
+	c["trace"] = map[string]interface{}{"exporter": ""}
+	// records are read and written as JSON
+	c["codecs"] = map[string]interface{}{}
+	c["registry"] = map[string]interface{}{}
+	return json.MarshalIndent(c, "", "  ")
+}
+
+// build builds the gateway into dir.
+func build(dir string) (string, error) {
+	bin := filepath.Join(dir, "wsapigw")
+	cmd := exec.Command("go", "build", "-o", bin, "..")
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("building the gateway: %v", err)
+	}
+	return bin, nil
+}
+
+func start() (*env, error) {
+	dir, err := ioutil.TempDir("", "wsapigw-e2e")
+	if err != nil {
+		return nil, err
+	}
+	e := &env{dir: dir, http: &http.Client{Timeout: 2 * startTimeout}}
+	bin := *gateway
+	if "" == bin {
+		bin, err = build(dir)
+	} else {
+		bin, err = filepath.Abs(bin)
+	}
+	if err != nil {
+		return e, err
+	}
+	if e.addr, err = freeAddr(); err != nil {
+		return e, err
+	}
+	if e.broker, err = freeAddr(); err != nil {
+		return e, err
+	}
+	if e.admin, err = freeAddr(); err != nil {
+		return e, err
+	}
+	c, err := config(e.broker, e.admin)
+	if err != nil {
+		return e, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), c, 0600); err != nil {
+		return e, err
+	}
+	logf, err := os.Create(filepath.Join(dir, "gateway.log"))
+	if err != nil {
+		return e, err
+	}
+	host, port, _ := net.SplitHostPort(e.addr)
+	e.cmd = exec.Command(bin, "-ip", host, "-port", port)
+	e.cmd.Dir = dir
+	e.cmd.Stdout, e.cmd.Stderr = logf, logf
+	if err := e.cmd.Start(); err != nil {
+		return e, err
+	}
+	e.exited = make(chan struct{})
+	go func() {
+		e.cmd.Wait()
+		close(e.exited)
+	}()
+	deadline := time.Now().Add(startTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-e.exited:
+			return e, errors.New("gateway exited: " + e.cmd.ProcessState.String())
+		default:
+		}
+		resp, err := e.http.Get("http://" + e.addr + "/readyz")
+		if nil == err {
+			resp.Body.Close()
+			if http.StatusOK == resp.StatusCode {
+				return e, nil
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	e.stop()
+	return e, errors.New("gateway not ready after " + startTimeout.String())
+}
+
+func (e *env) stop() {
+	e.cmd.Process.Kill()
+	<-e.exited
+}
+
+func (e *env) log() string {
+	b, _ := ioutil.ReadFile(filepath.Join(e.dir, "gateway.log"))
+	return string(b)
+}
+
+// record is a broker record as served by the in-memory broker.
+type record struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Value     string
+}
+
+// produce plays the backend producing v to topic.
+func (e *env) produce(topic string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := e.http.Post("http://"+e.broker+"/topics/"+url.PathEscape(topic), "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if http.StatusOK != resp.StatusCode {
+		return fmt.Errorf("producing to %s: %s", topic, resp.Status)
+	}
+	return nil
+}
+
+// consume plays the backend consuming topic, waiting up to wait for records.
+func (e *env) consume(topic string, wait time.Duration) ([]record, error) {
+	u := "http://" + e.broker + "/topics/" + url.PathEscape(topic) +
+		"?group=" + backendGroup + "&wait=" + strconv.Itoa(int(wait/time.Second))
+	resp, err := e.http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var records []record
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		return nil, fmt.Errorf("consuming %s: %v", topic, err)
+	}
+	return records, nil
+}
+
+// request consumes the next ledger request, which must be the only one.
+func (e *env) request() (*message, error) {
+	records, err := e.consume("ledgertx.req", *wait+time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if 1 != len(records) {
+		return nil, fmt.Errorf("ledgertx.req: got %d records, want 1", len(records))
+	}
+	m := &message{}
+	if err := json.Unmarshal([]byte(records[0].Value), m); err != nil {
+		return nil, fmt.Errorf("ledgertx.req: %v", err)
+	}
+	return m, nil
+}
+
+// adminDo calls the admin API with body, if set, as JSON and decodes the
+// response into v, if set.
+func (e *env) adminDo(method string, path string, body interface{}, v interface{}) (int, error) {
+	var r io.Reader
+	if nil != body {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, "http://"+e.admin+path, r)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if nil != v {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return resp.StatusCode, err
+		}
+	} else {
+		io.Copy(ioutil.Discard, resp.Body)
+	}
+	return resp.StatusCode, nil
+}
+
+type clientInfo struct {
+	CID  string
+	Type string
+}
+
+func (e *env) clients() ([]clientInfo, error) {
+	var clients []clientInfo
+	_, err := e.adminDo(http.MethodGet, "/clients", nil, &clients)
+	return clients, err
+}
+
+// errorInfo and message are the parts of the gateway's ClientMessage the
+// scenarios look at.
+type errorInfo struct {
+	Code    string
+	Message string
+	Fields  []string
+}
+
+type message struct {
+	Version  string                     `json:",omitempty"`
+	CID      string                     `json:",omitempty"`
+	Username string                     `json:",omitempty"`
+	Type     string                     `json:",omitempty"`
+	Status   string                     `json:",omitempty"`
+	Payload  map[string]json.RawMessage `json:",omitempty"`
+	Error    *errorInfo                 `json:",omitempty"`
+	RecordID string                     `json:",omitempty"`
+	Ack      string                     `json:",omitempty"`
+}
+
+// has reports whether the message carries a payload variant.
+func (m *message) has(variant string) bool {
+	_, ok := m.Payload[variant]
+	return ok
+}
+
+// variant decodes a payload variant into v.
+func (m *message) variant(name string, v interface{}) error {
+	raw, ok := m.Payload[name]
+	if !ok {
+		return fmt.Errorf("message has no %s payload: %s", name, m)
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func (m *message) String() string {
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+// client is a scripted websocket client.
+type client struct {
+	name   string
+	conn   *websocket.Conn
+	frames chan *message
+	closed chan struct{}
+}
+
+func (e *env) connect(name string, endpoint string) (*client, error) {
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+e.addr+endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	c := &client{name: name, conn: conn, frames: make(chan *message, 100), closed: make(chan struct{})}
+	go func() {
+		defer close(c.closed)
+		for {
+			_, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			m := &message{}
+			if err := json.Unmarshal(b, m); err != nil {
+				m.Status = "undecodable frame: " + string(b)
+			}
+			c.frames <- m
+		}
+	}()
+	return c, nil
+}
+
+func (c *client) send(v interface{}) error {
+	if err := c.conn.WriteJSON(v); err != nil {
+		return fmt.Errorf("%s: %v", c.name, err)
+	}
+	return nil
+}
+
+func (c *client) sendRaw(frame string) error {
+	if err := c.conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+		return fmt.Errorf("%s: %v", c.name, err)
+	}
+	return nil
+}
+
+// expect returns the next message, which must arrive within -wait.
+func (c *client) expect(what string) (*message, error) {
+	select {
+	case m := <-c.frames:
+		return m, nil
+	case <-c.closed:
+		return nil, fmt.Errorf("%s: connection closed waiting for %s", c.name, what)
+	case <-time.After(*wait):
+		return nil, fmt.Errorf("%s: no %s within %s", c.name, what, *wait)
+	}
+}
+
+// nothing fails if a message arrives within -quiet.
+func (c *client) nothing() error {
+	select {
+	case m := <-c.frames:
+		return fmt.Errorf("%s: unexpected message %s", c.name, m)
+	case <-time.After(*quiet):
+		return nil
+	}
+}
+
+// gone waits for the gateway to close the connection.
+func (c *client) gone() error {
+	select {
+	case <-c.closed:
+		return nil
+	case m := <-c.frames:
+		return fmt.Errorf("%s: unexpected message %s before disconnect", c.name, m)
+	case <-time.After(*wait):
+		return fmt.Errorf("%s: still connected after %s", c.name, *wait)
+	}
+}
+
+func (c *client) close() {
+	c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.conn.Close()
+}
+
+// gw is the gateway the tests run against.
+var gw *env
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if testing.Short() {
+		fmt.Println("skipping end-to-end tests in short mode")
+		os.Exit(0)
+	}
+	e, err := start()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "starting gateway:", err)
+		if nil != e {
+			fmt.Fprint(os.Stderr, e.log())
+			os.RemoveAll(e.dir)
+		}
+		os.Exit(2)
+	}
+	gw = e
+	code := m.Run()
+	e.stop()
+	if 0 != code || testing.Verbose() {
+		fmt.Println("--- gateway log")
+		fmt.Print(e.log())
+	}
+	os.RemoveAll(e.dir)
+	os.Exit(code)
+}
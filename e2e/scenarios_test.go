@@ -0,0 +1,487 @@
+package e2e
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type obj = map[string]interface{}
+
+// The scenarios share the gateway and each waits for its clients to be gone
+// before it returns, so they must not run in parallel.
+
+func TestEnrollment(t *testing.T) { check(t, enrollment(gw)) }
+
+func TestChangeFP(t *testing.T) { check(t, changeFP(gw)) }
+
+func TestFanout(t *testing.T) { check(t, fanout(gw)) }
+
+func TestErrorFrames(t *testing.T) { check(t, errorFrames(gw)) }
+
+func TestDisconnect(t *testing.T) { check(t, disconnect(gw)) }
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func person(id string) obj {
+	return obj{"ID": id, "FirstName": "Juan", "LastName": "Dela Cruz"}
+}
+
+func fpInfo(code string) obj {
+	return obj{"FPCode": code, "FPName": code + " Fund", "FPProgram": "retirement"}
+}
+
+func approved() obj {
+	return obj{"FPApproval": obj{"Status": "APPROVED", "Date": time.Now().Format("2006-01-02")}}
+}
+
+// employee is the ledger's Employee record.
+func employee(id string, fp string, newFP string, status string) obj {
+	e := obj{"docType": "Employee", "EmployeeData": person(id), "FPInfo": fpInfo(fp), "EnrollmentStatus": status}
+	if "" != newFP {
+		e["NewFPInfo"] = fpInfo(newFP)
+	}
+	return obj{"Employee": e}
+}
+
+type employeeRecord struct {
+	EmployeeData     struct{ ID string }
+	FPInfo           struct{ FPCode string }
+	EnrollmentStatus string
+}
+
+// expectEmployee expects the next message of each client to carry the
+// Employee record id in status.
+func expectEmployee(id string, status string, clients ...*client) error {
+	for _, c := range clients {
+		m, err := c.expect("Employee " + id)
+		if err != nil {
+			return err
+		}
+		var emp employeeRecord
+		if err := m.variant("Employee", &emp); err != nil {
+			return fmt.Errorf("%s: %v", c.name, err)
+		}
+		if id != emp.EmployeeData.ID || status != emp.EnrollmentStatus {
+			return fmt.Errorf("%s: got %s, want Employee %s in %s", c.name, m, id, status)
+		}
+	}
+	return nil
+}
+
+// expectVariant expects the next message of each client to carry a payload
+// variant.
+func expectVariant(variant string, clients ...*client) error {
+	for _, c := range clients {
+		m, err := c.expect(variant)
+		if err != nil {
+			return err
+		}
+		if !m.has(variant) {
+			return fmt.Errorf("%s: got %s, want a %s", c.name, m, variant)
+		}
+	}
+	return nil
+}
+
+// silent checks that none of the clients was routed anything.
+func silent(clients ...*client) error {
+	for _, c := range clients {
+		if err := c.nothing(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ledgerGot consumes the next ledger request and checks who sent which
+// payload variant.
+func (e *env) ledgerGot(ctype string, variant string) (*message, error) {
+	m, err := e.request()
+	if err != nil {
+		return nil, err
+	}
+	if ctype != m.Type || !m.has(variant) || "" == m.CID || "" == m.Version {
+		return nil, fmt.Errorf("ledger got %s, want a %s from %s", m, variant, ctype)
+	}
+	return m, nil
+}
+
+// settle waits until the gateway has n clients registered.
+func (e *env) settle(n int) error {
+	deadline := time.Now().Add(*wait)
+	for {
+		clients, err := e.clients()
+		if err != nil {
+			return err
+		}
+		if n == len(clients) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("gateway has %d clients, want %d", len(clients), n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// session connects a client per name, on the endpoint the name starts with
+// ("ra2" is a second RA client), and waits for the gateway to register them.
+// done disconnects them and waits for the gateway to notice.
+func (e *env) session(names ...string) (clients []*client, done func(), err error) {
+	done = func() {
+		for _, c := range clients {
+			c.close()
+		}
+		e.settle(0)
+	}
+	for _, name := range names {
+		c, err := e.connect(name, "/"+strings.TrimRight(name, "0123456789"))
+		if err != nil {
+			done()
+			return nil, nil, err
+		}
+		clients = append(clients, c)
+	}
+	if err := e.settle(len(names)); err != nil {
+		done()
+		return nil, nil, err
+	}
+	return clients, done, nil
+}
+
+// enrollment: RA enrolls an employee with FPA, the ledger asks FPA for
+// approval, FPA approves, and the ledger answers the RA and announces the
+// block.
+func enrollment(e *env) error {
+	cs, done, err := e.session("ra", "fpa", "fpb")
+	if err != nil {
+		return err
+	}
+	defer done()
+	ra, fpa, fpb := cs[0], cs[1], cs[2]
+
+	err = ra.send(obj{"Type": "RA", "Payload": obj{"EnrollmentReq": obj{"EmployeeData": person("E-100"), "FPInfo": fpInfo("FPA")}}})
+	if err != nil {
+		return err
+	}
+	req, err := e.ledgerGot("RA", "EnrollmentReq")
+	if err != nil {
+		return err
+	}
+
+	// the approval request is routed by FP code
+	if err := e.produce("employee.enrollment.approval.req", obj{"Payload": employee("E-100", "FPA", "", "PENDING")}); err != nil {
+		return err
+	}
+	if err := expectEmployee("E-100", "PENDING", fpa); err != nil {
+		return err
+	}
+	if err := silent(ra, fpb); err != nil {
+		return err
+	}
+
+	err = fpa.send(obj{"Type": "FPA", "Payload": obj{"EnrollmentApproval": obj{
+		"EmployeeData": person("E-100"), "FPInfo": fpInfo("FPA"), "Approvals": approved()}}})
+	if err != nil {
+		return err
+	}
+	if _, err := e.ledgerGot("FPA", "EnrollmentApproval"); err != nil {
+		return err
+	}
+
+	// the reply goes to the requesting client alone, whatever its payload
+	err = e.produce("employee.updates", obj{"CID": req.CID, "Status": "ENROLLED", "Payload": employee("E-100", "FPA", "", "ENROLLED")})
+	if err != nil {
+		return err
+	}
+	if err := expectEmployee("E-100", "ENROLLED", ra); err != nil {
+		return err
+	}
+	if err := silent(fpa, fpb); err != nil {
+		return err
+	}
+
+	if err := e.produce("new.block.created", obj{"Payload": obj{"Block": "block-100"}}); err != nil {
+		return err
+	}
+	return expectVariant("Block", ra, fpa, fpb)
+}
+
+// changeFP: RA moves an employee from FPA to FPB, both FPs approve in turn,
+// and the ledger's update reaches the RA and the new FP.
+func changeFP(e *env) error {
+	cs, done, err := e.session("ra", "fpa", "fpb")
+	if err != nil {
+		return err
+	}
+	defer done()
+	ra, fpa, fpb := cs[0], cs[1], cs[2]
+
+	err = ra.send(obj{"Type": "RA", "Payload": obj{"ChangeFPReq": obj{"EmpID": "E-200", "CurrFPCode": "FPA", "NewFPInfo": fpInfo("FPB")}}})
+	if err != nil {
+		return err
+	}
+	if _, err := e.ledgerGot("RA", "ChangeFPReq"); err != nil {
+		return err
+	}
+
+	// the current FP approves first
+	if err := e.produce("employee.changefp.req", obj{"Payload": employee("E-200", "FPA", "FPB", "CHANGE_FP_PENDING")}); err != nil {
+		return err
+	}
+	if err := expectEmployee("E-200", "CHANGE_FP_PENDING", fpa); err != nil {
+		return err
+	}
+	if err := silent(ra, fpb); err != nil {
+		return err
+	}
+	approval := obj{"ChangeFPApproval": obj{"EmployeeData": "E-200", "FPInfo": fpInfo("FPA"), "NewFPInfo": fpInfo("FPB"), "Approvals": approved()}}
+	if err := fpa.send(obj{"Type": "FPA", "Payload": approval}); err != nil {
+		return err
+	}
+	if _, err := e.ledgerGot("FPA", "ChangeFPApproval"); err != nil {
+		return err
+	}
+
+	// then the new one
+	if err := e.produce("employee.changefp.req", obj{"Payload": employee("E-200", "FPB", "FPB", "CHANGE_FP_APPROVED_BY_CURRENT")}); err != nil {
+		return err
+	}
+	if err := expectEmployee("E-200", "CHANGE_FP_APPROVED_BY_CURRENT", fpb); err != nil {
+		return err
+	}
+	if err := silent(ra, fpa); err != nil {
+		return err
+	}
+	if err := fpb.send(obj{"Type": "FPB", "Payload": approval}); err != nil {
+		return err
+	}
+	if _, err := e.ledgerGot("FPB", "ChangeFPApproval"); err != nil {
+		return err
+	}
+
+	// routed both by FP code and by Type
+	if err := e.produce("employee.updates", obj{"Type": "RA", "Payload": employee("E-200", "FPB", "", "ENROLLED")}); err != nil {
+		return err
+	}
+	if err := expectEmployee("E-200", "ENROLLED", ra, fpb); err != nil {
+		return err
+	}
+	return silent(fpa)
+}
+
+// fanout: every client of a type gets what is routed to the type, blocks go
+// to everyone, and operator notices to the clients of one type.
+func fanout(e *env) error {
+	cs, done, err := e.session("ra", "ra2", "fpa", "fpb", "fpb2")
+	if err != nil {
+		return err
+	}
+	defer done()
+	ra, ra2, fpa, fpb, fpb2 := cs[0], cs[1], cs[2], cs[3], cs[4]
+
+	if err := e.produce("dashboard.updates", obj{"Type": "RA", "Status": "dashboard", "Payload": obj{}}); err != nil {
+		return err
+	}
+	for _, c := range []*client{ra, ra2} {
+		m, err := c.expect("dashboard update")
+		if err != nil {
+			return err
+		}
+		if "dashboard" != m.Status {
+			return fmt.Errorf("%s: got %s, want the dashboard update", c.name, m)
+		}
+	}
+	if err := silent(fpa, fpb, fpb2); err != nil {
+		return err
+	}
+
+	if err := e.produce("employee.updates", obj{"Payload": employee("E-300", "FPB", "", "ENROLLED")}); err != nil {
+		return err
+	}
+	if err := expectEmployee("E-300", "ENROLLED", fpb, fpb2); err != nil {
+		return err
+	}
+	if err := silent(ra, ra2, fpa); err != nil {
+		return err
+	}
+
+	if err := e.produce("new.block.created", obj{"Payload": obj{"Block": "block-300"}}); err != nil {
+		return err
+	}
+	if err := expectVariant("Block", cs...); err != nil {
+		return err
+	}
+
+	var resp struct{ Delivered int }
+	status, err := e.adminDo(http.MethodPost, "/broadcast", obj{"Type": "FPB", "Message": "maintenance at noon"}, &resp)
+	if err != nil {
+		return err
+	}
+	if http.StatusOK != status || 2 != resp.Delivered {
+		return fmt.Errorf("broadcast: status %d, delivered to %d clients, want 2", status, resp.Delivered)
+	}
+	if err := expectVariant("Notice", fpb, fpb2); err != nil {
+		return err
+	}
+	return silent(ra, ra2, fpa)
+}
+
+// errorFrames: messages the gateway won't publish are answered with error
+// frames, and the connection stays usable.
+func errorFrames(e *env) error {
+	cs, done, err := e.session("ra")
+	if err != nil {
+		return err
+	}
+	defer done()
+	ra := cs[0]
+
+	valid := obj{"EnrollmentReq": obj{"EmployeeData": person("E-400"), "FPInfo": fpInfo("FPA")}}
+	incomplete := obj{"EnrollmentReq": obj{"EmployeeData": obj{"ID": "E-400"}, "FPInfo": fpInfo("FPA")}}
+	cases := []struct {
+		name  string
+		send  func() error
+		code  string
+		field string
+	}{
+		{"malformed", func() error { return ra.sendRaw("{not json") }, "malformed_message", ""},
+		{"unsupported version", func() error { return ra.send(obj{"Version": "9", "Type": "RA", "Payload": valid}) }, "unsupported_version", ""},
+		{"missing fields", func() error { return ra.send(obj{"Type": "RA", "Payload": incomplete}) }, "invalid_payload", "EnrollmentReq.EmployeeData.FirstName"},
+	}
+	for _, tc := range cases {
+		if err := tc.send(); err != nil {
+			return err
+		}
+		m, err := ra.expect(tc.code + " error frame")
+		if err != nil {
+			return err
+		}
+		if nil == m.Error || tc.code != m.Error.Code {
+			return fmt.Errorf("%s: got %s, want a %s error", tc.name, m, tc.code)
+		}
+		if "" != tc.field && !strings.Contains(strings.Join(m.Error.Fields, " "), tc.field) {
+			return fmt.Errorf("%s: error fields %v don't name %s", tc.name, m.Error.Fields, tc.field)
+		}
+	}
+	records, err := e.consume("ledgertx.req", 0)
+	if err != nil {
+		return err
+	}
+	if 0 != len(records) {
+		return fmt.Errorf("rejected messages were published: %v", records)
+	}
+
+	if err := ra.send(obj{"Type": "RA", "Payload": valid}); err != nil {
+		return err
+	}
+	_, err = e.ledgerGot("RA", "EnrollmentReq")
+	return err
+}
+
+// disconnect: the gateway unregisters clients that leave or are kicked,
+// keeps what is routed to a type with no client connected until one
+// connects, and doesn't hand a gone client's replies to anyone else.
+func disconnect(e *env) error {
+	cs, done, err := e.session("fpb")
+	if err != nil {
+		return err
+	}
+	cs[0].close()
+	if err := e.settle(0); err != nil {
+		return err
+	}
+
+	if err := e.produce("employee.enrollment.approval.req", obj{"Payload": employee("E-500", "FPB", "", "PENDING")}); err != nil {
+		return err
+	}
+	// give the hub time to route it before FPB comes back
+	time.Sleep(*quiet)
+	cs, done, err = e.session("fpb")
+	if err != nil {
+		return err
+	}
+	fpb := cs[0]
+	m, err := fpb.expect("stored approval request")
+	if err != nil {
+		done()
+		return err
+	}
+	if !m.has("Employee") || "" == m.RecordID {
+		done()
+		return fmt.Errorf("%s: got %s, want the stored Employee with its RecordID", fpb.name, m)
+	}
+	if err := fpb.send(obj{"Ack": m.RecordID}); err != nil {
+		done()
+		return err
+	}
+	// let the ack through before reconnecting
+	time.Sleep(*quiet)
+	done()
+	cs, done, err = e.session("fpb")
+	if err != nil {
+		return err
+	}
+	if err := silent(cs[0]); err != nil {
+		done()
+		return fmt.Errorf("acknowledged message sent again: %v", err)
+	}
+	done()
+
+	// a reply for a client that left reaches no one
+	cs, done, err = e.session("ra", "ra2")
+	if err != nil {
+		return err
+	}
+	defer done()
+	ra, ra2 := cs[0], cs[1]
+	if err := ra.send(obj{"Type": "RA", "Payload": obj{"EnrollmentReq": obj{"EmployeeData": person("E-501"), "FPInfo": fpInfo("FPA")}}}); err != nil {
+		return err
+	}
+	req, err := e.ledgerGot("RA", "EnrollmentReq")
+	if err != nil {
+		return err
+	}
+	ra.close()
+	if err := e.settle(1); err != nil {
+		return err
+	}
+	if err := e.produce("employee.updates", obj{"CID": req.CID, "Status": "ENROLLED", "Payload": obj{}}); err != nil {
+		return err
+	}
+	if err := silent(ra2); err != nil {
+		return err
+	}
+
+	// the admin API disconnects a client
+	status, err := e.adminDo(http.MethodDelete, "/clients/"+req.CID, nil, nil)
+	if err != nil {
+		return err
+	}
+	if http.StatusNotFound != status {
+		return fmt.Errorf("disconnecting a gone client: status %d, want 404", status)
+	}
+	clients, err := e.clients()
+	if err != nil {
+		return err
+	}
+	status, err = e.adminDo(http.MethodDelete, "/clients/"+clients[0].CID, nil, nil)
+	if err != nil {
+		return err
+	}
+	if http.StatusNoContent != status {
+		return fmt.Errorf("disconnecting %s: status %d", ra2.name, status)
+	}
+	if err := ra2.gone(); err != nil {
+		return err
+	}
+	return e.settle(0)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// HTTP fallbacks for clients behind proxies that strip websocket upgrades.
+// Next to the websocket, every endpoint serves
+//
+//	GET  <endpoint>/events            server-sent events
+//	GET  <endpoint>/poll[?session=]   long-polling
+//	POST <endpoint>/send?session=     one client message
+//
+// Opening /events, or polling without a session, starts a session: the client
+// is registered with the hub like a websocket client of the endpoint (same
+// routing, limits, outbox and ack mode) and gets its CID and a session token.
+// Messages for it are the JSON envelopes a websocket client would get, sent as
+// SSE data events or returned in batches by /poll. Whatever the client sends
+// is POSTed to /send with the session token and handled like a websocket
+// frame; errors come back on the stream. A long-polling session ends when the
+// client hasn't polled for pollIdle, an SSE session when its stream closes.
+
+const (
+	// comment lines keep idle SSE streams open through proxies
+	sseKeepAlive = 30 * time.Second
+
+	// how long a poll waits for a first message, and then for more
+	pollWait   = 25 * time.Second
+	pollLinger = 20 * time.Millisecond
+
+	// a long-polling session ends when not polled this long
+	pollIdle = 60 * time.Second
+
+	maxPollBatch = 100
+	maxSendBody  = 1 << 20
+)
+
+var (
+	errPollIdle   = errors.New("long-poll session idle")
+	errPollBehind = errors.New("long-poll session fell behind")
+)
+
+type SessionInfo struct {
+	CID     string `json:"CID"`
+	Session string `json:"Session"`
+}
+
+type PollResponse struct {
+	SessionInfo
+	Messages []json.RawMessage `json:"Messages"`
+}
+
+// httpSession is what both fallbacks share: the session token and its end.
+type httpSession struct {
+	token  string
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newHTTPSession() httpSession {
+	return httpSession{token: uuid.NewV4().String(), closed: make(chan struct{})}
+}
+
+// close ends the session. The HTTP fallbacks have no way of telling the
+// client why.
+func (s *httpSession) close(string) {
+	s.once.Do(func() { close(s.closed) })
+}
+
+type sseTransport struct {
+	httpSession
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (t *sseTransport) name() string { return "sse" }
+
+func (t *sseTransport) send(s string) error {
+	select {
+	case <-t.closed:
+		return errSessionClosed
+	default:
+	}
+	t.rc.SetWriteDeadline(time.Now().Add(writeWait))
+	if _, err := io.WriteString(t.w, s); err != nil {
+		return err
+	}
+	return t.rc.Flush()
+}
+
+func (t *sseTransport) write(frame []byte) error {
+	return t.send("data: " + string(frame) + "\n\n")
+}
+
+func (t *sseTransport) keepalive() time.Duration { return sseKeepAlive }
+
+func (t *sseTransport) ping() error { return t.send(": keepalive\n\n") }
+
+// pollTransport queues frames for the next poll. The queue holds as many
+// frames as a client's send buffer; a client that falls further behind is
+// disconnected, like one whose send buffer fills, rather than stalling its
+// writer.
+type pollTransport struct {
+	httpSession
+	frames chan []byte
+	// mu guards polling and last, the end of the latest poll
+	mu      sync.Mutex
+	polling bool
+	last    time.Time
+}
+
+func (t *pollTransport) name() string { return "longpoll" }
+
+func (t *pollTransport) write(frame []byte) error {
+	select {
+	case <-t.closed:
+		return errSessionClosed
+	default:
+	}
+	select {
+	case t.frames <- frame:
+		return nil
+	default:
+		return errPollBehind
+	}
+}
+
+func (t *pollTransport) keepalive() time.Duration { return pollIdle / 2 }
+
+func (t *pollTransport) ping() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.polling && time.Since(t.last) > pollIdle {
+		return errPollIdle
+	}
+	return nil
+}
+
+// begin marks a poll in progress, refusing concurrent polls.
+func (t *pollTransport) begin() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.polling {
+		return false
+	}
+	t.polling = true
+	return true
+}
+
+func (t *pollTransport) end() {
+	t.mu.Lock()
+	t.polling = false
+	t.last = time.Now()
+	t.mu.Unlock()
+}
+
+// collect waits up to pollWait for a frame and returns it with any that
+// follow shortly after.
+func (t *pollTransport) collect(r *http.Request) []json.RawMessage {
+	msgs := make([]json.RawMessage, 0)
+	wait := time.NewTimer(pollWait)
+	defer wait.Stop()
+	select {
+	case f := <-t.frames:
+		msgs = append(msgs, f)
+	case <-wait.C:
+		return msgs
+	case <-t.closed:
+		return msgs
+	case <-r.Context().Done():
+		return msgs
+	}
+	for len(msgs) < maxPollBatch {
+		linger := time.NewTimer(pollLinger)
+		select {
+		case f := <-t.frames:
+			linger.Stop()
+			msgs = append(msgs, f)
+		case <-linger.C:
+			return msgs
+		}
+	}
+	return msgs
+}
+
+// sessionTable maps session tokens to their clients.
+type sessionTable struct {
+	mu sync.Mutex
+	m  map[string]*Client
+}
+
+var sessions = &sessionTable{m: make(map[string]*Client)}
+
+func (s *sessionTable) add(token string, c *Client) {
+	s.mu.Lock()
+	s.m[token] = c
+	s.mu.Unlock()
+}
+
+func (s *sessionTable) remove(token string) {
+	s.mu.Lock()
+	delete(s.m, token)
+	s.mu.Unlock()
+}
+
+// get returns the client of a session opened on route, or nil.
+func (s *sessionTable) get(token string, route string) *Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.m[token]
+	if nil == c || c.route != route {
+		return nil
+	}
+	return c
+}
+
+// startSession admits and registers a fallback client. The client is
+// unregistered once the session ends.
+func startSession(hub *Hub, w http.ResponseWriter, r *http.Request, route string, ctype string,
+	t transport, s *httpSession) *Client {
+	if refuseUnready(hub, w) {
+		return nil
+	}
+	user, refused := refuseUnauthenticated(w, r)
+	if refused {
+		return nil
+	}
+	release, refused := refuseOverLimit(w, r, route, user)
+	if refused {
+		return nil
+	}
+	c := newClient(hub, t, codecs[defaultCodec], r, route, ctype)
+	c.user = user
+	c.release = release
+	sessions.add(s.token, c)
+	hub.register <- c
+	go func() {
+		<-s.closed
+		sessions.remove(s.token)
+		hub.unregister <- c
+	}()
+	wsLog.Info("session started", "cid", c.cid, "transport", t.name(), "remote", r.RemoteAddr)
+	return c
+}
+
+// serveEvents streams a new session's messages as server-sent events. The
+// first event, named "session", carries its SessionInfo.
+func serveEvents(hub *Hub, w http.ResponseWriter, r *http.Request, route string, ctype string) {
+	if http.MethodGet != r.Method {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t := &sseTransport{httpSession: newHTTPSession(), w: w, rc: http.NewResponseController(w)}
+	c := startSession(hub, w, r, route, ctype, t, &t.httpSession)
+	if nil == c {
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	info, _ := json.Marshal(SessionInfo{CID: c.cid, Session: t.token})
+	if err := t.send(fmt.Sprintf("event: session\ndata: %s\n\n", info)); err != nil {
+		t.close("")
+		return
+	}
+	go func() {
+		select {
+		case <-r.Context().Done():
+			t.close("")
+		case <-t.closed:
+		}
+	}()
+	// the handler must not return while the stream is still written to
+	writeClient(c)
+}
+
+// servePoll starts a long-polling session, or returns the session's next
+// messages.
+func servePoll(hub *Hub, w http.ResponseWriter, r *http.Request, route string, ctype string) {
+	if http.MethodGet != r.Method {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.URL.Query().Get("session")
+	if "" == token {
+		t := &pollTransport{httpSession: newHTTPSession(), frames: make(chan []byte, sendBufferSize), last: time.Now()}
+		c := startSession(hub, w, r, route, ctype, t, &t.httpSession)
+		if nil == c {
+			return
+		}
+		go writeClient(c)
+		writeAdminJSON(w, http.StatusOK, PollResponse{
+			SessionInfo: SessionInfo{CID: c.cid, Session: t.token},
+			Messages:    []json.RawMessage{},
+		})
+		return
+	}
+	c := sessions.get(token, route)
+	var t *pollTransport
+	if nil != c {
+		t, _ = c.t.(*pollTransport)
+	}
+	if nil == t {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	if !t.begin() {
+		http.Error(w, "already polling", http.StatusConflict)
+		return
+	}
+	defer t.end()
+	writeAdminJSON(w, http.StatusOK, PollResponse{
+		SessionInfo: SessionInfo{CID: c.cid, Session: t.token},
+		Messages:    t.collect(r),
+	})
+}
+
+// serveSend handles a message POSTed by a session's client.
+func serveSend(w http.ResponseWriter, r *http.Request, route string) {
+	if http.MethodPost != r.Method {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c := sessions.get(r.URL.Query().Get("session"), route)
+	if nil == c {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSendBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !c.receive(body) {
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleFallbacks registers the HTTP fallbacks of a websocket endpoint.
+func handleFallbacks(hub *Hub, route string, ctype string) {
+	http.HandleFunc(route+"/events", func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(hub, w, r, route, ctype)
+	})
+	http.HandleFunc(route+"/poll", func(w http.ResponseWriter, r *http.Request) {
+		servePoll(hub, w, r, route, ctype)
+	})
+	http.HandleFunc(route+"/send", func(w http.ResponseWriter, r *http.Request) {
+		serveSend(w, r, route)
+	})
+}
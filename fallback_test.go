@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readyHub is a hub that is ready, registers clients and publishes every
+// message successfully, passing them on.
+func readyHub(t *testing.T) (*Hub, <-chan *ClientMessage) {
+	h := newHub()
+	h.health.set(map[string]string{checkProducer: checkOK})
+	go clientRegistration(h)
+	return h, acceptPublishes(t, h)
+}
+
+// registered waits for the hub to register the client of cid.
+func registered(t *testing.T, h *Hub, cid string) *Client {
+	t.Helper()
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if c := h.client(cid); nil != c {
+			return c
+		}
+	}
+	t.Fatalf("client %s not registered", cid)
+	return nil
+}
+
+func TestEventsSession(t *testing.T) {
+	h, _ := readyHub(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := httptest.NewRequest(http.MethodGet, "/fpa/events", nil).WithContext(ctx)
+	body, pw := io.Pipe()
+	w := &pipeResponse{header: make(http.Header), PipeWriter: pw}
+	done := make(chan struct{})
+	go func() {
+		serveEvents(h, w, r, "/fpa", "FPA")
+		pw.Close()
+		close(done)
+	}()
+
+	events := bufio.NewReader(body)
+	event := func() (string, string) {
+		var name, data string
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case "" == line:
+				return name, data
+			case strings.HasPrefix(line, "event: "):
+				name = line[len("event: "):]
+			case strings.HasPrefix(line, "data: "):
+				data = line[len("data: "):]
+			}
+		}
+	}
+	name, data := event()
+	info := SessionInfo{}
+	if err := json.Unmarshal([]byte(data), &info); err != nil || "session" != name || "" == info.Session {
+		t.Fatalf("first event %s %s, want the session", name, data)
+	}
+	if ct := w.header.Get("Content-Type"); "text/event-stream" != ct {
+		t.Errorf("Content-Type %q", ct)
+	}
+	c := registered(t, h, info.CID)
+	if "sse" != c.t.name() || "FPA" != c.Type {
+		t.Errorf("registered a %s client over %s", c.Type, c.t.name())
+	}
+
+	h.deliver(c, &ClientMessage{CID: info.CID, Status: "ENROLLED"})
+	name, data = event()
+	msg := &ClientMessage{}
+	if err := json.Unmarshal([]byte(data), msg); err != nil || "" != name || "ENROLLED" != msg.Status {
+		t.Errorf("event %q %s, want the message", name, data)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("stream still served after the request ended")
+	}
+	for deadline := time.Now().Add(3 * time.Second); nil != h.client(info.CID); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("client still registered after the stream closed")
+		}
+	}
+}
+
+func poll(h *Hub, route string, session string, ctx context.Context) (*httptest.ResponseRecorder, *PollResponse) {
+	target := route + "/poll"
+	if "" != session {
+		target += "?session=" + session
+	}
+	r := httptest.NewRequest(http.MethodGet, target, nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	servePoll(h, w, r, route, strings.ToUpper(route[1:]))
+	resp := &PollResponse{}
+	json.Unmarshal(w.Body.Bytes(), resp)
+	return w, resp
+}
+
+func startPoll(t *testing.T, h *Hub) (*Client, *pollTransport) {
+	t.Helper()
+	w, resp := poll(h, "/fpa", "", context.Background())
+	if http.StatusOK != w.Code || "" == resp.Session || 0 != len(resp.Messages) {
+		t.Fatalf("starting a session: %d %s", w.Code, w.Body)
+	}
+	c := registered(t, h, resp.CID)
+	t.Cleanup(func() { c.t.close("") })
+	return c, c.t.(*pollTransport)
+}
+
+func TestPollBatches(t *testing.T) {
+	h, _ := readyHub(t)
+	c, pt := startPoll(t, h)
+	for i := 0; i < maxPollBatch+50; i++ {
+		h.deliver(c, &ClientMessage{CID: c.cid, Status: "ENROLLED"})
+	}
+	// the writer has queued them all for the next poll
+	for deadline := time.Now().Add(3 * time.Second); len(pt.frames) < maxPollBatch+50; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d frames queued", len(pt.frames))
+		}
+	}
+	for _, want := range []int{maxPollBatch, 50} {
+		w, resp := poll(h, "/fpa", pt.token, context.Background())
+		if http.StatusOK != w.Code || c.cid != resp.CID || want != len(resp.Messages) {
+			t.Fatalf("poll: %d with %d messages, want %d", w.Code, len(resp.Messages), want)
+		}
+	}
+}
+
+// A poller falling behind is disconnected rather than stalling its writer.
+func TestPollBehind(t *testing.T) {
+	h, _ := readyHub(t)
+	c, pt := startPoll(t, h)
+	for i := 0; i < sendBufferSize; i++ {
+		if err := pt.write([]byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pt.write([]byte("{}")); errPollBehind != err {
+		t.Errorf("write with the queue full: %v, want errPollBehind", err)
+	}
+	c.t.close("")
+	if err := pt.write([]byte("{}")); errSessionClosed != err {
+		t.Errorf("write after the session ended: %v, want errSessionClosed", err)
+	}
+}
+
+func TestPollConflict(t *testing.T) {
+	h, _ := readyHub(t)
+	_, pt := startPoll(t, h)
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan int)
+	go func() {
+		w, _ := poll(h, "/fpa", pt.token, ctx)
+		first <- w.Code
+	}()
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		pt.mu.Lock()
+		polling := pt.polling
+		pt.mu.Unlock()
+		if polling {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("first poll not started")
+		}
+	}
+	if w, _ := poll(h, "/fpa", pt.token, context.Background()); http.StatusConflict != w.Code {
+		t.Errorf("concurrent poll: %d, want 409", w.Code)
+	}
+	cancel()
+	if code := <-first; http.StatusOK != code {
+		t.Errorf("first poll: %d, want 200", code)
+	}
+}
+
+func TestUnknownSession(t *testing.T) {
+	h, _ := readyHub(t)
+	_, pt := startPoll(t, h)
+	for _, tc := range []struct {
+		name    string
+		route   string
+		session string
+	}{
+		{"unknown token", "/fpa", "nope"},
+		{"session of another endpoint", "/ra", pt.token},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if w, _ := poll(h, tc.route, tc.session, context.Background()); http.StatusNotFound != w.Code {
+				t.Errorf("poll: %d, want 404", w.Code)
+			}
+			r := httptest.NewRequest(http.MethodPost, tc.route+"/send?session="+tc.session, strings.NewReader("{}"))
+			w := httptest.NewRecorder()
+			serveSend(w, r, tc.route)
+			if http.StatusNotFound != w.Code {
+				t.Errorf("send: %d, want 404", w.Code)
+			}
+		})
+	}
+}
+
+func TestSendRateLimit(t *testing.T) {
+	limiter = &rateLimiter{
+		c:       RateLimitConfig{Endpoints: map[string]Limit{"/fpa": {Rate: 0.001, Burst: 1}}, AbuseStrikes: 1},
+		window:  time.Minute,
+		buckets: make(map[string]*bucket),
+	}
+	t.Cleanup(func() { limiter = nil })
+	withDedup(t)
+	h, published := readyHub(t)
+	_, pt := startPoll(t, h)
+
+	for _, want := range []int{http.StatusAccepted, http.StatusTooManyRequests} {
+		r := httptest.NewRequest(http.MethodPost, "/fpa/send?session="+pt.token, strings.NewReader(changeFP))
+		w := httptest.NewRecorder()
+		serveSend(w, r, "/fpa")
+		if want != w.Code {
+			t.Errorf("send: %d, want %d", w.Code, want)
+		}
+	}
+	for deadline := time.After(3 * time.Second); ; {
+		select {
+		case m := <-published:
+			if nil != m.Payload {
+				return
+			}
+		case <-deadline:
+			t.Fatal("the message within the limit was not published")
+		}
+	}
+}
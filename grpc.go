@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Services that prefer gRPC to websocket JSON call
+//
+//	service Gateway { rpc Connect(stream ClientMessage) returns (stream ClientMessage); }
+//
+// from wsapigw.proto on grpc.addr. Each stream is registered with the hub as a
+// client, of the type named by the wsapigw-client-type metadata (one of
+// grpc.types, the first by default), so it gets the same routing and fan-out
+// as websocket clients. Messages are the protobuf encoding of ClientMessage in
+// gRPC's length-prefixed framing, served over HTTP/2 without TLS by net/http;
+// compressed messages are not supported. Errors come back as ClientMessage
+// error frames, as on websockets. A client may close its side and keep
+// receiving; the stream ends with a grpc-status trailer.
+
+const grpcRoute = "/wsapigw.Gateway/Connect"
+
+// gRPC status codes used by the gateway
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcResourceExhausted = 8
+	grpcAborted           = 10
+	grpcUnimplemented     = 12
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+type GRPCConfig struct {
+	Addr  string   `json:"addr,omitempty"`
+	Token string   `json:"token,omitempty"`
+	Types []string `json:"types,omitempty"` // client types streams may register as
+}
+
+var defaultGRPCTypes = []string{"SVC"}
+
+var errGRPCCompressed = errors.New("compressed grpc messages are not supported")
+
+type grpcTransport struct {
+	w    http.ResponseWriter
+	rc   *http.ResponseController
+	once sync.Once
+	// closed is closed, and status and reason set, when the stream ends
+	closed chan struct{}
+	status int
+	reason string
+}
+
+func (t *grpcTransport) name() string { return "grpc" }
+
+func (t *grpcTransport) write(frame []byte) error {
+	select {
+	case <-t.closed:
+		return errSessionClosed
+	default:
+	}
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(frame)))
+	t.rc.SetWriteDeadline(time.Now().Add(writeWait))
+	if _, err := t.w.Write(prefix[:]); err != nil {
+		return err
+	}
+	if _, err := t.w.Write(frame); err != nil {
+		return err
+	}
+	return t.rc.Flush()
+}
+
+// HTTP/2 keeps the connection alive itself.
+func (t *grpcTransport) keepalive() time.Duration { return 0 }
+
+func (t *grpcTransport) ping() error { return nil }
+
+func (t *grpcTransport) close(reason string) {
+	t.end(grpcAborted, reason)
+}
+
+// end ends the stream with a status, unless it already ended.
+func (t *grpcTransport) end(status int, reason string) {
+	t.once.Do(func() {
+		if "" == reason {
+			status = grpcOK
+		}
+		t.status, t.reason = status, reason
+		close(t.closed)
+	})
+}
+
+// readGRPC reads one length-prefixed message.
+func readGRPC(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if 0 != prefix[0] {
+		return nil, errGRPCCompressed
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > maxSendBody {
+		return nil, errors.New("grpc message of " + strconv.FormatUint(uint64(n), 10) + " bytes is too large")
+	}
+	msg := make([]byte, n)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+// grpcError answers a call with a trailers-only error response.
+func grpcError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(status))
+	w.Header().Set("Grpc-Message", msg)
+	w.WriteHeader(http.StatusOK)
+}
+
+func grpcType(c GRPCConfig, r *http.Request) (string, bool) {
+	types := c.Types
+	if 0 == len(types) {
+		types = defaultGRPCTypes
+	}
+	ctype := r.Header.Get("Wsapigw-Client-Type")
+	if "" == ctype {
+		return types[0], true
+	}
+	for _, t := range types {
+		if t == ctype {
+			return ctype, true
+		}
+	}
+	return "", false
+}
+
+// serveGRPC handles the Connect call: the request body carries the client's
+// messages, the response body the gateway's.
+func serveGRPC(hub *Hub, c GRPCConfig, w http.ResponseWriter, r *http.Request) {
+	if http.MethodPost != r.Method || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "grpc requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	if "" != c.Token {
+		h := r.Header.Get("Authorization")
+		got := strings.TrimPrefix(h, "Bearer ")
+		if got == h || 1 != subtle.ConstantTimeCompare([]byte(got), []byte(c.Token)) {
+			grpcError(w, grpcUnauthenticated, "unauthenticated")
+			return
+		}
+	}
+	ctype, ok := grpcType(c, r)
+	if !ok {
+		grpcError(w, grpcInvalidArgument, "client type not allowed")
+		return
+	}
+	if !hub.health.ready() {
+		grpcError(w, grpcUnavailable, "gateway not ready")
+		return
+	}
+	// the token is shared by every service, so streams are anonymous
+	release, reason := admitter.admit(grpcRoute, remoteIP(r), "")
+	if "" != reason {
+		rejectedUpgrades.inc(grpcRoute, reason)
+		grpcError(w, grpcResourceExhausted, "connection limit reached: "+reason)
+		return
+	}
+
+	t := &grpcTransport{w: w, rc: http.NewResponseController(w), closed: make(chan struct{})}
+	client := newClient(hub, t, codecs["protobuf"], r, grpcRoute, ctype)
+	if "1" == r.Header.Get("Wsapigw-Acks") {
+		client.acks = newClientAcks()
+	}
+	client.release = release
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	if err := t.rc.Flush(); err != nil {
+		release()
+		return
+	}
+	hub.register <- client
+	wsLog.Info("grpc stream started", "cid", client.cid, "type", ctype, "remote", r.RemoteAddr)
+
+	go func() {
+		for {
+			msg, err := readGRPC(r.Body)
+			switch {
+			case errGRPCCompressed == err:
+				t.end(grpcUnimplemented, err.Error())
+				return
+			case io.EOF == err:
+				// the client closed its side; replies are still written
+				// until it cancels the call or the hub drops it
+				return
+			case err != nil:
+				t.end(grpcAborted, err.Error())
+				return
+			}
+			if !client.receive(msg) {
+				return
+			}
+		}
+	}()
+	go func() {
+		select {
+		case <-t.closed:
+		case <-r.Context().Done():
+			t.end(grpcOK, "")
+		}
+		hub.unregister <- client
+	}()
+	// the handler must not return while the stream is still written to
+	writeClient(client)
+	<-t.closed
+	w.Header().Set("Grpc-Status", strconv.Itoa(t.status))
+	if "" != t.reason {
+		w.Header().Set("Grpc-Message", t.reason)
+	}
+}
+
+// serveGRPCListener runs the gRPC service on its own listener. It is disabled
+// unless an address is configured.
+func serveGRPCListener(hub *Hub, c GRPCConfig) {
+	if "" == c.Addr {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(grpcRoute, func(w http.ResponseWriter, r *http.Request) {
+		serveGRPC(hub, c, w, r)
+	})
+	// http.Protocols needs Go 1.24
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{Addr: c.Addr, Handler: mux, Protocols: &protocols}
+	wsLog.Info("grpc service started", "addr", c.Addr)
+	if err := srv.ListenAndServe(); err != nil {
+		wsLog.Error("grpc ListenAndServe", "err", err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGRPCAuth(t *testing.T) {
+	h := newHub()
+	c := GRPCConfig{Token: "s3cret"}
+	for _, tc := range []struct {
+		header string
+		status int
+	}{
+		{"", grpcUnauthenticated},
+		{"s3cret", grpcUnauthenticated},
+		{"Basic s3cret", grpcUnauthenticated},
+		{"Bearer nope", grpcUnauthenticated},
+		// authenticated, then refused as the hub isn't connected yet
+		{"Bearer s3cret", grpcUnavailable},
+	} {
+		r := httptest.NewRequest("POST", grpcRoute, nil)
+		r.Header.Set("Content-Type", "application/grpc")
+		if "" != tc.header {
+			r.Header.Set("Authorization", tc.header)
+		}
+		w := httptest.NewRecorder()
+		serveGRPC(h, c, w, r)
+		if got := w.Header().Get("Grpc-Status"); strconv.Itoa(tc.status) != got {
+			t.Errorf("authorization %q: grpc-status %s, want %d", tc.header, got, tc.status)
+		}
+	}
+}
+
+func grpcFrame(flag byte, n uint32, body []byte) []byte {
+	prefix := []byte{flag, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(prefix[1:], n)
+	return append(prefix, body...)
+}
+
+func TestReadGRPC(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want []byte
+		err  error
+	}{
+		{"message", grpcFrame(0, 3, []byte("abc")), []byte("abc"), nil},
+		{"empty message", grpcFrame(0, 0, nil), []byte{}, nil},
+		{"end of stream", nil, nil, io.EOF},
+		{"compressed", grpcFrame(1, 3, []byte("abc")), nil, errGRPCCompressed},
+		{"truncated prefix", []byte{0, 0}, nil, io.ErrUnexpectedEOF},
+		{"truncated message", grpcFrame(0, 3, []byte("ab")), nil, io.ErrUnexpectedEOF},
+		{"largest message", grpcFrame(0, maxSendBody, make([]byte, maxSendBody)), make([]byte, maxSendBody), nil},
+		{"too large", grpcFrame(0, maxSendBody+1, nil), nil, errors.New("too large")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readGRPC(bytes.NewReader(tc.data))
+			switch {
+			case nil == tc.err:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case io.EOF == tc.err || io.ErrUnexpectedEOF == tc.err || errGRPCCompressed == tc.err:
+				if tc.err != err {
+					t.Fatalf("error %v, want %v", err, tc.err)
+				}
+				return
+			default:
+				if nil == err || !strings.Contains(err.Error(), tc.err.Error()) {
+					t.Fatalf("error %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("got %d bytes, want %d", len(got), len(tc.want))
+			}
+		})
+	}
+}
+
+// Messages written to a stream read back as they were, one per frame.
+func TestGRPCFraming(t *testing.T) {
+	w := httptest.NewRecorder()
+	tr := &grpcTransport{w: w, rc: http.NewResponseController(w), closed: make(chan struct{})}
+	var sent []*ClientMessage
+	for _, msg := range testMessages() {
+		b, err := protobufCodec{}.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tr.write(b); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, msg)
+	}
+	for _, want := range sent {
+		b, err := readGRPC(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := &ClientMessage{}
+		if err := (protobufCodec{}).Unmarshal(b, got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+	if _, err := readGRPC(w.Body); io.EOF != err {
+		t.Errorf("after the last frame: %v, want io.EOF", err)
+	}
+	tr.end(grpcAborted, "test")
+	if err := tr.write([]byte("x")); errSessionClosed != err {
+		t.Errorf("write after the stream ended: %v, want errSessionClosed", err)
+	}
+}
+
+// pipeResponse is a streaming ResponseWriter whose body is read from a pipe.
+type pipeResponse struct {
+	header http.Header
+	*io.PipeWriter
+}
+
+func (p *pipeResponse) Header() http.Header { return p.header }
+func (p *pipeResponse) WriteHeader(int)     {}
+func (p *pipeResponse) Flush()              {}
+
+// A client that closes its side after sending still gets its reply.
+func TestGRPCHalfClose(t *testing.T) {
+	h, published := readyHub(t)
+
+	reqBody, send := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := httptest.NewRequest(http.MethodPost, grpcRoute, reqBody).WithContext(ctx)
+	r.Header.Set("Content-Type", "application/grpc")
+	respBody, pw := io.Pipe()
+	w := &pipeResponse{header: make(http.Header), PipeWriter: pw}
+	done := make(chan struct{})
+	go func() {
+		serveGRPC(h, GRPCConfig{}, w, r)
+		pw.Close()
+		close(done)
+	}()
+
+	msg := &ClientMessage{}
+	if err := json.Unmarshal([]byte(changeFP), msg); err != nil {
+		t.Fatal(err)
+	}
+	b, err := protobufCodec{}.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := send.Write(grpcFrame(0, uint32(len(b)), b)); err != nil {
+		t.Fatal(err)
+	}
+	send.Close()
+
+	var cid string
+	for "" == cid {
+		select {
+		case m := <-published:
+			if nil != m.Payload {
+				cid = m.CID
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("message not published")
+		}
+	}
+	c := h.client(cid)
+	if nil == c {
+		t.Fatal("stream unregistered after the client closed its side")
+	}
+	h.deliver(c, &ClientMessage{CID: cid, Status: "ENROLLED"})
+	b, err = readGRPC(respBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := &ClientMessage{}
+	if err := (protobufCodec{}).Unmarshal(b, reply); err != nil || "ENROLLED" != reply.Status {
+		t.Fatalf("reply %+v, %v", reply, err)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("stream still served after the call was canceled")
+	}
+	if s := w.header.Get("Grpc-Status"); "0" != s {
+		t.Errorf("grpc-status %s, want 0", s)
+	}
+}
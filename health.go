@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// How often readiness is re-evaluated in the background.
+	healthInterval = 5 * time.Second
+
+	// A consumer error younger than this keeps the gateway unready.
+	consumerErrorWindow = 30 * time.Second
+
+	// A run of failed publishes whose latest is younger than this keeps the
+	// gateway unready.
+	producerErrorWindow = 30 * time.Second
+
+	// Consecutive failed publishes that make the gateway unready. A single
+	// failure is often a transient broker hiccup the producer retries past.
+	unreadyPublishFailures = 3
+)
+
+// names of the individual readiness checks
+const (
+	checkProducer   = "producer"
+	checkConsumer   = "consumer"
+	checkPartitions = "partitions"
+	checkBrokers    = "brokers"
+)
+
+const checkOK = "ok"
+
+type HealthStatus struct {
+	Ready     bool              `json:"Ready"`
+	Checks    map[string]string `json:"Checks"`
+	CheckedAt time.Time         `json:"CheckedAt"`
+}
+
+// Health tracks the state of the Kafka side of the gateway. Readiness is
+// evaluated periodically by watchHealth, and whenever the broker connection is
+// replaced, so that probes and websocket upgrades only read the cached result.
+type Health struct {
+	mu          sync.RWMutex
+	status      HealthStatus
+	producerErr error
+	producerAt  time.Time
+	pubFailures int // failed publishes since the last successful one
+	consumerErr error
+	consumerAt  time.Time
+}
+
+func newHealth() *Health {
+	return &Health{
+		status: HealthStatus{
+			Checks: map[string]string{checkProducer: checkReconnecting},
+		},
+	}
+}
+
+// producerResult records the outcome of the latest publish. Errors that
+// concern only the record, like one too large, say nothing about the
+// producer and are ignored.
+func (hl *Health) producerResult(err error) {
+	if nil != err && recordError(err) {
+		return
+	}
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	if nil == err {
+		hl.pubFailures = 0
+		return
+	}
+	hl.pubFailures++
+	hl.producerErr = err
+	hl.producerAt = time.Now()
+}
+
+// consumerError records an error reported by the consumer group.
+func (hl *Health) consumerError(err error) {
+	hl.mu.Lock()
+	hl.consumerErr = err
+	hl.consumerAt = time.Now()
+	hl.mu.Unlock()
+}
+
+func (hl *Health) ready() bool {
+	hl.mu.RLock()
+	defer hl.mu.RUnlock()
+	return hl.status.Ready
+}
+
+func (hl *Health) snapshot() HealthStatus {
+	hl.mu.RLock()
+	defer hl.mu.RUnlock()
+	checks := make(map[string]string, len(hl.status.Checks))
+	for k, v := range hl.status.Checks {
+		checks[k] = v
+	}
+	return HealthStatus{Ready: hl.status.Ready, Checks: checks, CheckedAt: hl.status.CheckedAt}
+}
+
+func (hl *Health) set(checks map[string]string) {
+	ready := true
+	for _, v := range checks {
+		if checkOK != v {
+			ready = false
+		}
+	}
+	hl.mu.Lock()
+	if ready != hl.status.Ready {
+		healthLog.Info("readiness changed", "ready", ready, "checks", checks)
+	}
+	hl.status = HealthStatus{Ready: ready, Checks: checks, CheckedAt: time.Now()}
+	hl.mu.Unlock()
+}
+
+const checkReconnecting = "reconnecting"
+
+// Consecutive failed broker checks after which the connection is recreated.
+const fatalBrokerChecks = 3
+
+func (h *Hub) checkProducer() string {
+	h.health.mu.RLock()
+	defer h.health.mu.RUnlock()
+	if h.health.pubFailures >= unreadyPublishFailures && time.Since(h.health.producerAt) < producerErrorWindow {
+		return fmt.Sprintf("%d publishes failed in a row: %v", h.health.pubFailures, h.health.producerErr)
+	}
+	return checkOK
+}
+
+func (h *Hub) checkConsumer(k *brokerConn) string {
+	if k.sub.Closed() {
+		return "closed"
+	}
+	h.health.mu.RLock()
+	defer h.health.mu.RUnlock()
+	if nil != h.health.consumerErr && time.Since(h.health.consumerAt) < consumerErrorWindow {
+		return "recent error: " + h.health.consumerErr.Error()
+	}
+	return checkOK
+}
+
+// checkHealth evaluates readiness against the current broker connection and
+// returns the broker check so watchHealth can spot a dead connection.
+func (h *Hub) checkHealth() (*brokerConn, string) {
+	k := h.conn()
+	if nil == k {
+		h.health.set(map[string]string{
+			checkProducer:   checkReconnecting,
+			checkConsumer:   checkReconnecting,
+			checkPartitions: checkReconnecting,
+			checkBrokers:    checkReconnecting,
+		})
+		return nil, checkReconnecting
+	}
+	brokers := k.cluster.checkBrokers()
+	h.health.set(map[string]string{
+		checkProducer:   h.checkProducer(),
+		checkConsumer:   h.checkConsumer(k),
+		checkPartitions: k.cluster.checkPartitions(h.cgroup, h.ctopics),
+		checkBrokers:    brokers,
+	})
+	return k, brokers
+}
+
+// watchHealth re-evaluates readiness until the process exits. A connection
+// whose brokers stay unreachable for fatalBrokerChecks rounds is failed so
+// maintainBroker recreates it.
+func watchHealth(h *Hub) {
+	var last *brokerConn
+	failures := 0
+	for {
+		k, brokers := h.checkHealth()
+		if k != last {
+			last = k
+			failures = 0
+		}
+		if nil != k && checkOK != brokers {
+			failures++
+			if failures >= fatalBrokerChecks {
+				k.fail(fmt.Errorf("brokers %s", brokers))
+			}
+		} else {
+			failures = 0
+		}
+		time.Sleep(healthInterval)
+	}
+}
+
+// serveHealthz reports liveness: the process is up and serving HTTP.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{\"Status\":\"ok\"}\n"))
+}
+
+// serveReadyz reports whether the gateway can currently move messages
+// between websocket clients and Kafka.
+func serveReadyz(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	status := hub.health.snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		healthLog.Warn("error writing readiness", "err", err)
+	}
+}
+
+// refuseUnready answers a websocket upgrade with 503 while the gateway is not
+// ready, and reports whether it did so.
+func refuseUnready(hub *Hub, w http.ResponseWriter) bool {
+	if hub.health.ready() {
+		return false
+	}
+	w.Header().Set("Retry-After", "5")
+	http.Error(w, "gateway not ready", http.StatusServiceUnavailable)
+	return true
+}
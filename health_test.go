@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestCheckProducer(t *testing.T) {
+	failed := errors.New("request timed out")
+	for _, tc := range []struct {
+		name    string
+		results []error
+		ago     time.Duration // since the last result
+		ready   bool
+	}{
+		{"no publishes", nil, 0, true},
+		{"one failure", []error{failed}, 0, true},
+		{"failures in a row", []error{nil, failed, failed, failed}, 0, false},
+		{"failures then a success", []error{failed, failed, failed, nil}, 0, true},
+		{"failures between successes", []error{failed, failed, nil, failed, failed}, 0, true},
+		{"failures long ago", []error{failed, failed, failed}, producerErrorWindow, true},
+		{"record errors", []error{sarama.ErrMessageSizeTooLarge, sarama.ErrInvalidTopic, sarama.ErrMessageSizeTooLarge}, 0, true},
+		{"record errors don't break a run", []error{failed, failed, sarama.ErrMessageSizeTooLarge, failed}, 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newHub()
+			for _, err := range tc.results {
+				h.health.producerResult(err)
+			}
+			h.health.producerAt = h.health.producerAt.Add(-tc.ago)
+			got := h.checkProducer()
+			if tc.ready != (checkOK == got) {
+				t.Errorf("producer check %q, want ready: %v", got, tc.ready)
+			}
+			if !tc.ready && !strings.Contains(got, failed.Error()) {
+				t.Errorf("producer check %q doesn't name the error", got)
+			}
+		})
+	}
+}
@@ -1,23 +1,51 @@
 package main
 
 import (
-	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// status frames sent to clients when the broker connection drops and returns
+const (
+	statusUnavailable = "backend unavailable"
+	statusRestored    = "backend restored"
+)
 
-	"github.com/Shopify/sarama"
-	uuid "github.com/satori/go.uuid"
-	"github.com/wvanbergen/kafka/consumergroup"
+var errBrokerUnavailable = errors.New("broker unavailable")
+
+// topics client messages are published to: requests, and connection events
+// for messages without a payload
+const (
+	requestTopic   = "ledgertx.req"
+	connectedTopic = "clients.connected"
 )
 
 type Hub struct {
+	// mu guards clients and the mutable fields of registered clients
+	mu         sync.RWMutex
 	clients    map[string]*Client
 	register   chan *Client
 	unregister chan *Client
 	pmsg       chan *ClientMessage
 	cmsg       chan *ConsumerMessage
-	producer   sarama.SyncProducer
 	ctopics    []string
-	consumers  *consumergroup.ConsumerGroup
+	dltopic    string
+	cgroup     string
+	system     string // messaging.system of the hub's spans
+	// commit consumed offsets only once delivered, see commit.go
+	afterDelivery bool
+	health        *Health
+	// bmu guards broker, which is nil while the gateway is reconnecting.
+	// Publishes hold the read lock so a connection is never closed under them.
+	bmu      sync.RWMutex
+	broker   *brokerConn
+	degraded bool
+	// omu guards offsets, the last consumed offset per topic and partition,
+	// and lag, computed from them by watchLag
+	omu     sync.Mutex
+	offsets map[string]map[int32]int64
+	lag     []partitionLag
 }
 
 func newHub() *Hub {
@@ -28,6 +56,9 @@ func newHub() *Hub {
 		pmsg:       make(chan *ClientMessage),
 		cmsg:       make(chan *ConsumerMessage),
 		ctopics:    make([]string, 0),
+		offsets:    make(map[string]map[int32]int64),
+		health:     newHealth(),
+		system:     brokerKafka,
 	}
 }
 
@@ -35,137 +66,315 @@ func clientRegistration(h *Hub) {
 	for {
 		select {
 		case client := <-h.register:
-			var err error
-			cid := uuid.Must(uuid.NewV4(), err)
-			if err != nil {
-				log.Printf("error generating uuid: %s", err)
-				return
-			}
-			h.clients[cid.String()] = client
-			client.cid = cid.String()
-			log.Print("...connected client ", cid)
+			h.mu.Lock()
+			h.clients[client.cid] = client
+			h.mu.Unlock()
+			hubLog.Info("client connected", "cid", client.cid, "type", client.Type, "remote", client.addr)
 			cmsg := &ClientMessage{}
 			cmsg.CID = client.cid
 			cmsg.OrgCode = client.Type
-			log.Printf("cmsg %+v\n", cmsg)
+			cmsg.route = client.route
 			h.pmsg <- cmsg
+			for _, r := range h.recipients(client) {
+				h.sendPending(client, r)
+			}
 		case client := <-h.unregister:
+			h.mu.Lock()
 			if nil != h.clients[client.cid] {
-				log.Print("...disconnected client ", client.cid)
-				prestr := "...removing client from hub..."
 				delete(h.clients, client.cid)
-				if nil != h.clients[client.cid] {
-					log.Printf(prestr+"error: cannot remove client %s from hub!", client.cid)
-				} else {
-					log.Printf(prestr+"client %s removed!", client.cid)
+				close(client.done)
+				if nil != client.release {
+					client.release()
 				}
+				gone.add(client.cid, client.user)
+				hubLog.Info("client disconnected", "cid", client.cid, "type", client.Type)
 			}
+			h.mu.Unlock()
+			client.drain()
 		}
 	}
 }
 
-func (h *Hub) run() {
-	c := initConfig()
+// client returns the registered client with the given cid, or nil.
+func (h *Hub) client(cid string) *Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.clients[cid]
+}
+
+// user returns the user a client authenticated as, "" for an anonymous one.
+func (h *Hub) user(c *Client) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return c.user
+}
+
+// deliver queues msg on the client's send buffer without blocking the hub.
+// A client that stopped draining its buffer is disconnected.
+func (h *Hub) deliver(c *Client, msg *ClientMessage) {
+	msg.d.add()
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	if c.closed {
+		msg.d.fail(c)
+		return
+	}
+	select {
+	case c.send <- msg:
+	default:
+		hubLog.Warn("send buffer full, disconnecting client", "cid", c.cid)
+		droppedMessages.inc(dropBufferFull)
+		msg.d.fail(c)
+		c.t.close("")
+	}
+}
+
+// drain fails the messages still queued for an unregistered client, so
+// their records are dead-lettered rather than committed as delivered.
+func (c *Client) drain() {
+	c.smu.Lock()
+	c.closed = true
+	c.smu.Unlock()
+	for {
+		select {
+		case msg := <-c.send:
+			msg.d.fail(c)
+		default:
+			return
+		}
+	}
+}
+
+// deadLetter forwards a consumed record the hub could not deliver to the
+// dead letter topic, if one is configured, and reports whether it did.
+func (h *Hub) deadLetter(cmsg *ConsumerMessage, reason string, sc spanContext) bool {
+	if "" == h.dltopic {
+		droppedMessages.inc(reason)
+		return false
+	}
+	if err := h.publish([]byte(cmsg.Value), h.dltopic, sc); err != nil {
+		droppedMessages.inc(reason)
+		return false
+	}
+	deadLettered.inc(cmsg.Topic)
+	return true
+}
+
+// conn returns the current broker connection, or nil while reconnecting.
+func (h *Hub) conn() *brokerConn {
+	h.bmu.RLock()
+	defer h.bmu.RUnlock()
+	return h.broker
+}
+
+// setConn swaps in a new broker connection, or nil when the current one was
+// lost, and tells connected clients about the change.
+func (h *Hub) setConn(k *brokerConn) {
+	h.bmu.Lock()
+	h.broker = k
+	notify := ""
+	if nil == k {
+		h.degraded = true
+		notify = statusUnavailable
+	} else if h.degraded {
+		h.degraded = false
+		notify = statusRestored
+	}
+	h.bmu.Unlock()
+
+	h.health.producerResult(nil)
+	h.checkHealth()
+	if "" != notify {
+		h.broadcastStatus(notify)
+	}
+}
+
+func (h *Hub) sendStatus(c *Client, status string) {
+	h.deliver(c, &ClientMessage{CID: c.cid, Status: status})
+}
+
+func (h *Hub) broadcastStatus(status string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, c := range h.clients {
+		h.sendStatus(c, status)
+	}
+}
+
+// publish sends message to topic in a span that is a child of parent, and
+// feeds the outcome into the producer health check. Errors the producer can't
+// recover from fail the connection.
+func (h *Hub) publish(message []byte, topic string, parent spanContext) (err error) {
+	sp := startSpan("publish "+topic, spanKindProducer, parent)
+	sp.set("messaging.system", h.system)
+	sp.set("messaging.destination.name", topic)
+	defer func() {
+		sp.fail(err)
+		sp.finish()
+	}()
+
+	h.bmu.RLock()
+	defer h.bmu.RUnlock()
+	if nil == h.broker {
+		publishErrors.inc(topic)
+		return errBrokerUnavailable
+	}
+	err = publish(message, topic, h.broker.pub, sp.context().recordHeaders())
+	h.health.producerResult(err)
+	if err != nil && fatalProducerError(err) {
+		h.broker.fail(err)
+	}
+	return err
+}
+
+func (h *Hub) run(c *KafkaConfig) {
 	//create consumers
 	for _, element := range c.Topics.Consume {
 		h.ctopics = append(h.ctopics, element)
 	}
-	prod, err := initProducer(c.KafkaAddr)
-	if err != nil {
-		log.Printf("error initializing producer: %s", err)
-		return
-	}
-	h.producer = prod
-	cons, err := initConsumer(h.ctopics, c.ZookeeperAddr, c.Cgroup)
-	if err != nil {
-		log.Printf("error initializing consumer: %s", err)
-		return
+	h.dltopic = c.Topics.DeadLetter
+	h.cgroup = c.Cgroup
+	h.system = brokerSystem(c.Broker)
+	switch c.Consumer.Commit {
+	case "", commitOnReceive:
+	case commitAfterDelivery:
+		h.afterDelivery = true
+	default:
+		hubLog.Error("unknown consumer commit mode, committing on receive", "commit", c.Consumer.Commit)
 	}
-	h.consumers = cons
-
-	log.Print("end init")
 
 	go clientRegistration(h)
+	go maintainBroker(h, c)
+	go watchHealth(h)
+	go watchLag(h)
+
+	hubLog.Info("hub started", "consume", h.ctopics)
 
 	for {
 		select {
 		case msg := <-h.pmsg:
-			log.Printf("msg from client %+v\n", msg)
-			if nil != msg.Payload {
-				if nil != msg.Payload.EnrollmentApproval {
-					log.Printf("EnrollmentApproval: %+v\n", msg.Payload.EnrollmentApproval)
-				}
-			}
-			var topic string
-			if nil != msg.Payload {
-				topic = "ledgertx.req"
-			} else {
-				topic = "clients.connected"
-			}
-			message, err := json.Marshal(msg)
-			if err != nil {
-				break
-			}
-			publish(message, topic, h.producer)
+			h.publishClient(msg)
 		case cmsg := <-h.cmsg:
-			msg := &ClientMessage{}
-			_ = json.Unmarshal([]byte(cmsg.Value), msg)
-			log.Printf("msg %+v\n", msg)
-			log.Printf("payload %+v\n", *msg.Payload)
-			log.Printf("cid %s\n", msg.CID)
-			client := h.clients[msg.CID]
-			if nil != client {
-				log.Printf("client %+v\n", client)
-				log.Printf("type: %s\n", msg.Type)
-				if nil != msg.Payload.EnrollmentApproval {
-					log.Printf("EnrollmentApproval: %+v\n", msg.Payload.EnrollmentApproval)
-				}
-				err := client.conn.WriteJSON(*msg)
-				if err != nil {
-					log.Printf("error: %v", err)
-					client.conn.Close()
-					h.unregister <- client
-					//delete(h.clients, msg.CID)
-				}
-			} else {
-				for _, client := range h.clients {
-					if nil != msg.Payload.Employee {
-						log.Printf("fpcode %s\n", msg.Payload.Employee.FPInfo.FPCode)
-						if client.Type == msg.Payload.Employee.FPInfo.FPCode {
-							err := client.conn.WriteJSON(*msg)
-							if err != nil {
-								log.Printf("error: %v", err)
-								client.conn.Close()
-								//delete(h.clients, msg.CID)
-								h.unregister <- client
-							}
-						}
-					}
-
-					if nil != msg.Payload.Block {
-						err := client.conn.WriteJSON(*msg)
-						if err != nil {
-							log.Printf("error: %v", err)
-							client.conn.Close()
-							//delete(h.clients, msg.CID)
-							h.unregister <- client
-						}
-					}
-
-					if "" != msg.Type {
-						if client.Type == msg.Type {
-							err := client.conn.WriteJSON(*msg)
-							if err != nil {
-								log.Printf("error: %v", err)
-								client.conn.Close()
-								//delete(h.clients, msg.CID)
-								h.unregister <- client
-							}
-						}
-					}
+			h.dispatch(cmsg)
+		}
+	}
+}
 
-				}
+// publishClient publishes a client message to its topic. A message that
+// isn't published has its idempotency key forgotten, so a retry goes through.
+func (h *Hub) publishClient(msg *ClientMessage) {
+	topic := connectedTopic
+	if nil != msg.Payload {
+		topic = requestTopic
+	}
+	hubLog.Debug("message from client", "cid", msg.CID, "topic", topic, "body", msg)
+	message, err := topicCodec(topic).Marshal(msg)
+	switch {
+	case errSchemaPending == err:
+		// the client retries, as when the broker is down
+		hubLog.Warn("schema not registered yet, message not published", "cid", msg.CID, "topic", topic)
+		publishErrors.inc(topic)
+	case err != nil:
+		hubLog.Error("error encoding client message", "cid", msg.CID, "err", err)
+		droppedMessages.inc(dropMarshal)
+		dedup.forget(msg.dkey)
+		msg.published(err)
+		return
+	default:
+		err = h.publish(message, topic, msg.sc)
+	}
+	msg.published(err)
+	if nil == err {
+		inboundMessages.inc(msg.route, topic)
+		return
+	}
+	dedup.forget(msg.dkey)
+	if (errBrokerUnavailable == err || errSchemaPending == err) && nil != msg.Payload {
+		if client := h.client(msg.CID); nil != client {
+			h.sendStatus(client, statusUnavailable)
+		}
+	}
+}
+
+// published reports the outcome of publishing msg to whoever waits for it.
+func (msg *ClientMessage) published(err error) {
+	if nil != msg.result {
+		msg.result <- err
+	}
+}
+
+// dispatch routes a consumed record to the client it is addressed to by CID,
+// or else fans it out by FP code, block event or client type.
+func (h *Hub) dispatch(cmsg *ConsumerMessage) {
+	sp := startSpan("dispatch "+cmsg.Topic, spanKindConsumer, parseTraceparent(cmsg.TraceParent))
+	sp.set("messaging.system", h.system)
+	sp.set("messaging.source.name", cmsg.Topic)
+	defer sp.finish()
+	// released once the record is routed, see delivery
+	defer cmsg.delivery.finish()
+
+	msg := &ClientMessage{}
+	err := topicCodec(cmsg.Topic).Unmarshal([]byte(cmsg.Value), msg)
+	if err != nil {
+		hubLog.Warn("error decoding consumed message", "topic", cmsg.Topic, "err", err)
+		sp.fail(errors.New("undecodable message"))
+		h.deadLetter(cmsg, dropDecode, sp.context())
+		return
+	}
+	msg.RecordID = fmt.Sprintf("%s/%d/%d", cmsg.Topic, cmsg.Partition, cmsg.Offset)
+	msg.topic = cmsg.Topic
+	msg.ts = cmsg.Timestamp
+	msg.d = cmsg.delivery
+	if nil != msg.d {
+		msg.d.out = msg
+	}
+	msg.sc = sp.context()
+	hubLog.Debug("message from kafka", "cid", msg.CID, "topic", cmsg.Topic, "body", msg)
+	// a reply to an ingestion request may carry only a Status or Error
+	if w := replies.take(msg.CorrelationID, msg.CID); nil != w {
+		sp.set("wsapigw.cid", msg.CID)
+		w <- msg
+		return
+	}
+	if nil == msg.Payload {
+		hubLog.Warn("consumed message has no payload", "topic", cmsg.Topic, "cid", msg.CID)
+		sp.fail(errors.New("message without payload"))
+		h.deadLetter(cmsg, dropDecode, sp.context())
+		return
+	}
+	client := h.client(msg.CID)
+	if nil != client {
+		sp.set("wsapigw.cid", msg.CID)
+		h.deliver(client, msg)
+		return
+	}
+
+	delivered := 0
+	h.mu.RLock()
+	for _, client := range h.clients {
+		if nil != msg.Payload.Employee {
+			if client.Type == msg.Payload.Employee.FPInfo.FPCode {
+				h.deliver(client, msg)
+				delivered++
 			}
 		}
+
+		if nil != msg.Payload.Block {
+			h.deliver(client, msg)
+			delivered++
+		}
+
+		if "" != msg.Type {
+			if client.Type == msg.Type {
+				h.deliver(client, msg)
+				delivered++
+			}
+		}
+
+	}
+	h.mu.RUnlock()
+	sp.set("wsapigw.delivered", delivered)
+	if 0 == delivered && !stash(msg, undeliveredRecipient(msg)) {
+		h.deadLetter(cmsg, dropNoClient, sp.context())
 	}
 }
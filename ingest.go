@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// The ingestion endpoint lets batch jobs and back-office tools submit messages
+// without holding a socket:
+//
+//	POST /messages[?wait=<seconds>]
+//	Authorization: Bearer <token>
+//
+// The body is a JSON ClientMessage. Each token stands for a client identity
+// (client type and optional username) and may be limited to some payload
+// variants. Messages go through the same rate limits, validation,
+// deduplication and topic routing as websocket frames, and the response tells
+// whether the message was published. With wait set the request also waits that
+// long for the reply addressed to the message's CID, which is unique per
+// request.
+//
+//	POST /requests[?timeout=<seconds>]
+//
+// is the request-reply variant: the message is published with a fresh
+// CorrelationID and ReplyTo set to ingest.reply_to, and the request blocks
+// until a record carrying that CorrelationID is consumed from any of the
+// gateway's topics, or the timeout (at most ingest.max_wait) passes. Replies
+// are matched by the gateway's own consumer; no consumer is started per
+// request.
+
+const (
+	ingestRoute          = "/messages"
+	requestRoute         = "/requests"
+	defaultIngestMaxWait = 30
+)
+
+// error codes only the ingestion endpoint answers with
+const (
+	errForbidden     = "forbidden"
+	errPublishFailed = "publish_failed"
+	errUnavailable   = "broker_unavailable"
+	errReplyTimeout  = "reply_timeout"
+)
+
+type IngestConfig struct {
+	Tokens map[string]IngestIdentity `json:"tokens,omitempty"`
+	// longest wait for a reply a request may ask for, in seconds
+	MaxWait int `json:"max_wait,omitempty"`
+	// topic request-reply callers' requests name as ReplyTo; it must be
+	// consumed by the gateway
+	ReplyTo string `json:"reply_to,omitempty"`
+}
+
+type IngestIdentity struct {
+	Type     string   `json:"type"` // client type messages are sent as
+	Username string   `json:"username,omitempty"`
+	Variants []string `json:"variants,omitempty"` // payload variants allowed; all when empty
+}
+
+type IngestResponse struct {
+	CID           string         `json:"CID"`
+	CorrelationID string         `json:"CorrelationID,omitempty"`
+	Status        string         `json:"Status"` // published, duplicate, rejected or failed
+	Error         *ErrorInfo     `json:"Error,omitempty"`
+	Reply         *ClientMessage `json:"Reply,omitempty"`
+}
+
+const (
+	ingestPublished = "published"
+	ingestRejected  = "rejected"
+	ingestFailed    = "failed"
+)
+
+type ingestIdentity struct {
+	IngestIdentity
+	token []byte
+	// names the token without revealing it, scoping its idempotency keys
+	name   string
+	limits *clientLimits
+}
+
+var (
+	ingestIdentities []*ingestIdentity
+	ingestMaxWait    = defaultIngestMaxWait * time.Second
+	// reply topic of /requests, "" when request-reply is disabled
+	replyTopic string
+)
+
+func initIngest(c IngestConfig, consume []string) {
+	for token, id := range c.Tokens {
+		if "" == token || "" == id.Type {
+			wsLog.Error("ignoring ingestion token without a client type")
+			continue
+		}
+		sum := sha256.Sum256([]byte(token))
+		i := &ingestIdentity{IngestIdentity: id, token: []byte(token), name: hex.EncodeToString(sum[:8])}
+		if nil != limiter {
+			i.limits = limiter.forClient(ingestRoute, id.Type)
+		}
+		ingestIdentities = append(ingestIdentities, i)
+	}
+	if 0 != c.MaxWait {
+		ingestMaxWait = time.Duration(c.MaxWait) * time.Second
+	}
+	if "" == c.ReplyTo {
+		return
+	}
+	for _, topic := range consume {
+		if topic == c.ReplyTo {
+			replyTopic = c.ReplyTo
+			return
+		}
+	}
+	wsLog.Error("ingest reply_to topic is not consumed, request-reply disabled", "topic", c.ReplyTo)
+}
+
+// ingestAuth returns the identity of the request's bearer token, or nil.
+func ingestAuth(r *http.Request) *ingestIdentity {
+	h := r.Header.Get("Authorization")
+	got := strings.TrimPrefix(h, "Bearer ")
+	if got == h {
+		return nil
+	}
+	var found *ingestIdentity
+	for _, id := range ingestIdentities {
+		if 1 == subtle.ConstantTimeCompare([]byte(got), id.token) {
+			found = id
+		}
+	}
+	return found
+}
+
+// allows reports whether the identity may send all variants set in p.
+func (id *ingestIdentity) allows(p *Payload) bool {
+	if 0 == len(id.Variants) || nil == p {
+		return true
+	}
+	for _, v := range p.variants() {
+		ok := false
+		for _, allowed := range id.Variants {
+			ok = ok || allowed == v
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// replyWaiters holds the ingestion requests waiting for a reply, by CID or
+// CorrelationID.
+type replyWaiters struct {
+	mu sync.Mutex
+	m  map[string]chan *ClientMessage
+}
+
+var replies = &replyWaiters{m: make(map[string]chan *ClientMessage)}
+
+func (r *replyWaiters) wait(key string) chan *ClientMessage {
+	ch := make(chan *ClientMessage, 1)
+	r.mu.Lock()
+	r.m[key] = ch
+	r.mu.Unlock()
+	return ch
+}
+
+// take returns and removes the waiter for the first of keys that has one,
+// or nil.
+func (r *replyWaiters) take(keys ...string) chan *ClientMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range keys {
+		if ch := r.m[key]; "" != key && nil != ch {
+			delete(r.m, key)
+			return ch
+		}
+	}
+	return nil
+}
+
+// serveIngest handles POST /messages.
+func serveIngest(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	ingest(hub, w, r, "wait", 0, false)
+}
+
+// serveRequest handles POST /requests.
+func serveRequest(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	ingest(hub, w, r, "timeout", ingestMaxWait, true)
+}
+
+// ingest publishes the message POSTed to the ingestion endpoints. The reply
+// wait is read from the param query parameter, defaulting to def. With
+// correlate the message is sent as a request and its reply matched by
+// CorrelationID rather than CID.
+func ingest(hub *Hub, w http.ResponseWriter, r *http.Request, param string, def time.Duration, correlate bool) {
+	if http.MethodPost != r.Method {
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	id := ingestAuth(r)
+	if nil == id {
+		wsLog.Warn("unauthorized ingestion request", "remote", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		adminError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	wait := def
+	if s := r.URL.Query().Get(param); "" != s {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || (correlate && 0 == n) {
+			adminError(w, http.StatusBadRequest, param+" must be a number of seconds")
+			return
+		}
+		wait = time.Duration(n) * time.Second
+		if wait > ingestMaxWait {
+			wait = ingestMaxWait
+		}
+	}
+	c := &Client{
+		hub:    hub,
+		cid:    uuid.NewV4().String(),
+		Type:   id.Type,
+		user:   id.Username,
+		scope:  "ingest/" + id.name,
+		addr:   r.RemoteAddr,
+		route:  r.URL.Path,
+		limits: id.limits,
+		since:  time.Now(),
+	}
+	resp := &IngestResponse{CID: c.cid, Status: ingestRejected}
+	if nil != limiter {
+		if limit := limiter.allow(c); "" != limit {
+			rateLimited.inc(c.route, limit)
+			resp.Error = c.rejection(&ErrorInfo{Code: errRateLimited, Message: limit + " rate limit exceeded"}).Error
+			writeAdminJSON(w, http.StatusTooManyRequests, resp)
+			return
+		}
+	}
+
+	sp := startSpan("receive "+c.route, spanKindServer, spanContext{})
+	defer sp.finish()
+	sp.set("wsapigw.cid", c.cid)
+	sp.set("wsapigw.route", c.route)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSendBody))
+	if err != nil {
+		resp.Error = c.rejection(&ErrorInfo{Code: errMalformed, Message: err.Error()}).Error
+		writeAdminJSON(w, http.StatusRequestEntityTooLarge, resp)
+		return
+	}
+	cmsg := &ClientMessage{}
+	if err := codecs[defaultCodec].Unmarshal(body, cmsg); err != nil {
+		resp.Error = c.rejection(&ErrorInfo{Code: errMalformed, Message: err.Error()}).Error
+		writeAdminJSON(w, http.StatusBadRequest, resp)
+		return
+	}
+	if !id.allows(cmsg.Payload) {
+		resp.Error = c.rejection(&ErrorInfo{Code: errForbidden, Message: "payload variant not allowed for this token"}).Error
+		writeAdminJSON(w, http.StatusForbidden, resp)
+		return
+	}
+	var reply chan *ClientMessage
+	if correlate {
+		cmsg.CorrelationID = uuid.NewV4().String()
+		cmsg.ReplyTo = replyTopic
+		resp.CorrelationID = cmsg.CorrelationID
+		reply = replies.wait(cmsg.CorrelationID)
+		defer replies.take(cmsg.CorrelationID)
+	} else if 0 != wait {
+		reply = replies.wait(c.cid)
+		defer replies.take(c.cid)
+	}
+	cmsg.result = make(chan error, 1)
+	if answer := c.submit(cmsg, sp); nil != answer {
+		if nil != answer.Error {
+			resp.Error = answer.Error
+			writeAdminJSON(w, http.StatusBadRequest, resp)
+			return
+		}
+		resp.Status = answer.Status
+		writeAdminJSON(w, http.StatusOK, resp)
+		return
+	}
+	select {
+	case err = <-cmsg.result:
+	case <-r.Context().Done():
+		return
+	}
+	switch {
+	case errBrokerUnavailable == err || errSchemaPending == err:
+		resp.Status = ingestFailed
+		resp.Error = &ErrorInfo{Code: errUnavailable, Message: err.Error()}
+		w.Header().Set("Retry-After", "5")
+		writeAdminJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	case err != nil:
+		resp.Status = ingestFailed
+		resp.Error = &ErrorInfo{Code: errPublishFailed, Message: err.Error()}
+		writeAdminJSON(w, http.StatusBadGateway, resp)
+		return
+	}
+	resp.Status = ingestPublished
+	if nil == reply {
+		writeAdminJSON(w, http.StatusAccepted, resp)
+		return
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	select {
+	case resp.Reply = <-reply:
+		writeAdminJSON(w, http.StatusOK, resp)
+	case <-timeout.C:
+		resp.Error = &ErrorInfo{Code: errReplyTimeout, Message: "no reply within " + wait.String()}
+		writeAdminJSON(w, http.StatusGatewayTimeout, resp)
+	case <-r.Context().Done():
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withIngest(t *testing.T, c IngestConfig, consume ...string) {
+	initIngest(c, consume)
+	t.Cleanup(func() {
+		ingestIdentities = nil
+		ingestMaxWait = defaultIngestMaxWait * time.Second
+		replyTopic = ""
+	})
+}
+
+func withDedup(t *testing.T) {
+	initIdempotency(IdempotencyConfig{})
+	t.Cleanup(func() { initIdempotency(IdempotencyConfig{}) })
+}
+
+// acceptPublishes plays the hub's publishing loop, publishing every message
+// successfully, and passes them on.
+func acceptPublishes(t *testing.T, h *Hub) <-chan *ClientMessage {
+	published := make(chan *ClientMessage, 100)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go func() {
+		for {
+			select {
+			case msg := <-h.pmsg:
+				published <- msg
+				msg.published(nil)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return published
+}
+
+const changeFP = `{"Type": "RA", "IdempotencyKey": "k1", "Payload": {"ChangeFPReq":
+	{"EmpID": "E-1", "CurrFPCode": "FPA", "NewFPInfo": {"FPCode": "FPB"}}}}`
+
+func postIngest(h *Hub, route string, token string, body string) (*httptest.ResponseRecorder, *IngestResponse) {
+	r := httptest.NewRequest(http.MethodPost, route, strings.NewReader(body))
+	if "" != token {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	if strings.HasPrefix(route, requestRoute) {
+		serveRequest(h, w, r)
+	} else {
+		serveIngest(h, w, r)
+	}
+	resp := &IngestResponse{}
+	json.Unmarshal(w.Body.Bytes(), resp)
+	return w, resp
+}
+
+// A retried batch from a token without a username is deduplicated, though
+// every request gets a new CID.
+func TestIngestIdempotency(t *testing.T) {
+	withDedup(t)
+	withIngest(t, IngestConfig{Tokens: map[string]IngestIdentity{
+		"batch":  {Type: "RA"},
+		"backup": {Type: "RA"},
+	}})
+	h := newHub()
+	published := acceptPublishes(t, h)
+
+	for _, tc := range []struct {
+		token  string
+		code   int
+		status string
+	}{
+		{"batch", http.StatusAccepted, ingestPublished},
+		{"batch", http.StatusOK, statusDuplicate},
+		// keys are scoped to the token
+		{"backup", http.StatusAccepted, ingestPublished},
+	} {
+		w, resp := postIngest(h, ingestRoute, tc.token, changeFP)
+		if tc.code != w.Code || tc.status != resp.Status {
+			t.Errorf("%s: %d %s, want %d %s", tc.token, w.Code, resp.Status, tc.code, tc.status)
+		}
+	}
+	if n := len(published); 2 != n {
+		t.Errorf("published %d messages, want 2", n)
+	}
+}
+
+func TestIngestAuth(t *testing.T) {
+	withIngest(t, IngestConfig{Tokens: map[string]IngestIdentity{"s3cret": {Type: "RA"}}})
+	for _, tc := range []struct {
+		header string
+		ok     bool
+	}{
+		{"", false},
+		{"s3cret", false},
+		{"Basic s3cret", false},
+		{"Bearer nope", false},
+		{"Bearer ", false},
+		{"Bearer s3cret", true},
+	} {
+		r := httptest.NewRequest(http.MethodPost, ingestRoute, nil)
+		if "" != tc.header {
+			r.Header.Set("Authorization", tc.header)
+		}
+		if id := ingestAuth(r); tc.ok != (nil != id) {
+			t.Errorf("authorization %q: identity %v, want one: %v", tc.header, id, tc.ok)
+		}
+	}
+}
+
+func TestReplyWaiters(t *testing.T) {
+	w := &replyWaiters{m: make(map[string]chan *ClientMessage)}
+	byCorrelation := w.wait("corr-1")
+	byCID := w.wait("cid-1")
+	for _, tc := range []struct {
+		name string
+		keys []string
+		want chan *ClientMessage
+	}{
+		{"by correlation ID", []string{"corr-1", "cid-1"}, byCorrelation},
+		{"falls back to the CID", []string{"", "cid-1"}, byCID},
+		{"taken once", []string{"corr-1", "cid-1"}, nil},
+		{"unknown", []string{"corr-2", "cid-2"}, nil},
+	} {
+		if got := w.take(tc.keys...); tc.want != got {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// serveReplies plays the service answering every published request on topic
+// with reply, carrying the request's CorrelationID.
+func serveReplies(h *Hub, published <-chan *ClientMessage, topic string, reply string) {
+	go func() {
+		for msg := range published {
+			if nil == msg.Payload {
+				continue
+			}
+			v := strings.Replace(reply, "$CORR", msg.CorrelationID, 1)
+			h.dispatch(&ConsumerMessage{Topic: topic, Value: v})
+		}
+	}()
+}
+
+func TestRequestReply(t *testing.T) {
+	withDedup(t)
+	withIngest(t, IngestConfig{Tokens: map[string]IngestIdentity{"s3cret": {Type: "RA"}}, ReplyTo: "replies"}, "replies")
+	h, published := readyHub(t)
+	serveReplies(h, published, "replies", `{"CorrelationID": "$CORR", "Status": "ENROLLED"}`)
+
+	// the reply carries no payload, only a Status
+	w, resp := postIngest(h, requestRoute, "s3cret", changeFP)
+	if http.StatusOK != w.Code || nil == resp.Reply {
+		t.Fatalf("%d %s, want the reply", w.Code, w.Body)
+	}
+	if resp.CorrelationID != resp.Reply.CorrelationID || "ENROLLED" != resp.Reply.Status {
+		t.Errorf("reply %+v to request %s", resp.Reply, resp.CorrelationID)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	withDedup(t)
+	withIngest(t, IngestConfig{Tokens: map[string]IngestIdentity{"s3cret": {Type: "RA"}}, ReplyTo: "replies"}, "replies")
+	h, published := readyHub(t)
+	requests := make(chan *ClientMessage, 1)
+	go func() {
+		for msg := range published {
+			if nil != msg.Payload {
+				requests <- msg
+			}
+		}
+	}()
+
+	w, resp := postIngest(h, requestRoute+"?timeout=1", "s3cret", changeFP)
+	if http.StatusGatewayTimeout != w.Code || nil == resp.Error || errReplyTimeout != resp.Error.Code {
+		t.Fatalf("%d %s, want reply_timeout", w.Code, w.Body)
+	}
+	req := <-requests
+	if resp.CorrelationID != req.CorrelationID || "replies" != req.ReplyTo {
+		t.Errorf("published %+v for request %s", req, resp.CorrelationID)
+	}
+
+	// a late reply finds no waiter and is routed like any other record
+	c := testClient(h, "c1", "RA")
+	h.mu.Lock()
+	h.clients[c.cid] = c
+	h.mu.Unlock()
+	h.dispatch(&ConsumerMessage{Topic: "replies",
+		Value: `{"CorrelationID": "` + req.CorrelationID + `", "Type": "RA", "Payload": {"Notice": "late"}}`})
+	select {
+	case msg := <-c.send:
+		if req.CorrelationID != msg.CorrelationID {
+			t.Errorf("client got %+v", msg)
+		}
+	default:
+		t.Error("late reply not routed")
+	}
+	replies.mu.Lock()
+	n := len(replies.m)
+	replies.mu.Unlock()
+	if 0 != n {
+		t.Errorf("%d reply waiters left", n)
+	}
+}
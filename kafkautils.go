@@ -1,96 +1,392 @@
-package main
-
-import (
-	"encoding/json"
-	"io/ioutil"
-	"log"
-	"os"
-	"time"
-
-	"github.com/Shopify/sarama"
-	"github.com/wvanbergen/kafka/consumergroup"
-)
-
-type ConsumerMessage struct {
-	Value string `json:"Value"`
-}
-
-type Topics struct {
-	Consume []string `json:"consume"`
-}
-
-type KafkaConfig struct {
-	KafkaAddr     string `json:"kafka"`
-	ZookeeperAddr string `json:"zookeeper"`
-	Topics        Topics `json:"topics"`
-	Cgroup        string `json:"cgroup"`
-}
-
-func initConfig() *KafkaConfig {
-	c, err := os.Open("config.json")
-	if err != nil {
-		log.Print(err)
-	}
-	defer c.Close()
-
-	byteValue, _ := ioutil.ReadAll(c)
-
-	var result KafkaConfig
-	json.Unmarshal([]byte(byteValue), &result)
-
-	return &result
-}
-
-func initProducer(kaddr string) (sarama.SyncProducer, error) {
-	log.Print(kaddr)
-	// setup sarama log to stdout
-	sarama.Logger = log.New(os.Stdout, "", log.Ltime)
-
-	// producer config
-	config := sarama.NewConfig()
-	config.Producer.Retry.Max = 5
-	config.Producer.RequiredAcks = sarama.WaitForAll
-	config.Producer.Return.Successes = true
-
-	// async producer
-	//prd, err := sarama.NewAsyncProducer([]string{kafkaConn}, config)
-
-	// sync producer
-	prd, err := sarama.NewSyncProducer([]string{kaddr}, config)
-
-	return prd, err
-}
-
-func publish(message []byte, topic string, producer sarama.SyncProducer) {
-	// publish sync
-	log.Printf("topic: %s", topic)
-	msg := &sarama.ProducerMessage{
-		Topic: topic,
-		Value: sarama.StringEncoder(string(message)),
-	}
-	p, o, err := producer.SendMessage(msg)
-	if err != nil {
-		log.Print("Error publish: ", err.Error())
-	}
-
-	// publish async
-	//producer.Input() <- &sarama.ProducerMessage{
-
-	log.Print("Partition: ", p)
-	log.Print("Offset: ", o)
-}
-
-func initConsumer(topics []string, zaddr string, cgroup string) (*consumergroup.ConsumerGroup, error) {
-	// consumer config
-	config := consumergroup.NewConfig()
-	config.Offsets.Initial = sarama.OffsetOldest
-	config.Offsets.ProcessingTimeout = 2 * time.Second
-
-	// join to consumer group
-	cg, err := consumergroup.JoinConsumerGroup(cgroup, topics, []string{zaddr}, config)
-	if err != nil {
-		return nil, err
-	}
-	log.Print("joined consumer group!")
-	return cg, err
-}
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/wvanbergen/kafka/consumergroup"
+	"github.com/wvanbergen/kazoo-go"
+)
+
+type ConsumerMessage struct {
+	Value       string    `json:"Value"`
+	Topic       string    `json:"Topic"`
+	Timestamp   time.Time `json:"Timestamp"`
+	TraceParent string    `json:"TraceParent,omitempty"`
+	Partition   int32     `json:"Partition"`
+	Offset      int64     `json:"Offset"`
+	// nil unless offsets are committed after delivery
+	delivery *delivery
+}
+
+type Topics struct {
+	Consume    []string `json:"consume"`
+	DeadLetter string   `json:"deadletter,omitempty"`
+}
+
+type AdminConfig struct {
+	Addr  string `json:"addr"`
+	Token string `json:"token"`
+}
+
+type KafkaConfig struct {
+	Server        ServerConfig      `json:"server"`
+	KafkaAddr     string            `json:"kafka"`
+	ZookeeperAddr string            `json:"zookeeper"`
+	Topics        Topics            `json:"topics"`
+	Cgroup        string            `json:"cgroup"`
+	Version       string            `json:"version,omitempty"`
+	Admin         AdminConfig       `json:"admin"`
+	Auth          AuthConfig        `json:"auth"`
+	Log           LogConfig         `json:"log"`
+	Trace         TraceConfig       `json:"trace"`
+	Codecs        CodecConfig       `json:"codecs"`
+	Registry      RegistryConfig    `json:"registry"`
+	RateLimit     RateLimitConfig   `json:"ratelimit"`
+	Admission     AdmissionConfig   `json:"admission"`
+	Idempotency   IdempotencyConfig `json:"idempotency"`
+	Consumer      ConsumerConfig    `json:"consumer"`
+	Outbox        OutboxConfig      `json:"outbox"`
+	Acks          AckConfig         `json:"acks"`
+	Ingest        IngestConfig      `json:"ingest"`
+	GRPC          GRPCConfig        `json:"grpc"`
+	Broker        BrokerConfig      `json:"broker"`
+}
+
+// setVersion sets the Kafka protocol version from the config, if any.
+// Record timestamps need at least 0.10.0.0.
+func setVersion(config *sarama.Config, version string) error {
+	if "" == version {
+		return nil
+	}
+	v, err := sarama.ParseKafkaVersion(version)
+	if err != nil {
+		return err
+	}
+	config.Version = v
+	return nil
+}
+
+// initProducer returns the sync producer along with the client it runs on,
+// which the hub also uses to look up partition offsets.
+func initProducer(kaddr string, version string) (sarama.Client, sarama.SyncProducer, error) {
+	kafkaLog.Info("connecting producer", "kafka", kaddr)
+
+	// producer config
+	config := sarama.NewConfig()
+	config.Producer.Retry.Max = 5
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	config.MetricRegistry = metrics.NewPrefixedChildRegistry(saramaRegistry, "producer-")
+	if err := setVersion(config, version); err != nil {
+		return nil, nil, err
+	}
+	// the idempotent producer keeps retries from writing a record twice
+	if config.Version.IsAtLeast(sarama.V0_11_0_0) {
+		config.Producer.Idempotent = true
+		config.Net.MaxOpenRequests = 1
+	} else {
+		kafkaLog.Warn("idempotent producer needs version 0.11.0.0 or later, retries may duplicate records", "version", config.Version.String())
+	}
+
+	// async producer
+	//prd, err := sarama.NewAsyncProducer([]string{brokerConn}, config)
+
+	// sync producer
+	kc, err := sarama.NewClient([]string{kaddr}, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	prd, err := sarama.NewSyncProducerFromClient(kc)
+	if err != nil {
+		kc.Close()
+		return nil, nil, err
+	}
+
+	return kc, prd, nil
+}
+
+func publish(message []byte, topic string, pub Publisher, headers map[string]string) error {
+	// publish sync
+	r := &Record{Topic: topic, Value: message, Headers: headers}
+	start := time.Now()
+	err := pub.Publish(r)
+	publishLatency.since(start, topic)
+	if err != nil {
+		kafkaLog.Error("error publishing", "topic", topic, "err", err)
+		publishErrors.inc(topic)
+		return err
+	}
+
+	kafkaLog.Debug("published", "topic", topic, "partition", r.Partition, "offset", r.Offset)
+	return nil
+}
+
+// kafkaPublisher publishes through a sarama sync producer.
+type kafkaPublisher struct {
+	producer sarama.SyncProducer
+}
+
+func (p *kafkaPublisher) Publish(r *Record) error {
+	msg := &sarama.ProducerMessage{Topic: r.Topic}
+	if nil != r.Key {
+		msg.Key = sarama.ByteEncoder(r.Key)
+	}
+	if nil != r.Value {
+		msg.Value = sarama.ByteEncoder(r.Value)
+	}
+	for k, v := range r.Headers {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
+	}
+	partition, offset, err := p.producer.SendMessage(msg)
+	r.Partition, r.Offset = partition, offset
+	return err
+}
+
+func (p *kafkaPublisher) Close() error { return p.producer.Close() }
+
+func initConsumer(topics []string, zaddr string, cgroup string, version string) (*consumergroup.ConsumerGroup, error) {
+	// consumer config
+	config := consumergroup.NewConfig()
+	config.Offsets.Initial = sarama.OffsetOldest
+	config.Offsets.ProcessingTimeout = 2 * time.Second
+	config.MetricRegistry = metrics.NewPrefixedChildRegistry(saramaRegistry, "consumer-")
+	if err := setVersion(config.Config, version); err != nil {
+		return nil, err
+	}
+
+	// join to consumer group
+	cg, err := consumergroup.JoinConsumerGroup(cgroup, topics, []string{zaddr}, config)
+	if err != nil {
+		return nil, err
+	}
+	kafkaLog.Info("joined consumer group", "cgroup", cgroup, "topics", topics)
+	return cg, err
+}
+
+func initKazoo(zaddr string) (*kazoo.Kazoo, error) {
+	return kazoo.NewKazooFromConnectionString(zaddr, nil)
+}
+
+// kafkaSubscriber is a member of a ZooKeeper-coordinated consumer group.
+type kafkaSubscriber struct {
+	cg      *consumergroup.ConsumerGroup
+	records chan *Record
+	// closed by Close, so the forwarding goroutine doesn't outlive the
+	// connection blocked on a record nobody reads
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newKafkaSubscriber(cg *consumergroup.ConsumerGroup) *kafkaSubscriber {
+	s := &kafkaSubscriber{cg: cg, records: make(chan *Record), stop: make(chan struct{})}
+	go func() {
+		defer close(s.records)
+		for msg := range cg.Messages() {
+			select {
+			case s.records <- fromSarama(msg):
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func fromSarama(msg *sarama.ConsumerMessage) *Record {
+	r := &Record{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Timestamp: msg.Timestamp,
+	}
+	for _, h := range msg.Headers {
+		if nil == h {
+			continue
+		}
+		if nil == r.Headers {
+			r.Headers = make(map[string]string)
+		}
+		r.Headers[string(h.Key)] = string(h.Value)
+	}
+	return r
+}
+
+func (s *kafkaSubscriber) Records() <-chan *Record { return s.records }
+
+func (s *kafkaSubscriber) Errors() <-chan error { return s.cg.Errors() }
+
+func (s *kafkaSubscriber) Commit(r *Record) error {
+	return s.cg.CommitUpto(&sarama.ConsumerMessage{Topic: r.Topic, Partition: r.Partition, Offset: r.Offset})
+}
+
+func (s *kafkaSubscriber) Closed() bool { return s.cg.Closed() }
+
+func (s *kafkaSubscriber) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	return s.cg.Close()
+}
+
+// connectKafka connects to Kafka and ZooKeeper.
+func connectKafka(c *KafkaConfig, topics []string) (*brokerConn, error) {
+	kc, prod, err := initProducer(c.KafkaAddr, c.Version)
+	if err != nil {
+		return nil, err
+	}
+	cons, err := initConsumer(topics, c.ZookeeperAddr, c.Cgroup, c.Version)
+	if err != nil {
+		prod.Close()
+		kc.Close()
+		return nil, err
+	}
+	kz, err := initKazoo(c.ZookeeperAddr)
+	if err != nil {
+		cons.Close()
+		prod.Close()
+		kc.Close()
+		return nil, err
+	}
+	return &brokerConn{
+		pub:     &kafkaPublisher{prod},
+		sub:     newKafkaSubscriber(cons),
+		cluster: &kafkaCluster{client: kc, kz: kz},
+		dead:    make(chan struct{}),
+		commits: make(map[partitionKey]*partitionCommits),
+	}, nil
+}
+
+// kafkaCluster is the cluster of a real Kafka, looked up through the
+// producer's client and ZooKeeper.
+type kafkaCluster struct {
+	client sarama.Client
+	kz     *kazoo.Kazoo
+}
+
+func (kc *kafkaCluster) highWaterMark(topic string, partition int32) (int64, error) {
+	return kc.client.GetOffset(topic, partition, sarama.OffsetNewest)
+}
+
+// checkPartitions verifies in ZooKeeper that every partition of the consumed
+// topics has been claimed by a member of the consumer group.
+func (kc *kafkaCluster) checkPartitions(cgroup string, topics []string) string {
+	group := kc.kz.Consumergroup(cgroup)
+	unowned := 0
+	total := 0
+	for _, topic := range topics {
+		partitions, err := kc.kz.Topic(topic).Partitions()
+		if err != nil {
+			return fmt.Sprintf("listing partitions of %s: %v", topic, err)
+		}
+		for _, p := range partitions {
+			total++
+			owner, err := group.PartitionOwner(topic, p.ID)
+			if err != nil {
+				return fmt.Sprintf("owner of %s/%d: %v", topic, p.ID, err)
+			}
+			if nil == owner {
+				unowned++
+			}
+		}
+	}
+	if 0 == total {
+		return "no partitions"
+	}
+	if 0 != unowned {
+		return fmt.Sprintf("%d of %d partitions unassigned", unowned, total)
+	}
+	return checkOK
+}
+
+// checkBrokers reports whether the producer's client holds a connection to
+// at least one broker, refreshing metadata to reconnect if it doesn't.
+func (kc *kafkaCluster) checkBrokers() string {
+	if kc.client.Closed() {
+		return "client closed"
+	}
+	connected := func() bool {
+		for _, b := range kc.client.Brokers() {
+			if ok, _ := b.Connected(); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if connected() {
+		return checkOK
+	}
+	if err := kc.client.RefreshMetadata(); err != nil {
+		return "unreachable: " + err.Error()
+	}
+	if !connected() {
+		return "no broker connected"
+	}
+	return checkOK
+}
+
+func (kc *kafkaCluster) readTopic(topic string, stop <-chan struct{}, apply func(*Record)) error {
+	consumer, err := sarama.NewConsumerFromClient(kc.client)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+	partitions, err := consumer.Partitions(topic)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	for _, p := range partitions {
+		pc, err := consumer.ConsumePartition(topic, p, sarama.OffsetOldest)
+		if err != nil {
+			kafkaLog.Error("error consuming partition", "topic", topic, "partition", p, "err", err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer pc.Close()
+			for {
+				select {
+				case msg, ok := <-pc.Messages():
+					if !ok {
+						return
+					}
+					apply(fromSarama(msg))
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (kc *kafkaCluster) close() {
+	kc.kz.Close()
+	if err := kc.client.Close(); err != nil {
+		kafkaLog.Warn("error closing kafka client", "err", err)
+	}
+}
+
+// recordError reports whether a publish error is about the record alone,
+// so the producer is fine and the next publish may well succeed.
+func recordError(err error) bool {
+	return err == sarama.ErrMessageSizeTooLarge ||
+		err == sarama.ErrInvalidMessage ||
+		err == sarama.ErrInvalidMessageSize ||
+		err == sarama.ErrInvalidTopic
+}
+
+// fatalProducerError reports whether a publish error means the producer
+// won't recover without being recreated.
+func fatalProducerError(err error) bool {
+	return err == sarama.ErrClosedClient ||
+		err == sarama.ErrOutOfBrokers ||
+		err == sarama.ErrShuttingDown ||
+		err == errBrokerClosed
+}
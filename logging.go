@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// Logs are written as JSON lines to stderr. Every component logs through its
+// own logger so entries can be filtered by the "component" field.
+
+var logLevel = new(slog.LevelVar)
+
+// redactPII masks the personal fields of EmpData in logged messages. It can
+// only be turned off through the log.redact config setting.
+var redactPII = true
+
+var rootLog = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+var (
+	hubLog    = rootLog.With("component", "hub")
+	wsLog     = rootLog.With("component", "websocket")
+	kafkaLog  = rootLog.With("component", "kafka")
+	brokerLog = rootLog.With("component", "broker")
+	adminLog  = rootLog.With("component", "admin")
+	healthLog = rootLog.With("component", "health")
+	saramaLog = rootLog.With("component", "sarama")
+)
+
+type LogConfig struct {
+	Level  string `json:"level,omitempty"`
+	Redact *bool  `json:"redact,omitempty"`
+}
+
+// initLogging applies the log config and routes sarama's logger and the
+// standard library logger, which the ZooKeeper client uses, through rootLog.
+// sarama is chatty, so its lines are logged at debug level.
+func initLogging(c LogConfig) {
+	switch strings.ToLower(c.Level) {
+	case "debug":
+		logLevel.Set(slog.LevelDebug)
+	case "warn", "warning":
+		logLevel.Set(slog.LevelWarn)
+	case "error":
+		logLevel.Set(slog.LevelError)
+	default:
+		logLevel.Set(slog.LevelInfo)
+	}
+	if nil != c.Redact {
+		redactPII = *c.Redact
+	}
+	sarama.Logger = slog.NewLogLogger(saramaLog.Handler(), slog.LevelDebug)
+	slog.SetDefault(rootLog)
+}
+
+const redacted = "[REDACTED]"
+
+func mask(s string) string {
+	if "" == s {
+		return s
+	}
+	return redacted
+}
+
+// redacted returns a copy of e with everything but the employee ID and the
+// employer masked.
+func (e EmpData) redacted() EmpData {
+	e.FirstName = mask(e.FirstName)
+	e.MiddleName = mask(e.MiddleName)
+	e.LastName = mask(e.LastName)
+	e.Birthday = mask(e.Birthday)
+	e.Age = mask(e.Age)
+	e.Address = mask(e.Address)
+	e.Email = mask(e.Email)
+	e.ContactNo = mask(e.ContactNo)
+	e.TaxID = mask(e.TaxID)
+	return e
+}
+
+func (e Employee) redacted() Employee {
+	e.EmployeeData = e.EmployeeData.redacted()
+	return e
+}
+
+// redacted returns a copy of p whose employee data is masked. The original
+// payload is left untouched since it is still delivered or published.
+func (p *Payload) redacted() *Payload {
+	if nil == p {
+		return nil
+	}
+	r := *p
+	if nil != p.EnrollmentReq {
+		v := *p.EnrollmentReq
+		v.EmployeeData = v.EmployeeData.redacted()
+		r.EnrollmentReq = &v
+	}
+	if nil != p.EnrollmentApproval {
+		v := *p.EnrollmentApproval
+		v.EmployeeData = v.EmployeeData.redacted()
+		r.EnrollmentApproval = &v
+	}
+	if nil != p.ChangeFPApproval {
+		v := *p.ChangeFPApproval
+		v.EmployeeData = mask(v.EmployeeData)
+		r.ChangeFPApproval = &v
+	}
+	if nil != p.Employee {
+		v := p.Employee.redacted()
+		r.Employee = &v
+	}
+	if nil != p.Employees {
+		emps := make([]Employee, len(*p.Employees))
+		for i, e := range *p.Employees {
+			emps[i] = e.redacted()
+		}
+		r.Employees = &emps
+	}
+	return &r
+}
+
+// loggedMessage has the fields of ClientMessage but not its LogValue method,
+// so the redacted copy is encoded as plain JSON.
+type loggedMessage ClientMessage
+
+// LogValue keeps personal data out of the logs unless redaction is disabled.
+func (m *ClientMessage) LogValue() slog.Value {
+	if nil == m {
+		return slog.AnyValue(nil)
+	}
+	c := loggedMessage(*m)
+	if redactPII {
+		c.Payload = m.Payload.redacted()
+	}
+	return slog.AnyValue(c)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogRedaction(t *testing.T) {
+	emp := EmpData{ID: "E-1", FirstName: "Juan", MiddleName: "Reyes", LastName: "Dela Cruz", Birthday: "1990-01-31",
+		Age: "34", Address: "12 Mabini St", Email: "jdc@example.com", ContactNo: "0917-555-0100", TaxID: "123-456-789",
+		Employer: "ACME"}
+	pii := []string{"Juan", "Reyes", "Dela Cruz", "1990-01-31", `"34"`, "12 Mabini St", "jdc@example.com",
+		"0917-555-0100", "123-456-789", "sealed-employee-data"}
+	employees := []Employee{{EmployeeData: emp}}
+	msg := &ClientMessage{CID: "c1", Payload: &Payload{
+		EnrollmentReq:      &EnrollmentReq{EmployeeData: emp},
+		EnrollmentApproval: &EnrollmentApproval{EmployeeData: emp},
+		ChangeFPApproval:   &ChangeFPApproval{EmployeeData: "sealed-employee-data"},
+		Employee:           &Employee{EmployeeData: emp},
+		Employees:          &employees,
+	}}
+	logged := func() string {
+		var buf bytes.Buffer
+		slog.New(slog.NewJSONHandler(&buf, nil)).Info("message from client", "body", msg)
+		return buf.String()
+	}
+
+	out := logged()
+	for _, v := range pii {
+		if strings.Contains(out, v) {
+			t.Errorf("logged %s: %s", v, out)
+		}
+	}
+	for _, v := range []string{`"ID":"E-1"`, `"Employer":"ACME"`, `"CID":"c1"`, redacted} {
+		if !strings.Contains(out, v) {
+			t.Errorf("%s not logged: %s", v, out)
+		}
+	}
+	if "Juan" != msg.Payload.EnrollmentReq.EmployeeData.FirstName || "Juan" != (*msg.Payload.Employees)[0].EmployeeData.FirstName {
+		t.Error("logging redacted the message itself")
+	}
+
+	redactPII = false
+	t.Cleanup(func() { redactPII = true })
+	out = logged()
+	for _, v := range pii {
+		if !strings.Contains(out, v) {
+			t.Errorf("%s not logged with redaction off", v)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With broker.type set to "memory" the gateway runs against an in-process
+// stand-in for Kafka instead of the brokers and ZooKeeper in the config.
+// Topics are created on first use with broker.partitions partitions (default
+// 1), keyed records are partitioned by key hash, and consumer groups keep
+// their committed offsets across reconnects. Nothing is persisted, and every
+// member of a group consumes all partitions: the stand-in is for one gateway
+// on a laptop, not for clusters.
+//
+// With broker.listen set, the stand-in's topics are also served over HTTP so
+// tools and tests in other processes can produce and consume:
+//
+//	POST /topics/{topic}[?key=]                  produce the body, returns a TopicRecord
+//	GET  /topics/{topic}?group=[&wait=][&max=]   next records for the group, committed
+//	                                             as they are returned
+
+const (
+	brokerKafka  = "kafka"
+	brokerMemory = "memory"
+
+	memMaxFetch  = 100
+	memFetchWait = 30 * time.Second
+)
+
+type BrokerConfig struct {
+	Type       string `json:"type,omitempty"` // "kafka" (default), "memory" or "redis"
+	Partitions int    `json:"partitions,omitempty"`
+	Listen     string `json:"listen,omitempty"`
+	Addr       string `json:"addr,omitempty"` // redis
+	Password   string `json:"password,omitempty"`
+}
+
+// TopicRecord is a memory broker record as served over HTTP.
+type TopicRecord struct {
+	Topic     string    `json:"Topic"`
+	Partition int32     `json:"Partition"`
+	Offset    int64     `json:"Offset"`
+	Key       string    `json:"Key,omitempty"`
+	Value     string    `json:"Value"`
+	Timestamp time.Time `json:"Timestamp"`
+}
+
+type memPartition struct {
+	mu      sync.Mutex
+	records []*Record
+	// closed and replaced whenever a record is appended
+	grown chan struct{}
+}
+
+func (p *memPartition) append(msg *Record) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	msg.Offset = int64(len(p.records))
+	p.records = append(p.records, msg)
+	close(p.grown)
+	p.grown = make(chan struct{})
+}
+
+// from returns the records from offset on, and a channel closed once more
+// are appended.
+func (p *memPartition) from(offset int64) ([]*Record, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if offset >= int64(len(p.records)) {
+		return nil, p.grown
+	}
+	return p.records[offset:], p.grown
+}
+
+func (p *memPartition) size() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return int64(len(p.records))
+}
+
+type memoryBroker struct {
+	partitions int
+	next       uint32 // round robin partition of unkeyed records
+	// mu guards topics and offsets, the next offset of each group
+	mu      sync.Mutex
+	topics  map[string][]*memPartition
+	offsets map[string]map[partitionKey]int64
+}
+
+// memBroker is shared by every connection, so state survives reconnects.
+var memBroker *memoryBroker
+
+func newMemoryBroker(partitions int) *memoryBroker {
+	if partitions < 1 {
+		partitions = 1
+	}
+	return &memoryBroker{
+		partitions: partitions,
+		topics:     make(map[string][]*memPartition),
+		offsets:    make(map[string]map[partitionKey]int64),
+	}
+}
+
+// topic returns the partitions of a topic, creating it if needed.
+func (b *memoryBroker) topic(name string) []*memPartition {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	parts, ok := b.topics[name]
+	if !ok {
+		parts = make([]*memPartition, b.partitions)
+		for i := range parts {
+			parts[i] = &memPartition{grown: make(chan struct{})}
+		}
+		b.topics[name] = parts
+	}
+	return parts
+}
+
+func (b *memoryBroker) produce(topic string, key []byte, value []byte, headers map[string]string) *Record {
+	parts := b.topic(topic)
+	var p int32
+	if nil != key {
+		h := fnv.New32a()
+		h.Write(key)
+		p = int32(h.Sum32() % uint32(len(parts)))
+	} else {
+		p = int32(atomic.AddUint32(&b.next, 1) % uint32(len(parts)))
+	}
+	r := &Record{
+		Topic:     topic,
+		Partition: p,
+		Key:       key,
+		Value:     value,
+		Headers:   headers,
+		Timestamp: time.Now(),
+	}
+	parts[p].append(r)
+	return r
+}
+
+// committed returns the next offset group consumes from a partition.
+func (b *memoryBroker) committed(group string, key partitionKey) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.offsets[group][key]
+}
+
+func (b *memoryBroker) commit(group string, key partitionKey, next int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	offsets := b.offsets[group]
+	if nil == offsets {
+		offsets = make(map[partitionKey]int64)
+		b.offsets[group] = offsets
+	}
+	if next > offsets[key] {
+		offsets[key] = next
+	}
+}
+
+// memPublisher is the stand-in's Publisher.
+type memPublisher struct {
+	b *memoryBroker
+}
+
+func (p *memPublisher) Publish(r *Record) error {
+	rec := p.b.produce(r.Topic, r.Key, r.Value, r.Headers)
+	r.Partition, r.Offset = rec.Partition, rec.Offset
+	return nil
+}
+
+func (p *memPublisher) Close() error { return nil }
+
+// memGroup is the stand-in's Subscriber. It consumes every partition of its
+// topics from the group's committed offsets.
+type memGroup struct {
+	b        *memoryBroker
+	group    string
+	messages chan *Record
+	errors   chan error
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	closed   int32
+}
+
+func (b *memoryBroker) join(group string, topics []string) *memGroup {
+	g := &memGroup{
+		b:        b,
+		group:    group,
+		messages: make(chan *Record),
+		errors:   make(chan error),
+		stop:     make(chan struct{}),
+	}
+	for _, topic := range topics {
+		for i, p := range b.topic(topic) {
+			g.wg.Add(1)
+			go g.consume(p, partitionKey{topic, int32(i)})
+		}
+	}
+	return g
+}
+
+func (g *memGroup) consume(p *memPartition, key partitionKey) {
+	defer g.wg.Done()
+	next := g.b.committed(g.group, key)
+	for {
+		records, grown := p.from(next)
+		for _, msg := range records {
+			select {
+			case g.messages <- msg:
+				next = msg.Offset + 1
+			case <-g.stop:
+				return
+			}
+		}
+		if 0 == len(records) {
+			select {
+			case <-grown:
+			case <-g.stop:
+				return
+			}
+		}
+	}
+}
+
+func (g *memGroup) Records() <-chan *Record { return g.messages }
+
+func (g *memGroup) Errors() <-chan error { return g.errors }
+
+func (g *memGroup) Commit(msg *Record) error {
+	g.b.commit(g.group, partitionKey{msg.Topic, msg.Partition}, msg.Offset+1)
+	return nil
+}
+
+func (g *memGroup) Closed() bool { return 1 == atomic.LoadInt32(&g.closed) }
+
+func (g *memGroup) Close() error {
+	if !atomic.CompareAndSwapInt32(&g.closed, 0, 1) {
+		return nil
+	}
+	close(g.stop)
+	g.wg.Wait()
+	close(g.messages)
+	close(g.errors)
+	return nil
+}
+
+// memCluster is the stand-in's cluster; it is always healthy.
+type memCluster struct {
+	b *memoryBroker
+}
+
+func (c *memCluster) highWaterMark(topic string, partition int32) (int64, error) {
+	parts := c.b.topic(topic)
+	if partition < 0 || int(partition) >= len(parts) {
+		return 0, errUnknownPartition
+	}
+	return parts[partition].size(), nil
+}
+
+func (c *memCluster) checkBrokers() string { return checkOK }
+
+func (c *memCluster) checkPartitions(string, []string) string { return checkOK }
+
+func (c *memCluster) readTopic(topic string, stop <-chan struct{}, apply func(*Record)) error {
+	var wg sync.WaitGroup
+	for _, p := range c.b.topic(topic) {
+		wg.Add(1)
+		go func(p *memPartition) {
+			defer wg.Done()
+			var next int64
+			for {
+				records, grown := p.from(next)
+				for _, msg := range records {
+					apply(msg)
+					next = msg.Offset + 1
+				}
+				select {
+				case <-grown:
+				case <-stop:
+					return
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (c *memCluster) close() {}
+
+func connectMemory(c *KafkaConfig, topics []string) *brokerConn {
+	return &brokerConn{
+		pub:     &memPublisher{memBroker},
+		sub:     memBroker.join(c.Cgroup, topics),
+		cluster: &memCluster{memBroker},
+		dead:    make(chan struct{}),
+		commits: make(map[partitionKey]*partitionCommits),
+	}
+}
+
+func initBroker(c BrokerConfig) {
+	switch c.Type {
+	case "", brokerKafka:
+		return
+	case brokerRedis:
+		if "" == c.Addr {
+			brokerLog.Error("redis broker needs broker.addr")
+		}
+		return
+	case brokerMemory:
+	default:
+		brokerLog.Error("unknown broker type, using kafka", "type", c.Type)
+		return
+	}
+	memBroker = newMemoryBroker(c.Partitions)
+	brokerLog.Warn("using the in-memory broker, records are lost on exit", "partitions", memBroker.partitions)
+	if "" != c.Listen {
+		go serveMemoryBroker(memBroker, c.Listen)
+	}
+}
+
+func toTopicRecord(msg *Record) TopicRecord {
+	return TopicRecord{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       string(msg.Key),
+		Value:     string(msg.Value),
+		Timestamp: msg.Timestamp,
+	}
+}
+
+// fetch returns up to max records of topic the group hasn't consumed,
+// waiting up to wait for one, and commits them.
+func (b *memoryBroker) fetch(topic string, group string, wait time.Duration, max int) []TopicRecord {
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	for {
+		records := make([]TopicRecord, 0)
+		var grown []<-chan struct{}
+		for i, p := range b.topic(topic) {
+			key := partitionKey{topic, int32(i)}
+			msgs, g := p.from(b.committed(group, key))
+			grown = append(grown, g)
+			for _, msg := range msgs {
+				if len(records) == max {
+					break
+				}
+				records = append(records, toTopicRecord(msg))
+				b.commit(group, key, msg.Offset+1)
+			}
+		}
+		if 0 != len(records) {
+			return records
+		}
+		// woken by the first partition to grow; the others are checked on
+		// the next round anyway
+		any := make(chan struct{})
+		stop := make(chan struct{})
+		for _, g := range grown {
+			go func(g <-chan struct{}) {
+				select {
+				case <-g:
+					select {
+					case any <- struct{}{}:
+					case <-stop:
+					}
+				case <-stop:
+				}
+			}(g)
+		}
+		select {
+		case <-any:
+			close(stop)
+		case <-deadline.C:
+			close(stop)
+			return records
+		}
+	}
+}
+
+// serveMemoryBroker serves the stand-in's topics over HTTP.
+func serveMemoryBroker(b *memoryBroker, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/topics/", func(w http.ResponseWriter, r *http.Request) {
+		topic := strings.Trim(strings.TrimPrefix(r.URL.Path, "/topics/"), "/")
+		if "" == topic {
+			adminError(w, http.StatusNotFound, "topic required")
+			return
+		}
+		q := r.URL.Query()
+		switch r.Method {
+		case http.MethodPost:
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSendBody))
+			if err != nil {
+				adminError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			var key []byte
+			if k := q.Get("key"); "" != k {
+				key = []byte(k)
+			}
+			writeAdminJSON(w, http.StatusOK, toTopicRecord(b.produce(topic, key, body, nil)))
+		case http.MethodGet:
+			group := q.Get("group")
+			if "" == group {
+				adminError(w, http.StatusBadRequest, "group required")
+				return
+			}
+			wait := time.Duration(0)
+			if s := q.Get("wait"); "" != s {
+				n, err := strconv.Atoi(s)
+				if err != nil || n < 0 {
+					adminError(w, http.StatusBadRequest, "wait must be a number of seconds")
+					return
+				}
+				wait = time.Duration(n) * time.Second
+				if wait > memFetchWait {
+					wait = memFetchWait
+				}
+			}
+			max := memMaxFetch
+			if n, err := strconv.Atoi(q.Get("max")); nil == err && n > 0 && n < max {
+				max = n
+			}
+			writeAdminJSON(w, http.StatusOK, b.fetch(topic, group, wait, max))
+		default:
+			adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+	brokerLog.Info("in-memory broker listening", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		brokerLog.Error("in-memory broker ListenAndServe", "err", err)
+	}
+}
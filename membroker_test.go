@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryBrokerPartitions(t *testing.T) {
+	b := newMemoryBroker(3)
+	if n := len(b.topic("t")); 3 != n {
+		t.Fatalf("%d partitions, want 3", n)
+	}
+	first := b.produce("t", []byte("E-1"), []byte("a"), nil)
+	for i := 0; i < 5; i++ {
+		if r := b.produce("t", []byte("E-1"), []byte("a"), nil); first.Partition != r.Partition {
+			t.Fatalf("record keyed E-1 on partition %d, then %d", first.Partition, r.Partition)
+		}
+	}
+	used := make(map[int32]bool)
+	for i := 0; i < 3; i++ {
+		used[b.produce("t", nil, []byte("b"), nil).Partition] = true
+	}
+	if 3 != len(used) {
+		t.Errorf("unkeyed records went to partitions %v, want all 3", used)
+	}
+	c := &memCluster{b}
+	var total int64
+	for p := int32(0); p < 3; p++ {
+		hwm, err := c.highWaterMark("t", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += hwm
+	}
+	if 9 != total {
+		t.Errorf("high water marks sum to %d, want 9", total)
+	}
+	if _, err := c.highWaterMark("t", 3); errUnknownPartition != err {
+		t.Errorf("partition 3: %v, want errUnknownPartition", err)
+	}
+}
+
+func receive(t *testing.T, g *memGroup, n int) []*Record {
+	t.Helper()
+	var got []*Record
+	for len(got) < n {
+		select {
+		case r := <-g.Records():
+			got = append(got, r)
+		case <-time.After(time.Second):
+			t.Fatalf("got %d records, want %d", len(got), n)
+		}
+	}
+	select {
+	case r := <-g.Records():
+		t.Fatalf("unexpected record %s/%d/%d", r.Topic, r.Partition, r.Offset)
+	case <-time.After(100 * time.Millisecond):
+	}
+	return got
+}
+
+// Groups resume from their committed offsets, independently of each other.
+func TestMemoryBrokerGroups(t *testing.T) {
+	b := newMemoryBroker(1)
+	for _, v := range []string{"a", "b", "c"} {
+		b.produce("t", nil, []byte(v), nil)
+	}
+	g := b.join("one", []string{"t"})
+	got := receive(t, g, 3)
+	g.Commit(got[1])
+	// committing an earlier record doesn't move the offset back
+	g.Commit(got[0])
+	g.Close()
+	if !g.Closed() {
+		t.Error("group not closed")
+	}
+
+	g = b.join("one", []string{"t"})
+	if got := receive(t, g, 1); "c" != string(got[0].Value) {
+		t.Errorf("resumed at %q, want \"c\"", got[0].Value)
+	}
+	b.produce("t", nil, []byte("d"), nil)
+	if got := receive(t, g, 1); "d" != string(got[0].Value) {
+		t.Errorf("got %q, want the new \"d\"", got[0].Value)
+	}
+	g.Close()
+
+	other := b.join("two", []string{"t"})
+	receive(t, other, 4)
+	other.Close()
+}
+
+// Over HTTP, records are committed as they are fetched.
+func TestMemoryBrokerFetch(t *testing.T) {
+	b := newMemoryBroker(2)
+	for _, v := range []string{"a", "b", "c"} {
+		b.produce("t", nil, []byte(v), nil)
+	}
+	if got := b.fetch("t", "g", 0, 2); 2 != len(got) {
+		t.Fatalf("fetched %d records, want 2", len(got))
+	}
+	if got := b.fetch("t", "g", 0, 10); 1 != len(got) {
+		t.Fatalf("fetched %d records, want the 1 left", len(got))
+	}
+	if got := b.fetch("t", "g", 0, 10); 0 != len(got) {
+		t.Fatalf("fetched %d records, want none", len(got))
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		b.produce("t", []byte("k"), []byte("d"), nil)
+	}()
+	got := b.fetch("t", "g", time.Second, 10)
+	if 1 != len(got) || "d" != got[0].Value || "k" != got[0].Key {
+		t.Errorf("fetched %+v while waiting, want the record produced", got)
+	}
+}
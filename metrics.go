@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Metrics are exposed on /metrics in the Prometheus text format. The gateway
+// only needs counters, gauges and histograms with a handful of labels, so they
+// are implemented here instead of pulling in the Prometheus client library.
+
+var defBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// How often the consumer lag is computed. Fetching the high water marks takes
+// a broker round trip per partition, too slow for every scrape.
+const lagInterval = 15 * time.Second
+
+// quantiles reported for the sarama histograms and timers
+var saramaQuantiles = []float64{0.5, 0.75, 0.95, 0.99}
+
+// saramaRegistry is handed to the producer and consumer configs so the
+// client-side Kafka metrics sarama collects end up on /metrics.
+var saramaRegistry = metrics.NewRegistry()
+
+var (
+	inboundMessages = newCounterVec("wsapigw_inbound_messages_total",
+		"Messages received from websocket clients and published to Kafka.", "route", "topic")
+	outboundMessages = newCounterVec("wsapigw_outbound_messages_total",
+		"Messages consumed from Kafka and written to websocket clients.", "route", "topic")
+	rejectedMessages = newCounterVec("wsapigw_rejected_messages_total",
+		"Client messages answered with an error frame instead of being published.", "route", "code")
+	publishErrors = newCounterVec("wsapigw_publish_errors_total",
+		"Failed Kafka publishes.", "topic")
+	droppedMessages = newCounterVec("wsapigw_dropped_messages_total",
+		"Messages the gateway gave up on.", "reason")
+	deadLettered = newCounterVec("wsapigw_dead_lettered_messages_total",
+		"Consumed messages forwarded to the dead letter topic.", "topic")
+	publishLatency = newHistogramVec("wsapigw_publish_latency_seconds",
+		"Time taken by a synchronous Kafka publish.", defBuckets, "topic")
+	droppedSpans = newCounterVec("wsapigw_dropped_spans_total",
+		"Trace spans dropped because the export queue was full or the export failed.")
+	deliveryLatency = newHistogramVec("wsapigw_delivery_latency_seconds",
+		"Time from a record's Kafka timestamp to its write on the websocket.", defBuckets, "route")
+)
+
+// reasons a message is counted in wsapigw_dropped_messages_total
+const (
+	dropBufferFull = "buffer_full"
+	dropDecode     = "decode_error"
+	dropNoClient   = "no_client"
+	dropMarshal    = "marshal_error"
+	// consumed record routed to a client but not written to its socket
+	dropUndelivered = "undelivered"
+	// message never acknowledged by an ack mode client, with no outbox
+	dropUnacked = "unacked"
+)
+
+type collector interface {
+	collect(w io.Writer)
+}
+
+var collectors []collector
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	if 0 == len(names) && 0 == len(extra) {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, n := range names {
+		pairs = append(pairs, n+"=\""+escapeLabel(values[i])+"\"")
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"=\""+escapeLabel(extra[i+1])+"\"")
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+	return strings.Replace(v, `"`, `\"`, -1)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name string, help string, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+	lvals  map[string][]string
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	c := &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+		lvals:  make(map[string][]string),
+	}
+	collectors = append(collectors, c)
+	return c
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+func (c *counterVec) add(v float64, values ...string) {
+	k := labelKey(values)
+	c.mu.Lock()
+	c.values[k] += v
+	c.lvals[k] = values
+	c.mu.Unlock()
+}
+
+func (c *counterVec) collect(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, c.lvals[k]), formatFloat(c.values[k]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+	lvals   map[string][]string
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+		lvals:   make(map[string][]string),
+	}
+	collectors = append(collectors, h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	k := labelKey(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist := h.values[k]
+	if nil == hist {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hist
+		h.lvals[k] = values
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) since(start time.Time, values ...string) {
+	h.observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *histogramVec) collect(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hist := h.values[k]
+		lv := h.lvals[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, lv, "le", formatFloat(b)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, lv, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, lv), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, lv), hist.count)
+	}
+}
+
+// collectClients reports the connected clients per client type.
+func (h *Hub) collectClients(w io.Writer) {
+	counts := make(map[string]int)
+	h.mu.RLock()
+	for _, c := range h.clients {
+		counts[c.Type]++
+	}
+	h.mu.RUnlock()
+	types := make([]string, 0, len(counts))
+	for t := range counts {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	writeHeader(w, "wsapigw_connected_clients", "Currently connected websocket clients.", "gauge")
+	for _, t := range types {
+		fmt.Fprintf(w, "wsapigw_connected_clients{type=\"%s\"} %d\n", escapeLabel(t), counts[t])
+	}
+}
+
+// markConsumed remembers the offset of the last record consumed from a
+// partition so the consumer lag can be computed.
+func (h *Hub) markConsumed(topic string, partition int32, offset int64) {
+	h.omu.Lock()
+	defer h.omu.Unlock()
+	if nil == h.offsets[topic] {
+		h.offsets[topic] = make(map[int32]int64)
+	}
+	h.offsets[topic][partition] = offset
+}
+
+type partitionLag struct {
+	topic     string
+	partition int32
+	lag       int64
+}
+
+// updateLag computes, per partition the gateway consumed from, how far the
+// last consumed offset trails the partition's high water mark.
+func (h *Hub) updateLag() {
+	type partOffset struct {
+		topic     string
+		partition int32
+		offset    int64
+	}
+	h.omu.Lock()
+	parts := make([]partOffset, 0)
+	for t, ps := range h.offsets {
+		for p, o := range ps {
+			parts = append(parts, partOffset{t, p, o})
+		}
+	}
+	h.omu.Unlock()
+	sort.Slice(parts, func(i, j int) bool {
+		if parts[i].topic != parts[j].topic {
+			return parts[i].topic < parts[j].topic
+		}
+		return parts[i].partition < parts[j].partition
+	})
+
+	var lags []partitionLag
+	if k := h.conn(); nil != k {
+		for _, p := range parts {
+			hwm, err := k.cluster.highWaterMark(p.topic, p.partition)
+			if errNoOffsets == err {
+				continue
+			}
+			if err != nil {
+				brokerLog.Warn("error fetching high water mark", "topic", p.topic, "partition", p.partition, "err", err)
+				continue
+			}
+			lag := hwm - p.offset - 1
+			if lag < 0 {
+				lag = 0
+			}
+			lags = append(lags, partitionLag{p.topic, p.partition, lag})
+		}
+	}
+	h.omu.Lock()
+	h.lag = lags
+	h.omu.Unlock()
+}
+
+// watchLag updates the consumer lag every lagInterval until the process exits.
+func watchLag(h *Hub) {
+	for {
+		h.updateLag()
+		time.Sleep(lagInterval)
+	}
+}
+
+// collectLag reports the consumer lag last computed by watchLag.
+func (h *Hub) collectLag(w io.Writer) {
+	h.omu.Lock()
+	lags := h.lag
+	h.omu.Unlock()
+	writeHeader(w, "wsapigw_consumer_lag", "Records between the last consumed offset and the high water mark.", "gauge")
+	for _, p := range lags {
+		fmt.Fprintf(w, "wsapigw_consumer_lag{topic=\"%s\",partition=\"%d\"} %d\n", escapeLabel(p.topic), p.partition, p.lag)
+	}
+}
+
+func saramaMetricName(name string) string {
+	return "sarama_" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || '_' == r {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// saramaLabel splits the broker or topic sarama bakes into the names of its
+// per-broker and per-topic metrics, like "request-rate-for-broker-1", off into
+// a label, so each metric is one family however many brokers there are.
+func saramaLabel(name string) (string, []string, []string) {
+	for _, l := range []string{"broker", "topic"} {
+		if i := strings.Index(name, "-for-"+l+"-"); i >= 0 {
+			return name[:i], []string{l}, []string{name[i+len("-for-"+l+"-"):]}
+		}
+	}
+	return name, nil, nil
+}
+
+// saramaMetric is one metric of a family, with the label split off its name.
+type saramaMetric struct {
+	lnames  []string
+	lvalues []string
+	m       interface{}
+}
+
+func (sm saramaMetric) labels(extra ...string) string {
+	return formatLabels(sm.lnames, sm.lvalues, extra...)
+}
+
+func writeGauges(w io.Writer, name string, sms []saramaMetric) {
+	writeHeader(w, name, "sarama metric", "gauge")
+	for _, sm := range sms {
+		var v string
+		switch m := sm.m.(type) {
+		case metrics.Counter:
+			v = strconv.FormatInt(m.Count(), 10)
+		case metrics.Gauge:
+			v = strconv.FormatInt(m.Value(), 10)
+		case metrics.GaugeFloat64:
+			v = formatFloat(m.Value())
+		default:
+			continue
+		}
+		fmt.Fprintf(w, "%s%s %s\n", name, sm.labels(), v)
+	}
+}
+
+func writeMeters(w io.Writer, name string, sms []saramaMetric) {
+	snaps := make([]metrics.Meter, len(sms))
+	for i, sm := range sms {
+		if m, ok := sm.m.(metrics.Meter); ok {
+			snaps[i] = m.Snapshot()
+		}
+	}
+	writeHeader(w, name+"_total", "sarama metric", "counter")
+	for i, s := range snaps {
+		if nil != s {
+			fmt.Fprintf(w, "%s_total%s %d\n", name, sms[i].labels(), s.Count())
+		}
+	}
+	writeHeader(w, name+"_rate1m", "sarama metric, one-minute rate", "gauge")
+	for i, s := range snaps {
+		if nil != s {
+			fmt.Fprintf(w, "%s_rate1m%s %s\n", name, sms[i].labels(), formatFloat(s.Rate1()))
+		}
+	}
+}
+
+func writeSummary(w io.Writer, name string, sms []saramaMetric) {
+	writeHeader(w, name, "sarama metric", "summary")
+	for _, sm := range sms {
+		var count, sum int64
+		var ps []float64
+		switch m := sm.m.(type) {
+		case metrics.Histogram:
+			s := m.Snapshot()
+			count, sum, ps = s.Count(), s.Sum(), s.Percentiles(saramaQuantiles)
+		case metrics.Timer:
+			s := m.Snapshot()
+			count, sum, ps = s.Count(), s.Sum(), s.Percentiles(saramaQuantiles)
+		default:
+			continue
+		}
+		for i, q := range saramaQuantiles {
+			fmt.Fprintf(w, "%s%s %s\n", name, sm.labels("quantile", formatFloat(q)), formatFloat(ps[i]))
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", name, sm.labels(), formatFloat(float64(sum)), name, sm.labels(), count)
+	}
+}
+
+// collectSarama bridges the go-metrics registry used by sarama.
+func collectSarama(w io.Writer, r metrics.Registry) {
+	families := make(map[string][]saramaMetric)
+	r.Each(func(n string, m interface{}) {
+		base, lnames, lvalues := saramaLabel(n)
+		name := saramaMetricName(base)
+		families[name] = append(families[name], saramaMetric{lnames, lvalues, m})
+	})
+	names := make([]string, 0, len(families))
+	for name, sms := range families {
+		names = append(names, name)
+		sort.Slice(sms, func(i, j int) bool { return labelKey(sms[i].lvalues) < labelKey(sms[j].lvalues) })
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sms := families[name]
+		switch sms[0].m.(type) {
+		case metrics.Counter, metrics.Gauge, metrics.GaugeFloat64:
+			writeGauges(w, name, sms)
+		case metrics.Meter:
+			writeMeters(w, name, sms)
+		case metrics.Histogram, metrics.Timer:
+			writeSummary(w, name, sms)
+		}
+	}
+}
+
+func serveMetrics(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.collect(bw)
+	}
+	hub.collectClients(bw)
+	hub.collectLag(bw)
+	collectSarama(bw, saramaRegistry)
+	bw.Flush()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func TestCollectSarama(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.GetOrRegisterMeter("request-rate-for-broker-2", r).Mark(3)
+	metrics.GetOrRegisterMeter("request-rate-for-broker-1", r).Mark(5)
+	metrics.GetOrRegisterMeter("request-rate", r).Mark(8)
+	metrics.GetOrRegisterHistogram("batch-size-for-topic-ledgertx_req", r, metrics.NewUniformSample(10)).Update(100)
+	metrics.GetOrRegisterCounter("requests-in-flight-for-broker-1", r).Inc(2)
+	var buf bytes.Buffer
+	collectSarama(&buf, r)
+	out := buf.String()
+
+	for _, want := range []string{
+		"# TYPE sarama_request_rate_total counter\n" +
+			"sarama_request_rate_total 8\n" +
+			"sarama_request_rate_total{broker=\"1\"} 5\n" +
+			"sarama_request_rate_total{broker=\"2\"} 3\n",
+		"sarama_request_rate_rate1m{broker=\"1\"} ",
+		"sarama_batch_size{topic=\"ledgertx_req\",quantile=\"0.5\"} 100\n",
+		"sarama_batch_size_count{topic=\"ledgertx_req\"} 1\n",
+		"# TYPE sarama_requests_in_flight gauge\nsarama_requests_in_flight{broker=\"1\"} 2\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if n := strings.Count(out, "# TYPE sarama_request_rate_total "); 1 != n {
+		t.Errorf("sarama_request_rate_total declared %d times, want once", n)
+	}
+	if strings.Contains(out, "for_broker") || strings.Contains(out, "for_topic") {
+		t.Errorf("broker or topic left in a metric name:\n%s", out)
+	}
+}
+
+// Scrapes report the lag computed last, without asking the brokers.
+func TestConsumerLag(t *testing.T) {
+	b := newMemoryBroker(1)
+	for i := 0; i < 5; i++ {
+		b.produce("employee.updates", nil, []byte("a"), nil)
+	}
+	h := newHub()
+	k := testConn(&commitRecorder{})
+	k.cluster = &memCluster{b}
+	h.broker = k
+	h.markConsumed("employee.updates", 0, 1)
+
+	lag := func() string {
+		var buf bytes.Buffer
+		h.collectLag(&buf)
+		return buf.String()
+	}
+	if out := lag(); strings.Contains(out, "wsapigw_consumer_lag{") {
+		t.Errorf("lag reported before it was computed:\n%s", out)
+	}
+	h.updateLag()
+	b.produce("employee.updates", nil, []byte("a"), nil)
+	if out := lag(); !strings.Contains(out, "wsapigw_consumer_lag{topic=\"employee.updates\",partition=\"0\"} 3\n") {
+		t.Errorf("lag 3 not reported:\n%s", out)
+	}
+	h.updateLag()
+	if out := lag(); !strings.Contains(out, "wsapigw_consumer_lag{topic=\"employee.updates\",partition=\"0\"} 4\n") {
+		t.Errorf("lag 4 not reported after the update:\n%s", out)
+	}
+}
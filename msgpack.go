@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/gorilla/websocket"
+)
+
+// MessagePack mirrors the JSON encoding: messages go through their JSON form,
+// so field names and omitted fields are the same in both codecs. Only maps,
+// arrays, strings, numbers, booleans and nil are produced; decoding accepts
+// every MessagePack type except extensions.
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (msgpackCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (msgpackCodec) Marshal(msg *ClientMessage) ([]byte, error) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := packValue(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, msg *ClientMessage) error {
+	u := unpacker{data: data}
+	v, err := u.value(0)
+	if err != nil {
+		return err
+	}
+	if u.pos != len(data) {
+		return errors.New("msgpack: trailing data")
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, msg)
+}
+
+func packValue(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); nil == err {
+			packInt(buf, i)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		packString(buf, v)
+	case []interface{}:
+		packLen(buf, len(v), 0x90, 15, 0xdc)
+		for _, e := range v {
+			if err := packValue(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		packLen(buf, len(keys), 0x80, 15, 0xde)
+		for _, k := range keys {
+			packString(buf, k)
+			if err := packValue(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: cannot encode %T", v)
+	}
+	return nil
+}
+
+func packInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= 0x7f:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func packString(buf *bytes.Buffer, s string) {
+	if len(s) <= 31 {
+		buf.WriteByte(0xa0 | byte(len(s)))
+	} else if len(s) <= math.MaxUint8 {
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(len(s)))
+	} else if len(s) <= math.MaxUint16 {
+		buf.WriteByte(0xda)
+		binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	} else {
+		buf.WriteByte(0xdb)
+		binary.Write(buf, binary.BigEndian, uint32(len(s)))
+	}
+	buf.WriteString(s)
+}
+
+// packLen writes an array or map header: the fix form for short lengths, else
+// the 16 or 32 bit form starting at code16.
+func packLen(buf *bytes.Buffer, n int, fix byte, fixMax int, code16 byte) {
+	switch {
+	case n <= fixMax:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(code16 + 1)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// nesting limit when decoding, to bound recursion on hostile input
+const msgpackMaxDepth = 64
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+type unpacker struct {
+	data []byte
+	pos  int
+}
+
+func (u *unpacker) next(n int) ([]byte, error) {
+	if n < 0 || len(u.data)-u.pos < n {
+		return nil, errMsgpackShort
+	}
+	b := u.data[u.pos : u.pos+n]
+	u.pos += n
+	return b, nil
+}
+
+func (u *unpacker) uint(n int) (uint64, error) {
+	b, err := u.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (u *unpacker) int(n int) (int64, error) {
+	v, err := u.uint(n)
+	if err != nil {
+		return 0, err
+	}
+	shift := uint(64 - 8*n)
+	return int64(v<<shift) >> shift, nil
+}
+
+func (u *unpacker) value(depth int) (interface{}, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errors.New("msgpack: nesting too deep")
+	}
+	b, err := u.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return u.mapOf(int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return u.arrayOf(int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return u.str(int(c & 0x1f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6: // bin 8/16/32, decoded as a string
+		n, err := u.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return u.str(int(n))
+	case 0xca:
+		v, err := u.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := u.uint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return u.uint(1 << (c - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		return u.int(1 << (c - 0xd0))
+	case 0xd9, 0xda, 0xdb:
+		n, err := u.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return u.str(int(n))
+	case 0xdc, 0xdd:
+		n, err := u.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return u.arrayOf(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := u.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return u.mapOf(int(n), depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type 0x%02x", c)
+}
+
+func (u *unpacker) str(n int) (string, error) {
+	b, err := u.next(n)
+	return string(b), err
+}
+
+func (u *unpacker) arrayOf(n int, depth int) (interface{}, error) {
+	if n > len(u.data)-u.pos {
+		return nil, errMsgpackShort
+	}
+	a := make([]interface{}, n)
+	for i := range a {
+		v, err := u.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		a[i] = v
+	}
+	return a, nil
+}
+
+func (u *unpacker) mapOf(n int, depth int) (interface{}, error) {
+	if n > len(u.data)-u.pos {
+		return nil, errMsgpackShort
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := u.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		ks, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key %v is not a string", k)
+		}
+		v, err := u.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		m[ks] = v
+	}
+	return m, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMsgpackMarshal(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		msg  *ClientMessage
+		want []byte
+	}{
+		{"empty", &ClientMessage{}, []byte{0x80}},
+		{"fixstr", &ClientMessage{CID: "a"}, []byte{0x81, 0xa3, 'C', 'I', 'D', 0xa1, 'a'}},
+		{"positive fixint", &ClientMessage{Seq: 127}, []byte{0x81, 0xa3, 'S', 'e', 'q', 0x7f}},
+		{"int16", &ClientMessage{Seq: 300}, []byte{0x81, 0xa3, 'S', 'e', 'q', 0xd1, 0x01, 0x2c}},
+		{"keys sorted", &ClientMessage{Type: "RA", CID: "a"},
+			[]byte{0x82, 0xa3, 'C', 'I', 'D', 0xa1, 'a', 0xa4, 'T', 'y', 'p', 'e', 0xa2, 'R', 'A'}},
+		{"str8", &ClientMessage{CID: strings.Repeat("x", 32)},
+			append([]byte{0x81, 0xa3, 'C', 'I', 'D', 0xd9, 32}, strings.Repeat("x", 32)...)},
+		{"array", &ClientMessage{Error: &ErrorInfo{Code: "c", Message: "", Fields: []string{"f"}}},
+			[]byte{0x81, 0xa5, 'E', 'r', 'r', 'o', 'r', 0x83,
+				0xa4, 'C', 'o', 'd', 'e', 0xa1, 'c',
+				0xa6, 'F', 'i', 'e', 'l', 'd', 's', 0x91, 0xa1, 'f',
+				0xa7, 'M', 'e', 's', 's', 'a', 'g', 'e', 0xa0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := msgpackCodec{}.Marshal(tc.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("got % x, want % x", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMsgpackUnmarshal(t *testing.T) {
+	cid := []byte{0xa3, 'C', 'I', 'D'}
+	seq := []byte{0xa3, 'S', 'e', 'q'}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	deep := append(bytes.Repeat([]byte{0x91}, msgpackMaxDepth+1), 0xc0)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want *ClientMessage
+		err  string
+	}{
+		{"bin8 as a string", join([]byte{0x81}, cid, []byte{0xc4, 1, 'x'}), &ClientMessage{CID: "x"}, ""},
+		{"str16", join([]byte{0x81}, cid, []byte{0xda, 0, 1, 'x'}), &ClientMessage{CID: "x"}, ""},
+		{"map16", join([]byte{0xde, 0, 1}, cid, []byte{0xa1, 'x'}), &ClientMessage{CID: "x"}, ""},
+		{"uint32", join([]byte{0x81}, seq, []byte{0xce, 0, 1, 0, 0}), &ClientMessage{Seq: 65536}, ""},
+		{"nil field", join([]byte{0x81}, cid, []byte{0xc0}), &ClientMessage{}, ""},
+		{"unknown field", join([]byte{0x81, 0xa1, 'X', 0xc3}), &ClientMessage{}, ""},
+		{"empty", nil, nil, "unexpected end"},
+		{"truncated string", join([]byte{0x81}, cid, []byte{0xa3, 'x'}), nil, "unexpected end"},
+		{"array longer than the data", join([]byte{0x81}, cid, []byte{0xdd, 0xff, 0xff, 0xff, 0xff}), nil, "unexpected end"},
+		{"trailing data", []byte{0x80, 0x80}, nil, "trailing data"},
+		{"non-string key", []byte{0x81, 0x01, 0x01}, nil, "not a string"},
+		{"extension", []byte{0xd4, 0x01, 0x01}, nil, "unsupported type 0xd4"},
+		{"too deep", deep, nil, "nesting too deep"},
+		{"wrong type", join([]byte{0x81}, seq, []byte{0xa1, 'x'}), nil, "cannot unmarshal"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := &ClientMessage{}
+			err := msgpackCodec{}.Unmarshal(tc.data, got)
+			if "" != tc.err {
+				if nil == err || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
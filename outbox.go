@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The outbox keeps consumed messages that could not be delivered until their
+// recipient connects: messages addressed to an authenticated user whose
+// connection is gone are kept for that user (see auth.go), messages fanned out
+// by client type for that type. Stored messages are sent when a matching
+// client connects, and stay stored, to be sent again on the next connect,
+// until a client acknowledges them with {"Ack": "<RecordID>"} or their TTL
+// runs out.
+//
+// The "kafka" store writes entries to a compacted topic keyed by recipient and
+// record, removing them with tombstones, and rebuilds its index from the topic
+// after every (re)connect. The "memory" store loses its entries on restart.
+
+const (
+	defaultOutboxTopic = "wsapigw.outbox"
+	defaultOutboxTTL   = 7 * 24 * time.Hour
+	outboxSweepPeriod  = time.Minute
+
+	// the user of a disconnected client is remembered this long so replies
+	// addressed to its CID can be kept for the user
+	goneUserTTL = 10 * time.Minute
+)
+
+type OutboxConfig struct {
+	Store string `json:"store,omitempty"` // "" (disabled), "kafka" or "memory"
+	Topic string `json:"topic,omitempty"` // compacted topic of the kafka store
+	TTL   int    `json:"ttl,omitempty"`   // seconds
+}
+
+var (
+	outboxStored = newCounterVec("wsapigw_outbox_stored_total",
+		"Undeliverable messages kept in the outbox.", "recipient_kind")
+	outboxSent = newCounterVec("wsapigw_outbox_sent_total",
+		"Outbox messages sent to connecting clients.", "route")
+	outboxAcked = newCounterVec("wsapigw_outbox_acked_total",
+		"Outbox messages removed after a client acknowledged them.", "route")
+	outboxExpired = newCounterVec("wsapigw_outbox_expired_total",
+		"Outbox messages removed when their TTL ran out.")
+)
+
+type OutboxEntry struct {
+	Recipient string         `json:"Recipient"` // "user:<name>" or "type:<client type>"
+	ID        string         `json:"ID"`        // RecordID of the message
+	Stored    time.Time      `json:"Stored"`
+	Expires   time.Time      `json:"Expires"`
+	Message   *ClientMessage `json:"Message"`
+}
+
+// An Outbox stores undelivered messages per recipient.
+type Outbox interface {
+	Put(e *OutboxEntry) error
+	Remove(recipient string, id string) error
+	// Pending returns the unexpired entries of a recipient, oldest first.
+	Pending(recipient string) []*OutboxEntry
+	// Expire removes and returns the entries whose TTL ran out.
+	Expire(now time.Time) []*OutboxEntry
+}
+
+var (
+	outbox    Outbox // nil when disabled
+	outboxTTL = defaultOutboxTTL
+)
+
+func initOutbox(h *Hub, c OutboxConfig) {
+	if 0 != c.TTL {
+		outboxTTL = time.Duration(c.TTL) * time.Second
+	}
+	switch c.Store {
+	case "":
+		return
+	case "memory":
+		outbox = newMemoryOutbox()
+	case "kafka":
+		topic := c.Topic
+		if "" == topic {
+			topic = defaultOutboxTopic
+		}
+		outbox = &kafkaOutbox{memoryOutbox: newMemoryOutbox(), h: h, topic: topic}
+	default:
+		rootLog.Error("unknown outbox store, outbox disabled", "store", c.Store)
+		return
+	}
+	go sweepOutbox()
+	collectors = append(collectors, outboxGauge{})
+	rootLog.Info("outbox enabled", "store", c.Store, "ttl", outboxTTL.String())
+}
+
+func sweepOutbox() {
+	for now := range time.Tick(outboxSweepPeriod) {
+		if n := len(outbox.Expire(now)); 0 != n {
+			outboxExpired.add(float64(n))
+		}
+	}
+}
+
+type memoryOutbox struct {
+	mu      sync.Mutex
+	entries map[string]map[string]*OutboxEntry
+}
+
+func newMemoryOutbox() *memoryOutbox {
+	return &memoryOutbox{entries: make(map[string]map[string]*OutboxEntry)}
+}
+
+func (o *memoryOutbox) Put(e *OutboxEntry) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if nil == o.entries[e.Recipient] {
+		o.entries[e.Recipient] = make(map[string]*OutboxEntry)
+	}
+	o.entries[e.Recipient][e.ID] = e
+	return nil
+}
+
+func (o *memoryOutbox) Remove(recipient string, id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if es := o.entries[recipient]; nil != es {
+		delete(es, id)
+		if 0 == len(es) {
+			delete(o.entries, recipient)
+		}
+	}
+	return nil
+}
+
+func (o *memoryOutbox) Pending(recipient string) []*OutboxEntry {
+	now := time.Now()
+	o.mu.Lock()
+	pending := make([]*OutboxEntry, 0, len(o.entries[recipient]))
+	for _, e := range o.entries[recipient] {
+		if now.Before(e.Expires) {
+			pending = append(pending, e)
+		}
+	}
+	o.mu.Unlock()
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Stored.Before(pending[j].Stored) })
+	return pending
+}
+
+func (o *memoryOutbox) Expire(now time.Time) []*OutboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var expired []*OutboxEntry
+	for r, es := range o.entries {
+		for id, e := range es {
+			if !now.Before(e.Expires) {
+				expired = append(expired, e)
+				delete(es, id)
+			}
+		}
+		if 0 == len(es) {
+			delete(o.entries, r)
+		}
+	}
+	return expired
+}
+
+func (o *memoryOutbox) size() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := 0
+	for _, es := range o.entries {
+		n += len(es)
+	}
+	return n
+}
+
+func (o *memoryOutbox) reset() {
+	o.mu.Lock()
+	o.entries = make(map[string]map[string]*OutboxEntry)
+	o.mu.Unlock()
+}
+
+// kafkaOutbox writes through to a compacted topic; its memoryOutbox is the
+// index that is read.
+type kafkaOutbox struct {
+	*memoryOutbox
+	h     *Hub
+	topic string
+}
+
+func outboxKey(recipient string, id string) []byte {
+	return []byte(recipient + "\n" + id)
+}
+
+func (o *kafkaOutbox) Put(e *OutboxEntry) error {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := o.h.publishRecord(outboxKey(e.Recipient, e.ID), value, o.topic); err != nil {
+		return err
+	}
+	return o.memoryOutbox.Put(e)
+}
+
+func (o *kafkaOutbox) Remove(recipient string, id string) error {
+	if err := o.h.publishRecord(outboxKey(recipient, id), nil, o.topic); err != nil {
+		return err
+	}
+	return o.memoryOutbox.Remove(recipient, id)
+}
+
+func (o *kafkaOutbox) Expire(now time.Time) []*OutboxEntry {
+	expired := o.memoryOutbox.Expire(now)
+	for _, e := range expired {
+		// the index already dropped it; a failed tombstone only leaves an
+		// expired record to be skipped on the next load
+		o.h.publishRecord(outboxKey(e.Recipient, e.ID), nil, o.topic)
+	}
+	return expired
+}
+
+// load rebuilds the index from the topic and then follows it, so entries
+// written by other gateway instances are seen too, until k fails.
+func (o *kafkaOutbox) load(k *brokerConn) {
+	o.reset()
+	brokerLog.Info("loading outbox", "topic", o.topic)
+	if err := k.cluster.readTopic(o.topic, k.dead, o.apply); err != nil {
+		brokerLog.Error("error loading outbox", "topic", o.topic, "err", err)
+	}
+}
+
+func (o *kafkaOutbox) apply(msg *Record) {
+	key := strings.SplitN(string(msg.Key), "\n", 2)
+	if 2 != len(key) {
+		return
+	}
+	if nil == msg.Value {
+		o.memoryOutbox.Remove(key[0], key[1])
+		return
+	}
+	e := &OutboxEntry{}
+	if err := json.Unmarshal(msg.Value, e); err != nil || nil == e.Message {
+		brokerLog.Warn("skipping undecodable outbox record", "partition", msg.Partition, "offset", msg.Offset, "err", err)
+		return
+	}
+	if time.Now().Before(e.Expires) {
+		o.memoryOutbox.Put(e)
+	}
+}
+
+type outboxGauge struct{}
+
+func (outboxGauge) collect(w io.Writer) {
+	n := 0
+	switch o := outbox.(type) {
+	case *memoryOutbox:
+		n = o.size()
+	case *kafkaOutbox:
+		n = o.size()
+	}
+	writeHeader(w, "wsapigw_outbox_pending", "Messages waiting in the outbox.", "gauge")
+	fmt.Fprintf(w, "wsapigw_outbox_pending %d\n", n)
+}
+
+// publishRecord publishes a keyed record, or a tombstone when value is nil.
+func (h *Hub) publishRecord(key []byte, value []byte, topic string) error {
+	h.bmu.RLock()
+	defer h.bmu.RUnlock()
+	if nil == h.broker {
+		return errBrokerUnavailable
+	}
+	err := h.broker.pub.Publish(&Record{Topic: topic, Key: key, Value: value})
+	h.health.producerResult(err)
+	if err != nil {
+		publishErrors.inc(topic)
+		if fatalProducerError(err) {
+			h.broker.fail(err)
+		}
+	}
+	return err
+}
+
+// recipients returns the outbox recipients a client receives messages for.
+func (h *Hub) recipients(c *Client) []string {
+	r := []string{"type:" + c.Type}
+	if user := h.user(c); "" != user {
+		r = append(r, "user:"+user)
+	}
+	return r
+}
+
+// recipientOf returns the outbox recipient to keep msg for when it could not
+// be written to c: the user for messages addressed to the client, its type
+// for fanned out ones. Messages addressed to an anonymous client are not kept.
+func (h *Hub) recipientOf(c *Client, msg *ClientMessage) string {
+	if c.cid == msg.CID {
+		if user := h.user(c); "" != user {
+			return "user:" + user
+		}
+		return ""
+	}
+	return "type:" + c.Type
+}
+
+// stash keeps msg for recipient, reporting whether it was stored.
+func stash(msg *ClientMessage, recipient string) bool {
+	if nil == outbox || "" == recipient || "" == msg.RecordID {
+		return false
+	}
+	// the copy is not tied to the delivery of the consumed record
+	kept := *msg
+	kept.d = nil
+	now := time.Now()
+	err := outbox.Put(&OutboxEntry{
+		Recipient: recipient,
+		ID:        msg.RecordID,
+		Stored:    now,
+		Expires:   now.Add(outboxTTL),
+		Message:   &kept,
+	})
+	if err != nil {
+		hubLog.Warn("error storing message in outbox", "recipient", recipient, "record", msg.RecordID, "err", err)
+		return false
+	}
+	outboxStored.inc(strings.SplitN(recipient, ":", 2)[0])
+	hubLog.Debug("message kept in outbox", "recipient", recipient, "record", msg.RecordID)
+	return true
+}
+
+// sendPending queues the messages kept for recipient on the client.
+func (h *Hub) sendPending(c *Client, recipient string) {
+	if nil == outbox {
+		return
+	}
+	for _, e := range outbox.Pending(recipient) {
+		msg := *e.Message
+		// the record's delivery completed when it was stored; this one
+		// stays in the outbox until acknowledged
+		msg.d = nil
+		msg.outboxed = true
+		h.deliver(c, &msg)
+		outboxSent.inc(c.route)
+	}
+}
+
+// ack removes an acknowledged message from the client's outboxes.
+func (h *Hub) ack(c *Client, id string) {
+	if nil == outbox {
+		return
+	}
+	for _, r := range h.recipients(c) {
+		if err := outbox.Remove(r, id); err != nil {
+			hubLog.Warn("error removing message from outbox", "recipient", r, "record", id, "err", err)
+			continue
+		}
+	}
+	outboxAcked.inc(c.route)
+}
+
+// goneUsers remembers the users of recently disconnected clients.
+type goneUsers struct {
+	mu    sync.Mutex
+	users map[string]string // cid -> user
+	order []goneUser
+}
+
+type goneUser struct {
+	cid  string
+	gone time.Time
+}
+
+var gone = &goneUsers{users: make(map[string]string)}
+
+func (g *goneUsers) add(cid string, user string) {
+	if "" == user {
+		return
+	}
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	i := 0
+	for ; i < len(g.order) && now.Sub(g.order[i].gone) > goneUserTTL; i++ {
+		delete(g.users, g.order[i].cid)
+	}
+	g.order = append(g.order[i:], goneUser{cid, now})
+	g.users[cid] = user
+}
+
+func (g *goneUsers) user(cid string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.users[cid]
+}
+
+// undeliveredRecipient returns the outbox recipient of a consumed message no
+// connected client matched, or "" when it has none. Replies to a CID are
+// kept for the user of the gone client, if it was known.
+func undeliveredRecipient(msg *ClientMessage) string {
+	switch {
+	case "" != msg.CID:
+		if user := gone.user(msg.CID); "" != user {
+			return "user:" + user
+		}
+	case nil != msg.Payload.Employee:
+		return "type:" + msg.Payload.Employee.FPInfo.FPCode
+	case "" != msg.Type:
+		return "type:" + msg.Type
+	}
+	return ""
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// nopTransport is a transport that drops what is written to it.
+type nopTransport struct{}
+
+func (nopTransport) name() string             { return "test" }
+func (nopTransport) write(frame []byte) error { return nil }
+func (nopTransport) keepalive() time.Duration { return 0 }
+func (nopTransport) ping() error              { return nil }
+func (nopTransport) close(reason string)      {}
+
+func testClient(h *Hub, cid string, ctype string) *Client {
+	return &Client{
+		hub:   h,
+		t:     nopTransport{},
+		send:  make(chan *ClientMessage, sendBufferSize),
+		done:  make(chan struct{}),
+		cid:   cid,
+		Type:  ctype,
+		route: "/" + ctype,
+	}
+}
+
+// commitRecorder is a Subscriber recording what is committed.
+type commitRecorder struct {
+	mu        sync.Mutex
+	committed []int64
+}
+
+func (s *commitRecorder) Records() <-chan *Record { return nil }
+func (s *commitRecorder) Errors() <-chan error    { return nil }
+func (s *commitRecorder) Closed() bool            { return false }
+func (s *commitRecorder) Close() error            { return nil }
+
+func (s *commitRecorder) Commit(r *Record) error {
+	s.mu.Lock()
+	s.committed = append(s.committed, r.Offset)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *commitRecorder) offsets() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.committed...)
+}
+
+func testConn(sub Subscriber) *brokerConn {
+	return &brokerConn{sub: sub, dead: make(chan struct{}), commits: make(map[partitionKey]*partitionCommits)}
+}
+
+func withOutbox(t *testing.T) *memoryOutbox {
+	o := newMemoryOutbox()
+	outbox = o
+	t.Cleanup(func() { outbox = nil })
+	return o
+}
+
+// A stored message redelivered to a client that then disconnects stays in
+// the outbox as it was, and leaves the delivery of its record alone.
+func TestOutboxRedeliveryDisconnect(t *testing.T) {
+	o := withOutbox(t)
+	h := newHub()
+	sub := &commitRecorder{}
+	k := testConn(sub)
+
+	// the record is consumed and routed to an FPA client that goes away
+	record := &Record{Topic: "employee.updates", Offset: 7}
+	d := k.track(h, record, &ConsumerMessage{Topic: record.Topic, Offset: record.Offset})
+	block := "block-7"
+	d.out = &ClientMessage{Payload: &Payload{Block: &block}, RecordID: "employee.updates/0/7", d: d}
+	first := testClient(h, "c1", "FPA")
+	h.deliver(first, d.out)
+	first.drain()
+	d.finish()
+
+	pending := o.Pending("type:FPA")
+	if 1 != len(pending) {
+		t.Fatalf("outbox holds %d messages for FPA, want 1", len(pending))
+	}
+	if nil != pending[0].Message.d {
+		t.Fatal("stored message is tied to the record's delivery")
+	}
+	expires := pending[0].Expires
+	if got := sub.offsets(); 1 != len(got) || 7 != got[0] {
+		t.Fatalf("committed %v, want [7]", got)
+	}
+
+	// a second FPA client gets it and disconnects before it is written
+	second := testClient(h, "c2", "FPA")
+	h.sendPending(second, "type:FPA")
+	second.drain()
+
+	if got := sub.offsets(); 1 != len(got) {
+		t.Errorf("committed %v after the redelivery failed, want [7]", got)
+	}
+	if n := len(d.failed); 1 != n {
+		t.Errorf("delivery has %d failed clients, want 1", n)
+	}
+	pending = o.Pending("type:FPA")
+	if 1 != len(pending) {
+		t.Fatalf("outbox holds %d messages for FPA, want 1", len(pending))
+	}
+	if !pending[0].Expires.Equal(expires) {
+		t.Errorf("outbox entry expires %v, was %v", pending[0].Expires, expires)
+	}
+}
+
+// An unacknowledged outbox message is still stored, not failed again.
+func TestOutboxRedeliveryUnacked(t *testing.T) {
+	o := withOutbox(t)
+	h := newHub()
+	block := "block-8"
+	if !stash(&ClientMessage{Payload: &Payload{Block: &block}, RecordID: "new.block.created/0/8"}, "type:RA") {
+		t.Fatal("message not stored")
+	}
+	c := testClient(h, "c1", "RA")
+	h.sendPending(c, "type:RA")
+	msg := <-c.send
+	if nil != msg.d || !msg.outboxed {
+		t.Fatalf("redelivered message: d %v, outboxed %v; want no delivery, outboxed", msg.d, msg.outboxed)
+	}
+	c.undelivered(msg, "expired")
+	if 1 != len(o.Pending("type:RA")) {
+		t.Error("unacknowledged outbox message was removed")
+	}
+}
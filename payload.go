@@ -1,85 +1,86 @@
 package main
 
 type Approval struct {
-	Status string `json:"Status"`
-	Date   string `json:"Date,omitempty"`
+	Status string `json:"Status" proto:"1"`
+	Date   string `json:"Date,omitempty" proto:"2"`
 }
 
 type Approvals struct {
-	RAApproval Approval `json:"RAApproval,omitempty"`
-	FPApproval Approval `json:"FPApproval,omitempty"`
+	RAApproval Approval `json:"RAApproval,omitempty" proto:"1"`
+	FPApproval Approval `json:"FPApproval,omitempty" proto:"2"`
 }
 
 type FPInfo struct {
-	FPName       string `json:"FPName"`
-	FPCode       string `json:"FPCode"`
-	FPProgram    string `json:"FPProgram"`
-	CurrInvstAmt string `json:"CurrInvstAmt,omitempty"`
-	Currency     string `json:"Currency,omitempty"`
+	FPName       string `json:"FPName" proto:"1"`
+	FPCode       string `json:"FPCode" proto:"2"`
+	FPProgram    string `json:"FPProgram" proto:"3"`
+	CurrInvstAmt string `json:"CurrInvstAmt,omitempty" proto:"4"`
+	Currency     string `json:"Currency,omitempty" proto:"5"`
 }
 
 type EmpData struct {
-	ID         string `json:"ID"`
-	FirstName  string `json:"FirstName"`
-	MiddleName string `json:"MiddleName"`
-	LastName   string `json:"LastName"`
-	Birthday   string `json:"Birthday"`
-	Age        string `json:"Age"`
-	Address    string `json:"Address"`
-	Email      string `json:"Email"`
-	ContactNo  string `json:"ContactNo"`
-	TaxID      string `json:"TaxID"`
-	Employer   string `json:"Employer"`
+	ID         string `json:"ID" proto:"1"`
+	FirstName  string `json:"FirstName" proto:"2"`
+	MiddleName string `json:"MiddleName" proto:"3"`
+	LastName   string `json:"LastName" proto:"4"`
+	Birthday   string `json:"Birthday" proto:"5"`
+	Age        string `json:"Age" proto:"6"`
+	Address    string `json:"Address" proto:"7"`
+	Email      string `json:"Email" proto:"8"`
+	ContactNo  string `json:"ContactNo" proto:"9"`
+	TaxID      string `json:"TaxID" proto:"10"`
+	Employer   string `json:"Employer" proto:"11"`
 }
 
 //Private Data
 type Employee struct {
-	ObjectType       string    `json:"docType"`
-	TxID             string    `json:"TxID"` //most recent Transaction ID
-	EmployeeData     EmpData   `json:"EmployeeData"`
-	FPInfo           FPInfo    `json:"FPInfo"`
-	EnrollmentStatus string    `json:"EnrollmentStatus"`
-	NewFPInfo        FPInfo    `json:"NewFPInfo,omitempty"`
-	Approvals        Approvals `json:"Approvals,omitempty"`
+	ObjectType       string    `json:"docType" proto:"1"`
+	TxID             string    `json:"TxID" proto:"2"` //most recent Transaction ID
+	EmployeeData     EmpData   `json:"EmployeeData" proto:"3"`
+	FPInfo           FPInfo    `json:"FPInfo" proto:"4"`
+	EnrollmentStatus string    `json:"EnrollmentStatus" proto:"5"`
+	NewFPInfo        FPInfo    `json:"NewFPInfo,omitempty" proto:"6"`
+	Approvals        Approvals `json:"Approvals,omitempty" proto:"7"`
 }
 
 //Payload from UI
 type EnrollmentReq struct {
-	EmployeeData EmpData `json:"EmployeeData"`
-	FPInfo       FPInfo  `json:"FPInfo"`
+	EmployeeData EmpData `json:"EmployeeData" proto:"1"`
+	FPInfo       FPInfo  `json:"FPInfo" proto:"2"`
 }
 
 //Private Data
 //Payload to/from UI
 type EnrollmentApproval struct {
-	EmployeeData EmpData   `json:"EmployeeData,omitempty"`
-	FPInfo       FPInfo    `json:"FPInfo,omitempty"`
-	Approvals    Approvals `json:"Approvals"`
+	EmployeeData EmpData   `json:"EmployeeData,omitempty" proto:"1"`
+	FPInfo       FPInfo    `json:"FPInfo,omitempty" proto:"2"`
+	Approvals    Approvals `json:"Approvals" proto:"3"`
 }
 
 //Payload from UI
 type ChangeFPReq struct {
-	EmpID      string `json:"EmpID"`
-	CurrFPCode string `json:"CurrFPCode"`
-	NewFPInfo  FPInfo `json:"NewFPInfo"`
+	EmpID      string `json:"EmpID" proto:"1"`
+	CurrFPCode string `json:"CurrFPCode" proto:"2"`
+	NewFPInfo  FPInfo `json:"NewFPInfo" proto:"3"`
 }
 
 //Private Data
 //Payload to/from UI
 type ChangeFPApproval struct {
-	EmployeeData string    `json:"EmployeeData"`
-	FPInfo       FPInfo    `json:"FPInfo"`
-	NewFPInfo    FPInfo    `json:"NewFPInfo"`
-	Approvals    Approvals `json:"Approvals"`
+	EmployeeData string    `json:"EmployeeData" proto:"1"`
+	FPInfo       FPInfo    `json:"FPInfo" proto:"2"`
+	NewFPInfo    FPInfo    `json:"NewFPInfo" proto:"3"`
+	Approvals    Approvals `json:"Approvals" proto:"4"`
 }
 
 //Payload contents
 type Payload struct {
-	EnrollmentReq      *EnrollmentReq      `json:"EnrollmentReq,omitempty"`
-	EnrollmentApproval *EnrollmentApproval `json:"EnrollmentApproval,omitempty"`
-	ChangeFPReq        *ChangeFPReq        `json:"ChangeFPReq,omitempty"`
-	ChangeFPApproval   *ChangeFPApproval   `json:"ChangeFPApproval,omitempty"`
-	Employee           *Employee           `json:"Employee,omitempty"`
-	Block              *string             `json:"Block,omitempty"`
-	Employees          *[]Employee         `json:"Employees,omitempty"`
+	EnrollmentReq      *EnrollmentReq      `json:"EnrollmentReq,omitempty" proto:"1"`
+	EnrollmentApproval *EnrollmentApproval `json:"EnrollmentApproval,omitempty" proto:"2"`
+	ChangeFPReq        *ChangeFPReq        `json:"ChangeFPReq,omitempty" proto:"3"`
+	ChangeFPApproval   *ChangeFPApproval   `json:"ChangeFPApproval,omitempty" proto:"4"`
+	Employee           *Employee           `json:"Employee,omitempty" proto:"5"`
+	Block              *string             `json:"Block,omitempty" proto:"6"`
+	Employees          *[]Employee         `json:"Employees,omitempty" proto:"7"`
+	Notice             *string             `json:"Notice,omitempty" proto:"8"`
 }
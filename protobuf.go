@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Protobuf encodes messages by the proto:"N" field numbers of the Go structs,
+// following the schema in wsapigw.proto. Every field is a string, a uint64, a
+// message or a repeated string or message, so only the varint and
+// length-delimited wire types are written. Unknown fields are skipped when
+// decoding.
+
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string { return "protobuf" }
+
+func (protobufCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (protobufCodec) Marshal(msg *ClientMessage) ([]byte, error) {
+	return protoEncode(nil, reflect.ValueOf(msg).Elem())
+}
+
+func (protobufCodec) Unmarshal(data []byte, msg *ClientMessage) error {
+	return protoDecode(data, reflect.ValueOf(msg).Elem(), 0)
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+const protoMaxDepth = 64
+
+var errProtoShort = errors.New("protobuf: unexpected end of data")
+
+type protoField struct {
+	num   uint64
+	index int
+}
+
+var protoFields sync.Map // reflect.Type -> []protoField
+
+// fieldsOf returns the numbered fields of a struct type.
+func fieldsOf(t reflect.Type) []protoField {
+	if f, ok := protoFields.Load(t); ok {
+		return f.([]protoField)
+	}
+	var fields []protoField
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("proto")
+		if "" == tag {
+			continue
+		}
+		n, err := strconv.ParseUint(tag, 10, 32)
+		if err != nil {
+			panic("bad proto tag on " + t.Name() + "." + t.Field(i).Name)
+		}
+		fields = append(fields, protoField{n, i})
+	}
+	protoFields.Store(t, fields)
+	return fields
+}
+
+func appendBytes(b []byte, num uint64, data []byte) []byte {
+	b = binary.AppendUvarint(b, num<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func protoEncode(b []byte, v reflect.Value) ([]byte, error) {
+	for _, f := range fieldsOf(v.Type()) {
+		fv := v.Field(f.index)
+		var err error
+		if b, err = protoEncodeField(b, f.num, fv); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func protoEncodeField(b []byte, num uint64, fv reflect.Value) ([]byte, error) {
+	switch fv.Kind() {
+	case reflect.String:
+		// proto3 scalars: the empty string is not written
+		if "" != fv.String() {
+			b = appendBytes(b, num, []byte(fv.String()))
+		}
+	case reflect.Uint64:
+		if 0 != fv.Uint() {
+			b = binary.AppendUvarint(b, num<<3|wireVarint)
+			b = binary.AppendUvarint(b, fv.Uint())
+		}
+	case reflect.Struct:
+		sub, err := protoEncode(nil, fv)
+		if err != nil {
+			return nil, err
+		}
+		if 0 != len(sub) {
+			b = appendBytes(b, num, sub)
+		}
+	case reflect.Ptr:
+		if fv.IsNil() {
+			return b, nil
+		}
+		e := fv.Elem()
+		switch e.Kind() {
+		case reflect.String:
+			// optional string: presence is kept even when empty
+			b = appendBytes(b, num, []byte(e.String()))
+		case reflect.Struct:
+			sub, err := protoEncode(nil, e)
+			if err != nil {
+				return nil, err
+			}
+			b = appendBytes(b, num, sub)
+		case reflect.Slice:
+			return protoEncodeField(b, num, e)
+		default:
+			return nil, fmt.Errorf("protobuf: cannot encode %s", fv.Type())
+		}
+	case reflect.Slice:
+		for i := 0; i < fv.Len(); i++ {
+			e := fv.Index(i)
+			switch e.Kind() {
+			case reflect.String:
+				b = appendBytes(b, num, []byte(e.String()))
+			case reflect.Struct:
+				sub, err := protoEncode(nil, e)
+				if err != nil {
+					return nil, err
+				}
+				b = appendBytes(b, num, sub)
+			default:
+				return nil, fmt.Errorf("protobuf: cannot encode %s", fv.Type())
+			}
+		}
+	default:
+		return nil, fmt.Errorf("protobuf: cannot encode %s", fv.Type())
+	}
+	return b, nil
+}
+
+func protoDecode(data []byte, v reflect.Value, depth int) error {
+	if depth > protoMaxDepth {
+		return errors.New("protobuf: nesting too deep")
+	}
+	fields := fieldsOf(v.Type())
+	for 0 != len(data) {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errProtoShort
+		}
+		data = data[n:]
+		num, wire := key>>3, key&7
+		var payload []byte
+		var varint uint64
+		switch wire {
+		case wireVarint:
+			if varint, n = binary.Uvarint(data); n <= 0 {
+				return errProtoShort
+			}
+			data = data[n:]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if wireFixed32 == wire {
+				size = 4
+			}
+			if len(data) < size {
+				return errProtoShort
+			}
+			data = data[size:]
+		case wireBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return errProtoShort
+			}
+			payload = data[n : n+int(l)]
+			data = data[n+int(l):]
+		default:
+			return fmt.Errorf("protobuf: unsupported wire type %d", wire)
+		}
+		fi := -1
+		for _, f := range fields {
+			if f.num == num {
+				fi = f.index
+				break
+			}
+		}
+		if fi < 0 {
+			continue
+		}
+		if wireVarint == wire && reflect.Uint64 == v.Field(fi).Kind() {
+			v.Field(fi).SetUint(varint)
+			continue
+		}
+		if wireBytes != wire {
+			return fmt.Errorf("protobuf: field %d has wire type %d", num, wire)
+		}
+		if err := protoDecodeField(payload, v.Field(fi), depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func protoDecodeField(data []byte, fv reflect.Value, depth int) error {
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(string(data))
+	case reflect.Struct:
+		// a message field may be split across several occurrences, which merge
+		return protoDecode(data, fv, depth+1)
+	case reflect.Ptr:
+		if fv.IsNil() {
+			fv.Set(reflect.New(fv.Type().Elem()))
+		}
+		return protoDecodeField(data, fv.Elem(), depth)
+	case reflect.Slice:
+		e := reflect.New(fv.Type().Elem()).Elem()
+		if err := protoDecodeField(data, e, depth); err != nil {
+			return err
+		}
+		fv.Set(reflect.Append(fv, e))
+	default:
+		return fmt.Errorf("protobuf: cannot decode into %s", fv.Type())
+	}
+	return nil
+}
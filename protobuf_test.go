@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProtobufMarshal(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		msg  *ClientMessage
+		want []byte
+	}{
+		{"empty", &ClientMessage{}, nil},
+		{"string", &ClientMessage{CID: "a"}, []byte{0x0a, 0x01, 'a'}},
+		{"varint", &ClientMessage{Seq: 300}, []byte{0x60, 0xac, 0x02}},
+		{"message", &ClientMessage{Payload: &Payload{Block: strp("b")}}, []byte{0x2a, 0x03, 0x32, 0x01, 'b'}},
+		{"empty message", &ClientMessage{Payload: &Payload{}}, []byte{0x2a, 0x00}},
+		{"repeated string", &ClientMessage{Error: &ErrorInfo{Fields: []string{"x", "y"}}},
+			[]byte{0x3a, 0x06, 0x1a, 0x01, 'x', 0x1a, 0x01, 'y'}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := protobufCodec{}.Marshal(tc.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("got % x, want % x", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestProtobufUnmarshal(t *testing.T) {
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	cid := []byte{0x0a, 0x01, 'a'}
+	// two occurrences of Payload, each setting one field of EnrollmentReq.EmployeeData
+	split := join(
+		[]byte{0x2a, 0x07, 0x0a, 0x05, 0x0a, 0x03, 0x0a, 0x01, '1'},
+		[]byte{0x2a, 0x07, 0x0a, 0x05, 0x0a, 0x03, 0x12, 0x01, 'J'},
+	)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want *ClientMessage
+		err  string
+	}{
+		{"string", cid, &ClientMessage{CID: "a"}, ""},
+		{"last one wins", join(cid, []byte{0x0a, 0x01, 'b'}), &ClientMessage{CID: "b"}, ""},
+		{"unknown varint skipped", join([]byte{0x98, 0x06, 0x01}, cid), &ClientMessage{CID: "a"}, ""},
+		{"unknown fixed64 skipped", join([]byte{0x99, 0x06, 1, 2, 3, 4, 5, 6, 7, 8}, cid), &ClientMessage{CID: "a"}, ""},
+		{"unknown fixed32 skipped", join([]byte{0x9d, 0x06, 1, 2, 3, 4}, cid), &ClientMessage{CID: "a"}, ""},
+		{"unknown bytes skipped", join([]byte{0x9a, 0x06, 0x02, 'x', 'y'}, cid), &ClientMessage{CID: "a"}, ""},
+		{"split message merged", split, &ClientMessage{Payload: &Payload{EnrollmentReq: &EnrollmentReq{
+			EmployeeData: EmpData{ID: "1", FirstName: "J"}}}}, ""},
+		{"truncated key", []byte{0x80}, nil, "unexpected end"},
+		{"truncated length", []byte{0x0a, 0x05, 'a'}, nil, "unexpected end"},
+		{"truncated varint", []byte{0x60, 0xac}, nil, "unexpected end"},
+		{"truncated fixed32", []byte{0x9d, 0x06, 1}, nil, "unexpected end"},
+		{"group", []byte{0x0b}, nil, "unsupported wire type 3"},
+		{"wrong wire type", []byte{0x08, 0x01}, nil, "field 1 has wire type 0"},
+		{"bad nested message", []byte{0x2a, 0x01, 0x80}, nil, "unexpected end"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := &ClientMessage{}
+			err := protobufCodec{}.Unmarshal(tc.data, got)
+			if "" != tc.err {
+				if nil == err || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
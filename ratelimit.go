@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Client messages pass through token buckets before they are decoded. Limits
+// are configured per endpoint and per client type, each connection getting its
+// own buckets, and per user, where all of a user's connections share a bucket.
+// "*" in users applies to every user without a limit of their own, and to
+// anonymous clients, which share a bucket per remote IP. A message must fit
+// all the limits that apply; one that doesn't is answered with a rate_limited
+// error frame, and a client that keeps going is disconnected.
+
+const errRateLimited = "rate_limited"
+
+// past this many user buckets, buckets that have refilled are dropped
+const maxUserBuckets = 10000
+
+type Limit struct {
+	Rate  float64 `json:"rate"`  // messages per second
+	Burst int     `json:"burst"` // bucket size, defaults to rate
+}
+
+type RateLimitConfig struct {
+	Endpoints map[string]Limit `json:"endpoints,omitempty"`
+	Types     map[string]Limit `json:"types,omitempty"`
+	Users     map[string]Limit `json:"users,omitempty"`
+	// Clients rate limited this many times within AbuseWindow seconds are
+	// disconnected. Zero never disconnects.
+	AbuseStrikes int `json:"abuse_strikes,omitempty"`
+	AbuseWindow  int `json:"abuse_window,omitempty"`
+}
+
+var (
+	rateLimited = newCounterVec("wsapigw_rate_limited_messages_total",
+		"Client messages refused by a rate limit.", "route", "limit")
+	rateLimitDisconnects = newCounterVec("wsapigw_rate_limit_disconnects_total",
+		"Clients disconnected for exceeding their rate limits persistently.", "route")
+)
+
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(l Limit) *bucket {
+	burst := float64(l.Burst)
+	if burst < 1 {
+		burst = l.Rate
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &bucket{rate: l.Rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// allow takes a token if one is available.
+func (b *bucket) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// idle reports whether the bucket has been unused long enough to be full.
+func (b *bucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate > 0 && now.Sub(b.last).Seconds()*b.rate+b.tokens >= b.burst
+}
+
+type rateLimiter struct {
+	c       RateLimitConfig
+	window  time.Duration
+	mu      sync.Mutex
+	buckets map[string]*bucket // per user, or per IP for anonymous clients
+}
+
+// limiter is nil when no limits are configured.
+var limiter *rateLimiter
+
+func initRateLimits(c RateLimitConfig) {
+	if 0 == len(c.Endpoints) && 0 == len(c.Types) && 0 == len(c.Users) {
+		return
+	}
+	limiter = &rateLimiter{
+		c:       c,
+		window:  time.Duration(c.AbuseWindow) * time.Second,
+		buckets: make(map[string]*bucket),
+	}
+	if 0 == limiter.window {
+		limiter.window = time.Minute
+	}
+	collectors = append(collectors, limiter)
+}
+
+// userBucket returns the bucket shared by the connections of c's user, or of
+// its IP when c is anonymous, or nil when no user limit applies.
+func (l *rateLimiter) userBucket(c *Client) *bucket {
+	key := "ip:" + addrIP(c.addr)
+	lim, ok := Limit{}, false
+	if "" != c.user {
+		key = "user:" + c.user
+		lim, ok = l.c.Users[c.user]
+	}
+	if !ok {
+		if lim, ok = l.c.Users["*"]; !ok {
+			return nil
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[key]
+	if nil == b {
+		if len(l.buckets) >= maxUserBuckets {
+			now := time.Now()
+			for k, ub := range l.buckets {
+				if ub.idle(now) {
+					delete(l.buckets, k)
+				}
+			}
+		}
+		b = newBucket(lim)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// clientLimits holds a connection's own buckets and its strike count. It is
+// only used by the client's read goroutine.
+type clientLimits struct {
+	endpoint *bucket
+	ctype    *bucket
+	strikes  int
+	since    time.Time
+}
+
+func (l *rateLimiter) forClient(route string, ctype string) *clientLimits {
+	cl := &clientLimits{}
+	if lim, ok := l.c.Endpoints[route]; ok {
+		cl.endpoint = newBucket(lim)
+	}
+	if lim, ok := l.c.Types[ctype]; ok {
+		cl.ctype = newBucket(lim)
+	}
+	return cl
+}
+
+// allow returns the limit a message from c exceeds, or "" when it may pass.
+func (l *rateLimiter) allow(c *Client) string {
+	now := time.Now()
+	if nil != c.limits.endpoint && !c.limits.endpoint.allow(now) {
+		return "endpoint"
+	}
+	if nil != c.limits.ctype && !c.limits.ctype.allow(now) {
+		return "type"
+	}
+	if b := l.userBucket(c); nil != b && !b.allow(now) {
+		return "user"
+	}
+	return ""
+}
+
+// strike records a rate limited message and reports whether the client has
+// now exceeded its limits often enough to be disconnected.
+func (l *rateLimiter) strike(c *Client) bool {
+	if 0 == l.c.AbuseStrikes {
+		return false
+	}
+	now := time.Now()
+	if now.Sub(c.limits.since) > l.window {
+		c.limits.strikes = 0
+		c.limits.since = now
+	}
+	c.limits.strikes++
+	return c.limits.strikes >= l.c.AbuseStrikes
+}
+
+// collect reports the configured limits.
+func (l *rateLimiter) collect(w io.Writer) {
+	writeHeader(w, "wsapigw_rate_limit", "Configured rate limits in messages per second.", "gauge")
+	writeLimits(w, "wsapigw_rate_limit", l.c, func(lim Limit) float64 { return lim.Rate })
+	writeHeader(w, "wsapigw_rate_limit_burst", "Configured rate limit bursts.", "gauge")
+	writeLimits(w, "wsapigw_rate_limit_burst", l.c, func(lim Limit) float64 { return newBucket(lim).burst })
+}
+
+func writeLimits(w io.Writer, name string, c RateLimitConfig, value func(Limit) float64) {
+	for _, scope := range []struct {
+		name   string
+		limits map[string]Limit
+	}{{"endpoint", c.Endpoints}, {"type", c.Types}, {"user", c.Users}} {
+		keys := make([]string, 0, len(scope.limits))
+		for k := range scope.limits {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s%s %s\n", name, formatLabels([]string{"scope", "key"}, []string{scope.name, k}),
+				formatFloat(value(scope.limits[k])))
+		}
+	}
+}
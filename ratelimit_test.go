@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestUserBucket(t *testing.T) {
+	l := &rateLimiter{
+		c: RateLimitConfig{Users: map[string]Limit{
+			"*":       {Rate: 1},
+			"batch":   {Rate: 100},
+			"limited": {Rate: 2},
+		}},
+		buckets: make(map[string]*bucket),
+	}
+	client := func(user string, addr string) *Client {
+		return &Client{user: user, addr: addr}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		a, b  *Client
+		same  bool
+		burst float64
+	}{
+		{"same user, different IPs", client("limited", "10.0.0.1:4000"), client("limited", "10.0.0.2:4000"), true, 2},
+		{"different users, same IP", client("limited", "10.0.0.1:4000"), client("batch", "10.0.0.1:4001"), false, 2},
+		{"user without a limit of its own", client("jdelacruz", "10.0.0.1:4000"), client("jdelacruz", "10.0.0.3:4000"), true, 1},
+		{"anonymous, same IP", client("", "10.0.0.1:4000"), client("", "10.0.0.1:4001"), true, 1},
+		{"anonymous, different IPs", client("", "10.0.0.1:4000"), client("", "10.0.0.2:4000"), false, 1},
+		{"anonymous and a user named like an IP", client("", "10.0.0.1:4000"), client("10.0.0.1", "10.0.0.1:4001"), false, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := l.userBucket(tc.a), l.userBucket(tc.b)
+			if nil == a || nil == b {
+				t.Fatal("no user bucket")
+			}
+			if (a == b) != tc.same {
+				t.Errorf("share a bucket: %v, want %v", a == b, tc.same)
+			}
+			if a.burst != tc.burst {
+				t.Errorf("burst %v, want %v", a.burst, tc.burst)
+			}
+		})
+	}
+
+	l.c.Users = map[string]Limit{"batch": {Rate: 100}}
+	if b := l.userBucket(client("", "10.0.0.1:4000")); nil != b {
+		t.Error("anonymous client limited without a \"*\" limit")
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With broker.type set to "redis" topics are Redis streams on broker.addr
+// (with broker.password if set) and the consumer group is a stream consumer
+// group, created from the start of each stream on first use. Records are
+// stream entries with a "value" field, a "key" field when keyed, an
+// "h:<name>" field per header, and a "tombstone" field instead of the value
+// when the value is nil. A stream is a single partition; an entry's offset is
+// derived from its id, so offsets grow but aren't consecutive and consumer lag
+// isn't reported. Each gateway consumes as its host name, so entries it read
+// but didn't acknowledge are delivered again when it reconnects, like
+// uncommitted Kafka offsets.
+
+const (
+	brokerRedis = "redis"
+
+	redisTimeout = 10 * time.Second
+	redisBlock   = time.Second
+	redisCount   = 100
+)
+
+// errNoOffsets is returned by clusters that can't tell a partition's high
+// water mark.
+var errNoOffsets = errors.New("broker has no consecutive offsets")
+
+// redisError is an error reply.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisConn is a connection speaking RESP, Redis' protocol. Commands are
+// serialized; a blocking command holds the connection until it returns.
+type redisConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialRedis(addr string, password string) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if "" != password {
+		if _, err := c.do("AUTH", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	return c.block(0, args...)
+}
+
+// block runs a command that may block for up to wait on the server.
+func (c *redisConn) block(wait time.Duration, args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetDeadline(time.Now().Add(wait + redisTimeout))
+	w := bufio.NewWriter(c.conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return readRESP(c.r)
+}
+
+func (c *redisConn) close() error { return c.conn.Close() }
+
+// readRESP reads one reply: a string for simple strings, redisError, int64,
+// []byte for bulk strings and []interface{} for arrays. Null bulk strings and
+// arrays are nil.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if "" == line {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// replyError returns the error reply as an error, if it is one.
+func replyError(reply interface{}, err error) (interface{}, error) {
+	if e, ok := reply.(redisError); ok {
+		return nil, e
+	}
+	return reply, err
+}
+
+// redisOffset maps an entry id, <milliseconds>-<sequence>, onto an offset.
+func redisOffset(id string) (int64, time.Time) {
+	parts := strings.SplitN(id, "-", 2)
+	ms, _ := strconv.ParseInt(parts[0], 10, 64)
+	var seq int64
+	if 2 == len(parts) {
+		seq, _ = strconv.ParseInt(parts[1], 10, 64)
+	}
+	return ms<<20 | seq&(1<<20-1), time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// redisEntries decodes the entries of an XREAD or XREADGROUP reply:
+// [[stream, [[id, [field, value, ...]], ...]], ...].
+func redisEntries(reply interface{}) map[string][]*Record {
+	streams := make(map[string][]*Record)
+	all, _ := reply.([]interface{})
+	for _, s := range all {
+		s, _ := s.([]interface{})
+		if 2 != len(s) {
+			continue
+		}
+		topic := string(bytesOf(s[0]))
+		entries, _ := s[1].([]interface{})
+		records := make([]*Record, 0, len(entries))
+		for _, e := range entries {
+			e, _ := e.([]interface{})
+			if 2 != len(e) {
+				continue
+			}
+			id := string(bytesOf(e[0]))
+			r := &Record{Topic: topic, id: id}
+			r.Offset, r.Timestamp = redisOffset(id)
+			fields, _ := e[1].([]interface{})
+			for i := 0; i+1 < len(fields); i += 2 {
+				name, value := string(bytesOf(fields[i])), bytesOf(fields[i+1])
+				switch {
+				case "value" == name:
+					r.Value = value
+				case "key" == name:
+					r.Key = value
+				case strings.HasPrefix(name, "h:"):
+					if nil == r.Headers {
+						r.Headers = make(map[string]string)
+					}
+					r.Headers[name[2:]] = string(value)
+				}
+			}
+			if nil == r.Value && 0 == len(fields) {
+				// a pending entry that has since been deleted
+				continue
+			}
+			records = append(records, r)
+		}
+		streams[topic] = records
+	}
+	return streams
+}
+
+func bytesOf(v interface{}) []byte {
+	switch v := v.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return nil
+}
+
+// redisPublisher publishes with XADD.
+type redisPublisher struct {
+	c *redisConn
+}
+
+func (p *redisPublisher) Publish(r *Record) error {
+	args := []string{"XADD", r.Topic, "*"}
+	if nil != r.Key {
+		args = append(args, "key", string(r.Key))
+	}
+	for k, v := range r.Headers {
+		args = append(args, "h:"+k, v)
+	}
+	if nil == r.Value {
+		args = append(args, "tombstone", "1")
+	} else {
+		args = append(args, "value", string(r.Value))
+	}
+	reply, err := replyError(p.c.do(args...))
+	if err != nil {
+		return redisFailure(err)
+	}
+	r.id = string(bytesOf(reply))
+	r.Offset, r.Timestamp = redisOffset(r.id)
+	return nil
+}
+
+func (p *redisPublisher) Close() error { return p.c.close() }
+
+// redisFailure turns connection errors into errBrokerClosed, so the
+// connection is recreated; error replies are passed on.
+func redisFailure(err error) error {
+	if _, ok := err.(redisError); ok {
+		return err
+	}
+	brokerLog.Warn("redis connection failed", "err", err)
+	return errBrokerClosed
+}
+
+// redisSubscriber reads the group's entries with XREADGROUP on a connection
+// of its own, and acknowledges them with XACK on the publisher's.
+type redisSubscriber struct {
+	c        *redisConn
+	acks     *redisConn
+	group    string
+	consumer string
+	topics   []string
+	records  chan *Record
+	errors   chan error
+	stop     chan struct{}
+	done     chan struct{}
+	closed   int32
+}
+
+func newRedisSubscriber(c *redisConn, acks *redisConn, group string, topics []string) (*redisSubscriber, error) {
+	for _, topic := range topics {
+		_, err := replyError(c.do("XGROUP", "CREATE", topic, group, "0", "MKSTREAM"))
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return nil, err
+		}
+	}
+	consumer, err := os.Hostname()
+	if err != nil {
+		consumer = "wsapigw"
+	}
+	s := &redisSubscriber{
+		c:        c,
+		acks:     acks,
+		group:    group,
+		consumer: consumer,
+		topics:   topics,
+		records:  make(chan *Record),
+		errors:   make(chan error),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.read()
+	return s, nil
+}
+
+// read first reads the entries delivered to this consumer before but not
+// acknowledged, then new ones, until the subscriber is closed or the
+// connection fails.
+func (s *redisSubscriber) read() {
+	defer close(s.done)
+	defer close(s.records)
+	cursors := make(map[string]string, len(s.topics))
+	for _, topic := range s.topics {
+		cursors[topic] = "0"
+	}
+	for {
+		args := []string{"XREADGROUP", "GROUP", s.group, s.consumer,
+			"COUNT", strconv.Itoa(redisCount), "BLOCK", strconv.Itoa(int(redisBlock / time.Millisecond)), "STREAMS"}
+		args = append(args, s.topics...)
+		for _, topic := range s.topics {
+			args = append(args, cursors[topic])
+		}
+		reply, err := replyError(s.c.block(redisBlock, args...))
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		if err != nil {
+			s.report(err)
+			if _, ok := err.(redisError); !ok {
+				return
+			}
+			time.Sleep(redisBlock)
+			continue
+		}
+		entries := redisEntries(reply)
+		for _, topic := range s.topics {
+			records, ok := entries[topic]
+			if ">" != cursors[topic] && (!ok || 0 == len(records)) {
+				cursors[topic] = ">"
+			}
+			for _, r := range records {
+				if ">" != cursors[topic] {
+					cursors[topic] = r.id
+				}
+				select {
+				case s.records <- r:
+				case <-s.stop:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *redisSubscriber) report(err error) {
+	select {
+	case s.errors <- err:
+	case <-s.stop:
+	}
+}
+
+func (s *redisSubscriber) Records() <-chan *Record { return s.records }
+
+func (s *redisSubscriber) Errors() <-chan error { return s.errors }
+
+func (s *redisSubscriber) Commit(r *Record) error {
+	_, err := replyError(s.acks.do("XACK", r.Topic, s.group, r.id))
+	return err
+}
+
+func (s *redisSubscriber) Closed() bool { return 1 == atomic.LoadInt32(&s.closed) }
+
+func (s *redisSubscriber) Close() error {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return nil
+	}
+	close(s.stop)
+	// interrupts a blocked read
+	err := s.c.close()
+	<-s.done
+	return err
+}
+
+// redisCluster answers the gateway's broker questions from the publisher's
+// connection.
+type redisCluster struct {
+	c        *redisConn
+	addr     string
+	password string
+}
+
+func (rc *redisCluster) highWaterMark(string, int32) (int64, error) {
+	return 0, errNoOffsets
+}
+
+func (rc *redisCluster) checkBrokers() string {
+	if _, err := replyError(rc.c.do("PING")); err != nil {
+		return "unreachable: " + err.Error()
+	}
+	return checkOK
+}
+
+// Streams have no partitions to assign.
+func (rc *redisCluster) checkPartitions(string, []string) string { return checkOK }
+
+func (rc *redisCluster) readTopic(topic string, stop <-chan struct{}, apply func(*Record)) error {
+	c, err := dialRedis(rc.addr, rc.password)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			c.close()
+		case <-done:
+			c.close()
+		}
+	}()
+	last := "0-0"
+	for {
+		reply, err := replyError(c.block(redisBlock, "XREAD", "COUNT", strconv.Itoa(redisCount),
+			"BLOCK", strconv.Itoa(int(redisBlock/time.Millisecond)), "STREAMS", topic, last))
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		if err != nil {
+			return err
+		}
+		for _, r := range redisEntries(reply)[topic] {
+			apply(r)
+			last = r.id
+		}
+	}
+}
+
+// The connection is the publisher's, closed with it.
+func (rc *redisCluster) close() {}
+
+func connectRedis(c *KafkaConfig, topics []string) (*brokerConn, error) {
+	brokerLog.Info("connecting to redis", "addr", c.Broker.Addr)
+	pc, err := dialRedis(c.Broker.Addr, c.Broker.Password)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := dialRedis(c.Broker.Addr, c.Broker.Password)
+	if err != nil {
+		pc.close()
+		return nil, err
+	}
+	sub, err := newRedisSubscriber(sc, pc, c.Cgroup, topics)
+	if err != nil {
+		sc.close()
+		pc.close()
+		return nil, err
+	}
+	brokerLog.Info("joined redis consumer group", "cgroup", c.Cgroup, "consumer", sub.consumer, "topics", topics)
+	return &brokerConn{
+		pub:     &redisPublisher{pc},
+		sub:     sub,
+		cluster: &redisCluster{c: pc, addr: c.Broker.Addr, password: c.Broker.Password},
+		dead:    make(chan struct{}),
+		commits: make(map[partitionKey]*partitionCommits),
+	}, nil
+}
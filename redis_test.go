@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadRESP(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		reply string
+		want  interface{}
+		err   string
+	}{
+		{"simple string", "+OK\r\n", "OK", ""},
+		{"error", "-BUSYGROUP Consumer Group name already exists\r\n", redisError("BUSYGROUP Consumer Group name already exists"), ""},
+		{"integer", ":-42\r\n", int64(-42), ""},
+		{"bulk string", "$5\r\nab\r\nc\r\n", []byte("ab\r\nc"), ""},
+		{"empty bulk string", "$0\r\n\r\n", []byte{}, ""},
+		{"null bulk string", "$-1\r\n", nil, ""},
+		{"array", "*2\r\n$1\r\na\r\n:1\r\n", []interface{}{[]byte("a"), int64(1)}, ""},
+		{"nested array", "*1\r\n*2\r\n+x\r\n$-1\r\n", []interface{}{[]interface{}{"x", nil}}, ""},
+		{"empty array", "*0\r\n", []interface{}{}, ""},
+		{"null array", "*-1\r\n", nil, ""},
+		{"empty line", "\r\n", nil, "empty reply"},
+		{"unexpected prefix", "%1\r\n", nil, "unexpected reply"},
+		{"bad integer", ":x\r\n", nil, "invalid syntax"},
+		{"bad length", "$x\r\n", nil, "invalid syntax"},
+		{"truncated bulk string", "$5\r\nab", nil, "unexpected EOF"},
+		{"truncated array", "*2\r\n+a\r\n", nil, "EOF"},
+		{"no line end", "+OK", nil, "EOF"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readRESP(bufio.NewReader(strings.NewReader(tc.reply)))
+			if "" != tc.err {
+				if nil == err || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRedisEntries(t *testing.T) {
+	b := func(s string) []byte { return []byte(s) }
+	entry := func(id string, fields ...string) interface{} {
+		f := make([]interface{}, len(fields))
+		for i, s := range fields {
+			f[i] = b(s)
+		}
+		return []interface{}{b(id), f}
+	}
+	reply := []interface{}{
+		[]interface{}{b("employee.updates"), []interface{}{
+			entry("1700000000000-0", "key", "E-1", "h:traceparent", "00-ab", "value", `{"CID":"a"}`),
+			entry("1700000000000-1", "tombstone", "1"),
+			// pending, since deleted
+			[]interface{}{b("1700000000000-2"), nil},
+		}},
+		[]interface{}{b("ledger.blocks"), []interface{}{}},
+	}
+	at := time.Unix(1700000000, 0)
+	want := map[string][]*Record{
+		"employee.updates": {
+			{Topic: "employee.updates", Offset: 1700000000000 << 20, Key: b("E-1"), Value: b(`{"CID":"a"}`),
+				Headers: map[string]string{"traceparent": "00-ab"}, Timestamp: at, id: "1700000000000-0"},
+			{Topic: "employee.updates", Offset: 1700000000000<<20 | 1, Timestamp: at, id: "1700000000000-1"},
+		},
+		"ledger.blocks": {},
+	}
+	got := redisEntries(reply)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if 0 != len(redisEntries(nil)) {
+		t.Error("null reply has entries")
+	}
+}
+
+// startRedis builds the Redis stand-in and runs it for the test.
+func startRedis(t *testing.T) string {
+	if testing.Short() {
+		t.Skip("builds and runs the redis stand-in")
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "wsapigw-redis")
+	build := exec.Command("go", "build", "-o", bin, "./cmd/wsapigw-redis")
+	build.Stdout, build.Stderr = os.Stderr, os.Stderr
+	if err := build.Run(); err != nil {
+		t.Fatalf("building the redis stand-in: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	cmd := exec.Command(bin, "-addr", addr)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if c, err := net.Dial("tcp", addr); nil == err {
+			c.Close()
+			return addr
+		}
+	}
+	t.Fatal("redis stand-in not listening")
+	return ""
+}
+
+func nextRecord(t *testing.T, conn *brokerConn) *Record {
+	t.Helper()
+	select {
+	case r := <-conn.sub.Records():
+		return r
+	case err := <-conn.sub.Errors():
+		t.Fatal(err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("no record")
+	}
+	return nil
+}
+
+func noRecord(t *testing.T, conn *brokerConn) {
+	t.Helper()
+	select {
+	case r := <-conn.sub.Records():
+		t.Fatalf("unexpected record %s", r.Value)
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+// The adapter against the stand-in: records round trip through a stream, a
+// group's unacknowledged entries are redelivered when it reconnects, and
+// acknowledged ones aren't.
+func TestRedisBroker(t *testing.T) {
+	c := &KafkaConfig{Cgroup: "wsapigw", Broker: BrokerConfig{Type: brokerRedis, Addr: startRedis(t)}}
+	topics := []string{"employee.updates"}
+	connect := func() *brokerConn {
+		conn, err := connectRedis(c, topics)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	conn := connect()
+	if s := conn.cluster.checkBrokers(); checkOK != s {
+		t.Fatalf("checkBrokers: %s", s)
+	}
+	sent := []*Record{
+		{Topic: "employee.updates", Key: []byte("E-1"), Value: []byte("one"), Headers: map[string]string{"traceparent": "00-ab"}},
+		{Topic: "employee.updates", Value: []byte("two")},
+	}
+	for _, r := range sent {
+		if err := conn.pub.Publish(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sent[1].Offset <= sent[0].Offset {
+		t.Errorf("offsets %d then %d, want increasing", sent[0].Offset, sent[1].Offset)
+	}
+	for _, want := range sent {
+		got := nextRecord(t, conn)
+		if want.id != got.id || string(want.Value) != string(got.Value) || string(want.Key) != string(got.Key) ||
+			!reflect.DeepEqual(want.Headers, got.Headers) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+	if err := conn.sub.Commit(sent[0]); err != nil {
+		t.Fatal(err)
+	}
+	conn.sub.Close()
+	conn.pub.Close()
+
+	conn = connect()
+	defer conn.pub.Close()
+	defer conn.sub.Close()
+	if r := nextRecord(t, conn); "two" != string(r.Value) {
+		t.Errorf("redelivered %q, want the unacknowledged \"two\"", r.Value)
+	}
+	noRecord(t, conn)
+
+	var read []string
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- conn.cluster.readTopic("employee.updates", stop, func(r *Record) { read = append(read, string(r.Value)) })
+	}()
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"one", "two"}; !reflect.DeepEqual(read, want) {
+		t.Errorf("readTopic read %q, want %q", read, want)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// With a schema registry configured, every record the gateway produces or
+// consumes uses the Confluent wire format: a zero magic byte, the 4-byte
+// big-endian schema ID, then the Avro or Protobuf encoded ClientMessage.
+// Protobuf records also carry the message indexes, always [0] since
+// ClientMessage is the first message in wsapigw.proto. Schemas are registered
+// under the "<topic>-value" subject in the background, from startup for the
+// topics the gateway publishes to; a publish before its subject is registered
+// fails like one to an unavailable broker. Consumed records are decoded with
+// the writer's schema, fetched by ID as they are consumed. Both lookups are
+// cached, so the hub never waits on the registry.
+
+//go:embed wsapigw.proto
+var protoSchema string
+
+const (
+	registryMagic   = 0
+	registryTimeout = 5 * time.Second
+	// registration is retried with backoff up to registryRetry; a failed
+	// schema lookup is retried after it
+	registryRetry = time.Minute
+
+	schemaTypeAvro     = "AVRO"
+	schemaTypeProtobuf = "PROTOBUF"
+)
+
+type RegistryConfig struct {
+	URL      string `json:"url,omitempty"`
+	Format   string `json:"format,omitempty"` // "avro" (default) or "protobuf"
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// writerSchema is a schema fetched by ID to decode consumed records.
+type writerSchema struct {
+	schemaType string
+	avro       *avroType
+}
+
+type schemaRegistry struct {
+	url        string
+	username   string
+	password   string
+	schemaType string
+	schema     string
+	client     *http.Client
+
+	mu       sync.Mutex
+	ids      map[string]uint32 // subject -> ID of the gateway's schema
+	pending  map[string]bool   // subjects being registered
+	writers  map[uint32]*writerSchema
+	failed   map[uint32]writerFailure
+	topicCdc map[string]Codec
+}
+
+// writerFailure is a failed writer schema lookup, not retried before
+// registryRetry has passed.
+type writerFailure struct {
+	err error
+	at  time.Time
+}
+
+// registry is nil unless a schema registry URL is configured.
+var registry *schemaRegistry
+
+var errSchemaPending = errors.New("schema not registered yet")
+
+func newSchemaRegistry(c RegistryConfig) (*schemaRegistry, error) {
+	r := &schemaRegistry{
+		url:      strings.TrimRight(c.URL, "/"),
+		username: c.Username,
+		password: c.Password,
+		client:   &http.Client{Timeout: registryTimeout},
+		ids:      make(map[string]uint32),
+		pending:  make(map[string]bool),
+		writers:  make(map[uint32]*writerSchema),
+		failed:   make(map[uint32]writerFailure),
+		topicCdc: make(map[string]Codec),
+	}
+	switch strings.ToLower(c.Format) {
+	case "", "avro":
+		schema, err := avroSchema(reflect.TypeOf(ClientMessage{}))
+		if err != nil {
+			return nil, fmt.Errorf("deriving avro schema: %v", err)
+		}
+		r.schemaType = schemaTypeAvro
+		r.schema = string(schema)
+	case "protobuf":
+		r.schemaType = schemaTypeProtobuf
+		r.schema = protoSchema
+	default:
+		return nil, fmt.Errorf("unknown format %q", c.Format)
+	}
+	return r, nil
+}
+
+// initRegistry enables the registry and starts registering the schema for
+// the topics client messages are published to.
+func initRegistry(c RegistryConfig) {
+	if "" == c.URL {
+		return
+	}
+	r, err := newSchemaRegistry(c)
+	if err != nil {
+		rootLog.Error("schema registry disabled", "err", err)
+		return
+	}
+	registry = r
+	rootLog.Info("schema registry enabled", "url", r.url, "format", r.schemaType)
+	for _, topic := range []string{requestTopic, connectedTopic} {
+		r.schemaID(topic + "-value")
+	}
+}
+
+type registryError struct {
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+func (r *schemaRegistry) do(method string, path string, body interface{}, out interface{}) error {
+	var rd io.Reader
+	if nil != body {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, r.url+path, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if nil != body {
+		req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	}
+	if "" != r.username {
+		req.SetBasicAuth(r.username, r.password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e registryError
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("schema registry %s %s: %s (%d %s)", method, path, resp.Status, e.ErrorCode, e.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// schemaID returns the ID of the gateway's schema under subject. Until it is
+// known, registration runs in the background and errSchemaPending is returned.
+func (r *schemaRegistry) schemaID(subject string) (uint32, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id, ok := r.ids[subject]; ok {
+		return id, nil
+	}
+	if !r.pending[subject] {
+		r.pending[subject] = true
+		go r.keepRegistering(subject)
+	}
+	return 0, errSchemaPending
+}
+
+// keepRegistering registers the gateway's schema under subject, retrying
+// until the registry accepts it.
+func (r *schemaRegistry) keepRegistering(subject string) {
+	for wait := time.Second; ; wait *= 2 {
+		_, err := r.register(subject)
+		if nil == err {
+			return
+		}
+		if wait > registryRetry {
+			wait = registryRetry
+		}
+		kafkaLog.Warn("error registering schema, retrying", "subject", subject, "in", wait, "err", err)
+		time.Sleep(wait)
+	}
+}
+
+// register registers the gateway's schema under subject, which returns the
+// existing ID when the schema is already registered.
+func (r *schemaRegistry) register(subject string) (uint32, error) {
+	req := struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType,omitempty"`
+	}{Schema: r.schema}
+	// AVRO is the registry's default and older registries reject the field
+	if schemaTypeAvro != r.schemaType {
+		req.SchemaType = r.schemaType
+	}
+	var resp struct {
+		ID uint32 `json:"id"`
+	}
+	if err := r.do("POST", "/subjects/"+url.PathEscape(subject)+"/versions", req, &resp); err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	r.ids[subject] = resp.ID
+	delete(r.pending, subject)
+	r.mu.Unlock()
+	kafkaLog.Info("registered schema", "subject", subject, "id", resp.ID, "type", r.schemaType)
+	return resp.ID, nil
+}
+
+// writer returns the schema with the given ID.
+func (r *schemaRegistry) writer(id uint32) (*writerSchema, error) {
+	r.mu.Lock()
+	w, ok := r.writers[id]
+	f, failed := r.failed[id]
+	r.mu.Unlock()
+	if ok {
+		return w, nil
+	}
+	if failed && time.Since(f.at) < registryRetry {
+		return nil, f.err
+	}
+	w, err := r.fetchWriter(id)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.failed[id] = writerFailure{err, time.Now()}
+		return nil, err
+	}
+	delete(r.failed, id)
+	r.writers[id] = w
+	return w, nil
+}
+
+func (r *schemaRegistry) fetchWriter(id uint32) (*writerSchema, error) {
+	var resp struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType"`
+	}
+	if err := r.do("GET", fmt.Sprintf("/schemas/ids/%d", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	w := &writerSchema{schemaType: resp.SchemaType}
+	switch resp.SchemaType {
+	case "", schemaTypeAvro:
+		w.schemaType = schemaTypeAvro
+		t, err := parseAvro(resp.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("schema %d: %v", id, err)
+		}
+		w.avro = t
+	case schemaTypeProtobuf:
+	default:
+		return nil, fmt.Errorf("schema %d has unsupported type %s", id, resp.SchemaType)
+	}
+	return w, nil
+}
+
+// prefetch fetches the writer schema of a consumed record, so that decoding
+// it on the hub finds the schema cached.
+func (r *schemaRegistry) prefetch(value []byte) {
+	if len(value) < 5 || registryMagic != value[0] {
+		return
+	}
+	id := binary.BigEndian.Uint32(value[1:5])
+	if _, err := r.writer(id); err != nil {
+		kafkaLog.Warn("error fetching writer schema", "id", id, "err", err)
+	}
+}
+
+// codec returns the registry codec for a topic.
+func (r *schemaRegistry) codec(topic string) Codec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.topicCdc[topic]
+	if !ok {
+		c = &registryCodec{r: r, subject: topic + "-value"}
+		r.topicCdc[topic] = c
+	}
+	return c
+}
+
+var errNotRegistryFramed = errors.New("record is not in schema registry wire format")
+
+type registryCodec struct {
+	r       *schemaRegistry
+	subject string
+}
+
+func (c *registryCodec) Name() string { return "registry-" + strings.ToLower(c.r.schemaType) }
+
+func (c *registryCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (c *registryCodec) Marshal(msg *ClientMessage) ([]byte, error) {
+	id, err := c.r.schemaID(c.subject)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 5, 256)
+	b[0] = registryMagic
+	binary.BigEndian.PutUint32(b[1:], id)
+	if schemaTypeProtobuf == c.r.schemaType {
+		// message indexes [0], which the wire format shortens to a single 0
+		b = append(b, 0)
+		return protoEncode(b, reflect.ValueOf(msg).Elem())
+	}
+	var buf bytes.Buffer
+	buf.Write(b)
+	avroEncode(&buf, reflect.ValueOf(msg).Elem())
+	return buf.Bytes(), nil
+}
+
+func (c *registryCodec) Unmarshal(data []byte, msg *ClientMessage) error {
+	if len(data) < 5 || registryMagic != data[0] {
+		return errNotRegistryFramed
+	}
+	w, err := c.r.writer(binary.BigEndian.Uint32(data[1:5]))
+	if err != nil {
+		return err
+	}
+	data = data[5:]
+	if schemaTypeAvro == w.schemaType {
+		return avroDecode(data, w.avro, msg)
+	}
+	// message indexes: a zigzag count followed by that many indexes, where
+	// a zero count means [0]
+	n, size := binary.Varint(data)
+	if size <= 0 {
+		return errProtoShort
+	}
+	data = data[size:]
+	for i := int64(0); i < n; i++ {
+		idx, size := binary.Varint(data)
+		if size <= 0 {
+			return errProtoShort
+		}
+		if 0 != idx {
+			return fmt.Errorf("protobuf record is not a ClientMessage (message index %d)", idx)
+		}
+		data = data[size:]
+	}
+	return protoDecode(data, reflect.ValueOf(msg).Elem(), 0)
+}
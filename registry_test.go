@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRegistry is a schema registry stand-in serving the two calls the
+// gateway makes, counting them.
+type testRegistry struct {
+	mu       sync.Mutex
+	schemas  []map[string]string // by ID - 1
+	subjects map[string]int
+	calls    map[string]int
+}
+
+func newTestRegistry(t *testing.T) (*testRegistry, *httptest.Server) {
+	tr := &testRegistry{subjects: make(map[string]int), calls: make(map[string]int)}
+	srv := httptest.NewServer(http.HandlerFunc(tr.serve))
+	t.Cleanup(srv.Close)
+	return tr, srv
+}
+
+func (tr *testRegistry) serve(w http.ResponseWriter, r *http.Request) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.calls[r.Method+" "+r.URL.Path]++
+	w.Header().Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	switch {
+	case "POST" == r.Method && strings.HasSuffix(r.URL.Path, "/versions"):
+		var s map[string]string
+		json.NewDecoder(r.Body).Decode(&s)
+		subject := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/subjects/"), "/versions")
+		id, ok := tr.subjects[subject]
+		if !ok {
+			tr.schemas = append(tr.schemas, s)
+			id = len(tr.schemas)
+			tr.subjects[subject] = id
+		}
+		json.NewEncoder(w).Encode(map[string]int{"id": id})
+	case "GET" == r.Method && strings.HasPrefix(r.URL.Path, "/schemas/ids/"):
+		id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/schemas/ids/"))
+		if id < 1 || id > len(tr.schemas) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(registryError{ErrorCode: 40403, Message: "Schema not found"})
+			return
+		}
+		json.NewEncoder(w).Encode(tr.schemas[id-1])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (tr *testRegistry) id(subject string) int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.subjects[subject]
+}
+
+func (tr *testRegistry) count(call string) int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.calls[call]
+}
+
+func testSchemaRegistry(t *testing.T, url string, format string) *schemaRegistry {
+	r, err := newSchemaRegistry(RegistryConfig{URL: url, Format: format})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// registered registers the schema for topic, as the gateway does in the
+// background.
+func (r *schemaRegistry) registered(t *testing.T, topic string) Codec {
+	t.Helper()
+	if _, err := r.register(topic + "-value"); err != nil {
+		t.Fatal(err)
+	}
+	return r.codec(topic)
+}
+
+func TestRegistryFraming(t *testing.T) {
+	tr, srv := newTestRegistry(t)
+	// a schema registered before the gateway's, so its ID isn't 1
+	tr.schemas = append(tr.schemas, map[string]string{"schema": `"string"`})
+
+	for _, tc := range []struct {
+		format string
+		// bytes after the magic byte and schema ID
+		prefix []byte
+	}{
+		{"avro", nil},
+		{"protobuf", []byte{0}},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			r := testSchemaRegistry(t, srv.URL, tc.format)
+			topic := "employee.updates." + tc.format
+			c := r.registered(t, topic)
+			if c != r.codec(topic) {
+				t.Error("codec not cached per topic")
+			}
+			for name, msg := range testMessages() {
+				b, err := c.Marshal(msg)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				id := tr.id(topic + "-value")
+				header := append([]byte{registryMagic, 0, 0, 0, byte(id)}, tc.prefix...)
+				if !bytes.HasPrefix(b, header) {
+					t.Fatalf("%s: record starts % x, want % x", name, b[:len(header)], header)
+				}
+				got := &ClientMessage{}
+				if err := c.Unmarshal(b, got); err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if !reflect.DeepEqual(got, msg) {
+					t.Errorf("%s: got %+v, want %+v", name, got, msg)
+				}
+			}
+			path := "/subjects/" + topic + "-value/versions"
+			if n := tr.count("POST " + path); 1 != n {
+				t.Errorf("schema registered %d times, want once", n)
+			}
+			if n := tr.count("GET /schemas/ids/" + strconv.Itoa(tr.id(topic+"-value"))); 1 != n {
+				t.Errorf("schema fetched %d times, want once", n)
+			}
+		})
+	}
+}
+
+func TestRegistryUnmarshal(t *testing.T) {
+	tr, srv := newTestRegistry(t)
+	r := testSchemaRegistry(t, srv.URL, "protobuf")
+	c := r.registered(t, "employee.updates")
+	b, err := c.Marshal(&ClientMessage{CID: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := byte(tr.id("employee.updates-value"))
+	tr.mu.Lock()
+	tr.schemas = append(tr.schemas, map[string]string{"schema": "syntax", "schemaType": "JSON"})
+	jsonID := byte(len(tr.schemas))
+	tr.mu.Unlock()
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"registry framed", b, ""},
+		{"explicit message index [0]", []byte{0, 0, 0, 0, id, 0x02, 0x00, 0x0a, 0x01, 'a'}, ""},
+		{"plain JSON", []byte(`{"CID": "a"}`), errNotRegistryFramed.Error()},
+		{"too short", []byte{0, 0, 0}, errNotRegistryFramed.Error()},
+		{"unknown schema", []byte{0, 0, 0, 0, 99, 0}, "Schema not found"},
+		{"unsupported schema type", []byte{0, 0, 0, 0, jsonID, 0}, "unsupported type JSON"},
+		{"other message", []byte{0, 0, 0, 0, id, 0x02, 0x02, 0x0a, 0x01, 'a'}, "message index 1"},
+		{"truncated message indexes", []byte{0, 0, 0, 0, id, 0x04, 0x00}, "unexpected end"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := &ClientMessage{}
+			err := c.Unmarshal(tc.data, got)
+			if "" == tc.err {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if "a" != got.CID {
+					t.Errorf("CID %q, want \"a\"", got.CID)
+				}
+				return
+			}
+			if nil == err || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error %v, want one containing %q", err, tc.err)
+			}
+		})
+	}
+}
+
+// Publishing doesn't wait for the registry: until the subject is registered
+// in the background, encoding fails at once.
+func TestRegistryPending(t *testing.T) {
+	tr, srv := newTestRegistry(t)
+	release := make(chan struct{})
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	// closing the server waits for the blocked request
+	t.Cleanup(unblock)
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		tr.serve(w, r)
+	})
+	r := testSchemaRegistry(t, srv.URL, "avro")
+	c := r.codec(requestTopic)
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		if _, err := c.Marshal(&ClientMessage{CID: "a"}); errSchemaPending != err {
+			t.Fatalf("encoding: %v, want errSchemaPending", err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("encoding took %v", d)
+		}
+	}
+	unblock()
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := c.Marshal(&ClientMessage{CID: "a"}); nil == err {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("schema not registered")
+		}
+	}
+	if n := tr.count("POST /subjects/" + requestTopic + "-value/versions"); 1 != n {
+		t.Errorf("schema registered %d times, want once", n)
+	}
+}
+
+// A failed writer schema lookup isn't retried for every record.
+func TestRegistryWriterFailure(t *testing.T) {
+	tr, srv := newTestRegistry(t)
+	r := testSchemaRegistry(t, srv.URL, "avro")
+	record := []byte{registryMagic, 0, 0, 0, 7, 0}
+	r.prefetch(record)
+	c := r.codec("employee.updates")
+	for i := 0; i < 3; i++ {
+		if err := c.Unmarshal(record, &ClientMessage{}); nil == err || !strings.Contains(err.Error(), "Schema not found") {
+			t.Fatalf("error %v, want the failed lookup", err)
+		}
+	}
+	if n := tr.count("GET /schemas/ids/7"); 1 != n {
+		t.Errorf("schema fetched %d times, want once", n)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing follows a message from the websocket through Kafka and back. Spans
+// are exported in the OpenTelemetry OTLP/HTTP JSON encoding, either to a
+// collector or as one JSON document per batch on stdout. Trace context travels
+// through Kafka in the W3C traceparent record header, which requires Kafka
+// version 0.11.0.0 or later in config.json.
+
+const (
+	// W3C trace context header, also used as the Kafka record header key.
+	traceparentHeader = "traceparent"
+
+	// Spans are exported when this many are queued or every traceFlushPeriod.
+	traceBatchSize   = 512
+	traceFlushPeriod = 5 * time.Second
+
+	// Spans are dropped rather than blocking the hub when the queue is full.
+	traceQueueSize = 4096
+
+	defaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+)
+
+// OTLP span kinds
+const (
+	spanKindServer   = 2
+	spanKindProducer = 4
+	spanKindConsumer = 5
+)
+
+type TraceConfig struct {
+	Exporter string `json:"exporter,omitempty"` // "", "stdout" or "otlp"
+	Endpoint string `json:"endpoint,omitempty"` // OTLP/HTTP traces URL
+	Service  string `json:"service,omitempty"`
+}
+
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+func (sc spanContext) valid() bool {
+	return sc.traceID != [16]byte{} && sc.spanID != [8]byte{}
+}
+
+// traceparent formats sc as a W3C traceparent value, always sampled.
+func (sc spanContext) traceparent() string {
+	return "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-01"
+}
+
+// parseTraceparent reads a W3C traceparent value. Malformed values yield an
+// invalid context, which starts a new trace.
+func parseTraceparent(v string) spanContext {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if 4 != len(parts) || 2 != len(parts[0]) || "ff" == parts[0] {
+		return sc
+	}
+	tid, err := hex.DecodeString(parts[1])
+	if err != nil || 16 != len(tid) {
+		return sc
+	}
+	sid, err := hex.DecodeString(parts[2])
+	if err != nil || 8 != len(sid) {
+		return sc
+	}
+	copy(sc.traceID[:], tid)
+	copy(sc.spanID[:], sid)
+	return sc
+}
+
+// recordHeaders injects sc into broker record headers.
+func (sc spanContext) recordHeaders() map[string]string {
+	if !sc.valid() {
+		return nil
+	}
+	return map[string]string{traceparentHeader: sc.traceparent()}
+}
+
+type spanAttr struct {
+	key   string
+	value interface{}
+}
+
+type span struct {
+	name   string
+	kind   int
+	sc     spanContext
+	parent [8]byte
+	start  time.Time
+	end    time.Time
+	attrs  []spanAttr
+	err    error
+}
+
+// tracer is nil when tracing is disabled; spans are then nil and every span
+// method is a no-op.
+var tracer *spanExporter
+
+// startSpan starts a span as a child of parent, or as the root of a new trace
+// when parent is invalid.
+func startSpan(name string, kind int, parent spanContext) *span {
+	if nil == tracer {
+		return nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now()}
+	if parent.valid() {
+		s.sc.traceID = parent.traceID
+		s.parent = parent.spanID
+	} else {
+		rand.Read(s.sc.traceID[:])
+	}
+	rand.Read(s.sc.spanID[:])
+	return s
+}
+
+func (s *span) context() spanContext {
+	if nil == s {
+		return spanContext{}
+	}
+	return s.sc
+}
+
+func (s *span) set(key string, value interface{}) {
+	if nil == s {
+		return
+	}
+	s.attrs = append(s.attrs, spanAttr{key, value})
+}
+
+func (s *span) fail(err error) {
+	if nil == s {
+		return
+	}
+	s.err = err
+}
+
+func (s *span) finish() {
+	if nil == s {
+		return
+	}
+	s.end = time.Now()
+	tracer.enqueue(s)
+}
+
+type spanExporter struct {
+	service  string
+	endpoint string // empty for stdout
+	queue    chan *span
+	client   *http.Client
+	mu       sync.Mutex // serializes stdout writes
+}
+
+func initTracing(c TraceConfig) {
+	switch c.Exporter {
+	case "":
+		return
+	case "stdout", "otlp":
+	default:
+		rootLog.Error("unknown trace exporter, tracing disabled", "exporter", c.Exporter)
+		return
+	}
+	e := &spanExporter{
+		service: c.Service,
+		queue:   make(chan *span, traceQueueSize),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	if "" == e.service {
+		e.service = "wsapigw"
+	}
+	if "otlp" == c.Exporter {
+		e.endpoint = c.Endpoint
+		if "" == e.endpoint {
+			e.endpoint = defaultOTLPEndpoint
+		}
+	}
+	tracer = e
+	go e.run()
+	rootLog.Info("tracing enabled", "exporter", c.Exporter, "endpoint", e.endpoint)
+}
+
+func (e *spanExporter) enqueue(s *span) {
+	select {
+	case e.queue <- s:
+	default:
+		droppedSpans.inc()
+	}
+}
+
+func (e *spanExporter) run() {
+	ticker := time.NewTicker(traceFlushPeriod)
+	defer ticker.Stop()
+	batch := make([]*span, 0, traceBatchSize)
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if 0 == len(batch) {
+				continue
+			}
+		}
+		if err := e.export(batch); err != nil {
+			rootLog.Warn("error exporting spans", "spans", len(batch), "err", err)
+			droppedSpans.add(float64(len(batch)))
+		}
+		batch = make([]*span, 0, traceBatchSize)
+	}
+}
+
+// OTLP/HTTP JSON encoding, see opentelemetry-proto's trace.proto.
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       otlpStatus `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttribute(key string, value interface{}) otlpAttr {
+	a := otlpAttr{Key: key}
+	switch v := value.(type) {
+	case bool:
+		a.Value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.IntValue = &s
+	case int32:
+		s := strconv.FormatInt(int64(v), 10)
+		a.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.IntValue = &s
+	case string:
+		a.Value.StringValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+func (e *spanExporter) encode(batch []*span) ([]byte, error) {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(batch))}
+	scope.Scope.Name = "wsapigw"
+	for _, s := range batch {
+		ospan := otlpSpan{
+			TraceID: hex.EncodeToString(s.sc.traceID[:]),
+			SpanID:  hex.EncodeToString(s.sc.spanID[:]),
+			Name:    s.name,
+			Kind:    s.kind,
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent != [8]byte{} {
+			ospan.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for _, a := range s.attrs {
+			ospan.Attributes = append(ospan.Attributes, otlpAttribute(a.key, a.value))
+		}
+		if nil != s.err {
+			ospan.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		scope.Spans = append(scope.Spans, ospan)
+	}
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	rs.Resource.Attributes = []otlpAttr{otlpAttribute("service.name", e.service)}
+	return json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{rs}})
+}
+
+func (e *spanExporter) export(batch []*span) error {
+	body, err := e.encode(batch)
+	if err != nil {
+		return err
+	}
+	if "" == e.endpoint {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		_, err = os.Stdout.Write(append(body, '\n'))
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	for _, tc := range []struct {
+		name  string
+		value string
+		valid bool
+	}{
+		{"sampled", tp, true},
+		// the gateway samples everything it forwards
+		{"not sampled", " 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00 ", true},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"short trace ID", "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", false},
+		{"span ID not hex", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902zz-01", false},
+		{"zero trace ID", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"empty", "", false},
+	} {
+		sc := parseTraceparent(tc.value)
+		if tc.valid != sc.valid() {
+			t.Errorf("%s: valid %v, want %v", tc.name, sc.valid(), tc.valid)
+			continue
+		}
+		if tc.valid && tp != sc.traceparent() {
+			t.Errorf("%s: read as %s", tc.name, sc.traceparent())
+		}
+	}
+}
+
+// A failed child span as a collector receives it.
+func TestOTLPExport(t *testing.T) {
+	var body []byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if "application/json" != r.Header.Get("Content-Type") {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer collector.Close()
+	e := &spanExporter{service: "wsapigw-test", endpoint: collector.URL, client: collector.Client()}
+	tracer = e
+	t.Cleanup(func() { tracer = nil })
+
+	parent := startSpan("receive /ra", spanKindServer, spanContext{})
+	s := startSpan("publish ledgertx.req", spanKindProducer, parent.context())
+	s.set("messaging.destination.name", "ledgertx.req")
+	s.set("messaging.kafka.partition", int32(3))
+	s.set("wsapigw.retried", false)
+	s.fail(errors.New("broker unavailable"))
+	s.end = s.start.Add(1500)
+	if err := e.export([]*span{s}); err != nil {
+		t.Fatal(err)
+	}
+
+	var req struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []map[string]interface{} `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Scope struct {
+					Name string `json:"name"`
+				} `json:"scope"`
+				Spans []map[string]interface{} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	if 1 != len(req.ResourceSpans) || 1 != len(req.ResourceSpans[0].ScopeSpans) || 1 != len(req.ResourceSpans[0].ScopeSpans[0].Spans) {
+		t.Fatalf("want one resource, scope and span: %s", body)
+	}
+	rs := req.ResourceSpans[0]
+	if b, _ := json.Marshal(rs.Resource.Attributes); `[{"key":"service.name","value":{"stringValue":"wsapigw-test"}}]` != string(b) {
+		t.Errorf("resource attributes %s", b)
+	}
+	if "wsapigw" != rs.ScopeSpans[0].Scope.Name {
+		t.Errorf("scope %q", rs.ScopeSpans[0].Scope.Name)
+	}
+
+	got := rs.ScopeSpans[0].Spans[0]
+	traceparent := "00-" + got["traceId"].(string) + "-" + got["parentSpanId"].(string) + "-01"
+	if parent.context().traceparent() != traceparent || 16 != len(got["spanId"].(string)) {
+		t.Errorf("trace %v, span %v, parent %v; want a child of %s", got["traceId"], got["spanId"], got["parentSpanId"], parent.context().traceparent())
+	}
+	start, end := got["startTimeUnixNano"].(string), got["endTimeUnixNano"].(string)
+	if "publish ledgertx.req" != got["name"] || float64(spanKindProducer) != got["kind"] || len(start) != len(end) || start >= end {
+		t.Errorf("name %v, kind %v, from %v to %v", got["name"], got["kind"], start, end)
+	}
+	for _, want := range []string{
+		`{"key":"messaging.destination.name","value":{"stringValue":"ledgertx.req"}}`,
+		// 64-bit integers are strings in OTLP JSON
+		`{"key":"messaging.kafka.partition","value":{"intValue":"3"}}`,
+		`{"key":"wsapigw.retried","value":{"boolValue":false}}`,
+	} {
+		if b, _ := json.Marshal(got["attributes"]); !strings.Contains(string(b), want) {
+			t.Errorf("attributes %s, want %s", b, want)
+		}
+	}
+	if b, _ := json.Marshal(got["status"]); `{"code":2,"message":"broker unavailable"}` != string(b) {
+		t.Errorf("status %s", b)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// transport is the connection a client's frames are written to: a websocket,
+// or one of the HTTP fallbacks in fallback.go. Everything above it (hub
+// registration, routing, codecs, limits, acks) is shared.
+type transport interface {
+	// name identifies the transport in logs and the admin API.
+	name() string
+	// write sends one encoded message to the peer.
+	write(frame []byte) error
+	// keepalive is the period of ping; zero disables it.
+	keepalive() time.Duration
+	// ping keeps an idle connection open, failing once the peer is gone.
+	ping() error
+	// close drops the connection, telling the peer why when reason is set
+	// and the transport can. It may be called more than once.
+	close(reason string)
+}
+
+var errSessionClosed = errors.New("session closed")
+
+type wsTransport struct {
+	conn  *websocket.Conn
+	ftype int
+}
+
+func (t *wsTransport) name() string { return "websocket" }
+
+func (t *wsTransport) write(frame []byte) error {
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return t.conn.WriteMessage(t.ftype, frame)
+}
+
+func (t *wsTransport) keepalive() time.Duration { return pingPeriod }
+
+func (t *wsTransport) ping() error {
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return t.conn.WriteMessage(websocket.PingMessage, nil)
+}
+
+func (t *wsTransport) close(reason string) {
+	if "" != reason {
+		msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+		if err := t.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait)); err != nil {
+			wsLog.Warn("error sending close", "err", err)
+		}
+	}
+	t.conn.Close()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Inbound messages are validated against the contract of the schema version
+// they declare before anything is published. Messages without a Version are
+// treated as the current version, which is then set on the published message
+// so downstream services know which contract it was checked against.
+
+const currentVersion = "1"
+
+// error codes sent back to clients in ClientMessage.Error
+const (
+	errMalformed          = "malformed_message"
+	errUnsupportedVersion = "unsupported_version"
+	errInvalidPayload     = "invalid_payload"
+)
+
+type ErrorInfo struct {
+	Code    string   `json:"Code" proto:"1"`
+	Message string   `json:"Message" proto:"2"`
+	Fields  []string `json:"Fields,omitempty" proto:"3"`
+}
+
+func (e *ErrorInfo) Error() string {
+	if 0 == len(e.Fields) {
+		return e.Code + ": " + e.Message
+	}
+	return e.Code + ": " + e.Message + " (" + strings.Join(e.Fields, ", ") + ")"
+}
+
+// validator returns the paths of the missing or invalid fields of a payload
+// variant.
+type validator func(p *Payload) []string
+
+// contract lists the payload variants clients may send in one schema version.
+type contract map[string]validator
+
+var contracts = map[string]contract{
+	"1": {
+		"EnrollmentReq":      validateEnrollmentReq,
+		"EnrollmentApproval": validateEnrollmentApproval,
+		"ChangeFPReq":        validateChangeFPReq,
+		"ChangeFPApproval":   validateChangeFPApproval,
+	},
+}
+
+func required(fields []string, path string, value string) []string {
+	if "" == strings.TrimSpace(value) {
+		return append(fields, path)
+	}
+	return fields
+}
+
+// approvalStatus requires at least one of the approvals to carry a status.
+func approvalStatus(fields []string, path string, a Approvals) []string {
+	if "" == a.RAApproval.Status && "" == a.FPApproval.Status {
+		return append(fields, path+".RAApproval.Status|FPApproval.Status")
+	}
+	return fields
+}
+
+func validateEnrollmentReq(p *Payload) []string {
+	r := p.EnrollmentReq
+	var fields []string
+	fields = required(fields, "EnrollmentReq.EmployeeData.ID", r.EmployeeData.ID)
+	fields = required(fields, "EnrollmentReq.EmployeeData.FirstName", r.EmployeeData.FirstName)
+	fields = required(fields, "EnrollmentReq.EmployeeData.LastName", r.EmployeeData.LastName)
+	fields = required(fields, "EnrollmentReq.FPInfo.FPCode", r.FPInfo.FPCode)
+	return fields
+}
+
+func validateEnrollmentApproval(p *Payload) []string {
+	r := p.EnrollmentApproval
+	var fields []string
+	fields = required(fields, "EnrollmentApproval.EmployeeData.ID", r.EmployeeData.ID)
+	fields = required(fields, "EnrollmentApproval.FPInfo.FPCode", r.FPInfo.FPCode)
+	fields = approvalStatus(fields, "EnrollmentApproval.Approvals", r.Approvals)
+	return fields
+}
+
+func validateChangeFPReq(p *Payload) []string {
+	r := p.ChangeFPReq
+	var fields []string
+	fields = required(fields, "ChangeFPReq.EmpID", r.EmpID)
+	fields = required(fields, "ChangeFPReq.CurrFPCode", r.CurrFPCode)
+	fields = required(fields, "ChangeFPReq.NewFPInfo.FPCode", r.NewFPInfo.FPCode)
+	return fields
+}
+
+func validateChangeFPApproval(p *Payload) []string {
+	r := p.ChangeFPApproval
+	var fields []string
+	fields = required(fields, "ChangeFPApproval.EmployeeData", r.EmployeeData)
+	fields = required(fields, "ChangeFPApproval.FPInfo.FPCode", r.FPInfo.FPCode)
+	fields = required(fields, "ChangeFPApproval.NewFPInfo.FPCode", r.NewFPInfo.FPCode)
+	fields = approvalStatus(fields, "ChangeFPApproval.Approvals", r.Approvals)
+	return fields
+}
+
+// variants returns the names of the payload variants that are set.
+func (p *Payload) variants() []string {
+	var set []string
+	if nil != p.EnrollmentReq {
+		set = append(set, "EnrollmentReq")
+	}
+	if nil != p.EnrollmentApproval {
+		set = append(set, "EnrollmentApproval")
+	}
+	if nil != p.ChangeFPReq {
+		set = append(set, "ChangeFPReq")
+	}
+	if nil != p.ChangeFPApproval {
+		set = append(set, "ChangeFPApproval")
+	}
+	if nil != p.Employee {
+		set = append(set, "Employee")
+	}
+	if nil != p.Block {
+		set = append(set, "Block")
+	}
+	if nil != p.Employees {
+		set = append(set, "Employees")
+	}
+	if nil != p.Notice {
+		set = append(set, "Notice")
+	}
+	return set
+}
+
+// validate checks an inbound message against its version's contract: the
+// payload must hold exactly one variant the contract accepts, with all of the
+// variant's required fields set.
+func validate(msg *ClientMessage) *ErrorInfo {
+	if "" == msg.Version {
+		msg.Version = currentVersion
+	}
+	c, ok := contracts[msg.Version]
+	if !ok {
+		versions := make([]string, 0, len(contracts))
+		for v := range contracts {
+			versions = append(versions, v)
+		}
+		sort.Strings(versions)
+		return &ErrorInfo{
+			Code:    errUnsupportedVersion,
+			Message: "supported versions are " + strings.Join(versions, ", "),
+		}
+	}
+	if nil == msg.Payload {
+		return &ErrorInfo{Code: errInvalidPayload, Message: "payload is required"}
+	}
+	set := msg.Payload.variants()
+	if 1 != len(set) {
+		return &ErrorInfo{
+			Code:    errInvalidPayload,
+			Message: "payload must hold exactly one variant",
+			Fields:  set,
+		}
+	}
+	check, ok := c[set[0]]
+	if !ok {
+		return &ErrorInfo{
+			Code:    errInvalidPayload,
+			Message: set[0] + " is not accepted from clients in version " + msg.Version,
+		}
+	}
+	if fields := check(msg.Payload); 0 != len(fields) {
+		return &ErrorInfo{
+			Code:    errInvalidPayload,
+			Message: "missing required fields",
+			Fields:  fields,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateMessage(t *testing.T) {
+	emp := EmpData{ID: "E-1", FirstName: "Juan", LastName: "Dela Cruz"}
+	approved := Approvals{RAApproval: Approval{Status: "APPROVED"}}
+	block := "block-1"
+	for _, tc := range []struct {
+		name    string
+		version string
+		payload *Payload
+		code    string
+		fields  []string
+	}{
+		{"enrollment", "", &Payload{EnrollmentReq: &EnrollmentReq{EmployeeData: emp, FPInfo: FPInfo{FPCode: "FPA"}}}, "", nil},
+		{"enrollment approval", "1", &Payload{EnrollmentApproval: &EnrollmentApproval{
+			EmployeeData: EmpData{ID: "E-1"}, FPInfo: FPInfo{FPCode: "FPA"}, Approvals: approved}}, "", nil},
+		{"change", "1", &Payload{ChangeFPReq: &ChangeFPReq{EmpID: "E-1", CurrFPCode: "FPA", NewFPInfo: FPInfo{FPCode: "FPB"}}}, "", nil},
+		{"change approval", "1", &Payload{ChangeFPApproval: &ChangeFPApproval{
+			EmployeeData: "sealed", FPInfo: FPInfo{FPCode: "FPA"}, NewFPInfo: FPInfo{FPCode: "FPB"}, Approvals: approved}}, "", nil},
+		{"unknown version", "2", &Payload{ChangeFPReq: &ChangeFPReq{}}, errUnsupportedVersion, nil},
+		{"no payload", "1", nil, errInvalidPayload, nil},
+		{"empty payload", "1", &Payload{}, errInvalidPayload, nil},
+		{"two variants", "1", &Payload{ChangeFPReq: &ChangeFPReq{}, Block: &block}, errInvalidPayload, []string{"ChangeFPReq", "Block"}},
+		{"variant clients don't send", "1", &Payload{Block: &block}, errInvalidPayload, nil},
+		{"blank fields", "1", &Payload{EnrollmentReq: &EnrollmentReq{EmployeeData: EmpData{ID: "E-1", FirstName: " "}}}, errInvalidPayload,
+			[]string{"EnrollmentReq.EmployeeData.FirstName", "EnrollmentReq.EmployeeData.LastName", "EnrollmentReq.FPInfo.FPCode"}},
+		{"no approval status", "1", &Payload{ChangeFPApproval: &ChangeFPApproval{
+			EmployeeData: "sealed", FPInfo: FPInfo{FPCode: "FPA"}, NewFPInfo: FPInfo{FPCode: "FPB"}}}, errInvalidPayload,
+			[]string{"ChangeFPApproval.Approvals.RAApproval.Status|FPApproval.Status"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := &ClientMessage{Version: tc.version, Payload: tc.payload}
+			e := validate(msg)
+			if "" == tc.code {
+				if nil != e {
+					t.Fatal(e)
+				}
+				if currentVersion != msg.Version {
+					t.Errorf("version %q, want %q set", msg.Version, currentVersion)
+				}
+				return
+			}
+			if nil == e || tc.code != e.Code {
+				t.Fatalf("error %v, want %s", e, tc.code)
+			}
+			if nil != tc.fields && !reflect.DeepEqual(tc.fields, e.Fields) {
+				t.Errorf("fields %q, want %q", e.Fields, tc.fields)
+			}
+		})
+	}
+}
+
+// A message is checked against the contract of the version it declares.
+func TestValidateVersions(t *testing.T) {
+	contracts["2"] = contract{"ChangeFPReq": validateChangeFPReq}
+	t.Cleanup(func() { delete(contracts, "2") })
+	enroll := &Payload{EnrollmentReq: &EnrollmentReq{
+		EmployeeData: EmpData{ID: "E-1", FirstName: "Juan", LastName: "Dela Cruz"}, FPInfo: FPInfo{FPCode: "FPA"}}}
+	change := &Payload{ChangeFPReq: &ChangeFPReq{EmpID: "E-1", CurrFPCode: "FPA", NewFPInfo: FPInfo{FPCode: "FPB"}}}
+	for _, tc := range []struct {
+		version string
+		payload *Payload
+		ok      bool
+	}{
+		{"1", enroll, true},
+		{"1", change, true},
+		{"2", enroll, false},
+		{"2", change, true},
+	} {
+		e := validate(&ClientMessage{Version: tc.version, Payload: tc.payload})
+		if tc.ok != (nil == e) {
+			t.Errorf("version %s, %v: error %v", tc.version, tc.payload.variants(), e)
+		}
+	}
+	e := validate(&ClientMessage{Version: "3", Payload: change})
+	if nil == e || "supported versions are 1, 2" != e.Message {
+		t.Errorf("version 3: error %v, want the supported versions", e)
+	}
+}
@@ -1,15 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
-	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/wvanbergen/kafka/consumergroup"
+	uuid "github.com/satori/go.uuid"
 )
 
 const (
@@ -22,130 +22,416 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// Maximum message size allowed from peer, the same as a message sent
+	// over the HTTP fallbacks or gRPC.
+	maxMessageSize = maxSendBody
+
+	// Number of outbound messages buffered per client.
+	sendBufferSize = 256
 )
 
 type ClientMessage struct {
-	CID      string   `json:"CID,omitempty"`
-	Username string   `json:"Username,omitempty"`
-	Type     string   `json:"Type,omitempty"`
-	OrgCode  string   `json:"OrgCode,omitempty"`
-	Payload  *Payload `json:"Payload,omitempty"`
+	Version  string     `json:"Version,omitempty" proto:"8"`
+	CID      string     `json:"CID,omitempty" proto:"1"`
+	Username string     `json:"Username,omitempty" proto:"2"`
+	Type     string     `json:"Type,omitempty" proto:"3"`
+	OrgCode  string     `json:"OrgCode,omitempty" proto:"4"`
+	Payload  *Payload   `json:"Payload,omitempty" proto:"5"`
+	Status   string     `json:"Status,omitempty" proto:"6"`
+	Error    *ErrorInfo `json:"Error,omitempty" proto:"7"`
+	// client-chosen key identifying retries of the same message
+	IdempotencyKey string `json:"IdempotencyKey,omitempty" proto:"9"`
+	// "topic/partition/offset" of the record a message was consumed from;
+	// redeliveries carry the same RecordID
+	RecordID string `json:"RecordID,omitempty" proto:"10"`
+	// sent by clients to remove the outbox message with this RecordID
+	Ack string `json:"Ack,omitempty" proto:"11"`
+	// ack mode: sequence number of an outbound message, and the one a
+	// client acknowledges
+	Seq    uint64 `json:"Seq,omitempty" proto:"12"`
+	AckSeq uint64 `json:"AckSeq,omitempty" proto:"13"`
+	// request-reply: replies echo the request's CorrelationID, and are
+	// produced to its ReplyTo topic
+	CorrelationID string `json:"CorrelationID,omitempty" proto:"14"`
+	ReplyTo       string `json:"ReplyTo,omitempty" proto:"15"`
+	// gateway bookkeeping, never serialized
+	route string    // endpoint of the sending client
+	topic string    // topic the message was consumed from
+	ts    time.Time // Kafka timestamp of the consumed record
+	sc    spanContext
+	dkey  string // sender-scoped idempotency key, see dedupKey
+	d     *delivery
+	// sent from the outbox, which keeps it until acknowledged
+	outboxed bool
+	// receives the outcome of publishing, when someone waits for it
+	result chan error
 }
 
 type Client struct {
-	hub  *Hub
-	conn *websocket.Conn
-	cid  string
-	Type string
+	hub   *Hub
+	t     transport
+	send  chan *ClientMessage
+	done  chan struct{}
+	cid   string
+	Type  string
+	user  string
+	addr  string
+	route string
+	codec Codec
+	// scopes an anonymous client's idempotency keys, its cid when empty
+	scope string
+	// rate limit buckets, nil without limits
+	limits *clientLimits
+	// gives back the admission control slot
+	release func()
+	// unacknowledged messages, nil unless the client asked for ack mode
+	acks *clientAcks
+	// smu guards closed, which is set once the hub unregistered the client
+	// and no more messages may be queued
+	smu    sync.Mutex
+	closed bool
+	// time the websocket upgrade completed
+	since time.Time
 }
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    subprotocols(),
+}
+
+var ip = flag.String("ip", defaultIP, "http service address, overrides server.ip")
+var port = flag.Int("port", defaultPort, "server port, overrides server.port")
+
+func newClient(hub *Hub, t transport, codec Codec, r *http.Request, route string, ctype string) *Client {
+	c := &Client{
+		hub:   hub,
+		t:     t,
+		send:  make(chan *ClientMessage, sendBufferSize),
+		done:  make(chan struct{}),
+		cid:   uuid.NewV4().String(),
+		Type:  ctype,
+		addr:  r.RemoteAddr,
+		route: route,
+		codec: codec,
+		since: time.Now(),
+	}
+	if nil != limiter {
+		c.limits = limiter.forClient(c.route, ctype)
+	}
+	if "1" == r.URL.Query().Get("acks") {
+		c.acks = newClientAcks()
+	}
+	return c
 }
 
-var ip = flag.String("ip", "0.0.0.0", "http service address")
-var port = flag.Int("port", 3000, "server port")
-
-func handleClient(c *Client) {
-	/*
-		defer func() {
-			c.hub.unregister <- c
-			c.conn.Close()
-		}()
-		c.conn.SetReadLimit(maxMessageSize)
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
-		c.conn.SetPongHandler(func(string) error {
-			c.conn.SetReadDeadline(time.Now().Add(pongWait))
-			return nil
-		})*/
+// handleClient reads a websocket client's frames until the connection fails.
+func handleClient(c *Client, conn *websocket.Conn) {
+	defer func() {
+		c.hub.unregister <- c
+		conn.Close()
+	}()
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
 	for {
-		_, msg, err := c.conn.ReadMessage()
+		_, msg, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err,
 				websocket.CloseGoingAway,
 				websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
+				wsLog.Warn("unexpected close", "cid", c.cid, "err", err)
 			}
 			break
 		}
-		log.Printf("...new msg!: %s\n", msg)
-		cmsg := &ClientMessage{}
-		_ = json.Unmarshal(msg, cmsg)
-		if err != nil {
-			log.Printf("error: %v", err)
+		if !c.receive(msg) {
 			break
 		}
-		log.Printf("...new client msg!: %+v\n", cmsg)
-		cmsg.CID = c.cid
-		c.hub.pmsg <- cmsg
 	}
 }
 
-func consumeKafka(h *Hub, cg *consumergroup.ConsumerGroup) {
+// receive handles one frame sent by the client, whatever its transport. It
+// returns false once the client has been disconnected.
+func (c *Client) receive(msg []byte) bool {
+	cmsg := &ClientMessage{}
+	err := c.codec.Unmarshal(msg, cmsg)
+	// acks aren't charged against the rate limits
+	if nil == err && ("" != cmsg.Ack || 0 != cmsg.AckSeq) && nil == cmsg.Payload {
+		if "" != cmsg.Ack {
+			c.hub.ack(c, cmsg.Ack)
+		}
+		if 0 != cmsg.AckSeq && nil != c.acks {
+			c.acked(cmsg.AckSeq)
+		}
+		return true
+	}
+	if nil != limiter {
+		if limit := limiter.allow(c); "" != limit {
+			rateLimited.inc(c.route, limit)
+			c.reject(&ErrorInfo{Code: errRateLimited, Message: limit + " rate limit exceeded"})
+			if limiter.strike(c) {
+				wsLog.Warn("disconnecting client exceeding rate limits", "cid", c.cid, "limit", limit)
+				rateLimitDisconnects.inc(c.route)
+				c.hub.disconnect(c, "rate limit exceeded")
+				return false
+			}
+			return true
+		}
+	}
+	sp := startSpan("receive "+c.route, spanKindServer, spanContext{})
+	defer sp.finish()
+	sp.set("wsapigw.cid", c.cid)
+	sp.set("wsapigw.route", c.route)
+	if err != nil {
+		c.reject(&ErrorInfo{Code: errMalformed, Message: err.Error()})
+		sp.fail(err)
+		return true
+	}
+	if answer := c.submit(cmsg, sp); nil != answer {
+		c.hub.deliver(c, answer)
+	}
+	return true
+}
+
+// submit validates a client message and queues it for publishing. It returns
+// the error or duplicate frame to answer with instead, if any.
+func (c *Client) submit(cmsg *ClientMessage, sp *span) *ClientMessage {
+	if e := validate(cmsg); nil != e {
+		sp.fail(e)
+		return c.rejection(e)
+	}
+	cmsg.dkey = dedupKey(c, cmsg)
+	if "" != cmsg.dkey && !dedup.first(cmsg.dkey) {
+		duplicateMessages.inc(c.route)
+		wsLog.Info("duplicate client message", "cid", c.cid, "key", cmsg.IdempotencyKey)
+		return &ClientMessage{CID: c.cid, IdempotencyKey: cmsg.IdempotencyKey, Status: statusDuplicate}
+	}
+	cmsg.CID = c.cid
+	cmsg.route = c.route
+	cmsg.sc = sp.context()
+	c.hub.pmsg <- cmsg
+	return nil
+}
+
+// rejection returns the error frame answering a message the gateway won't
+// publish.
+func (c *Client) rejection(e *ErrorInfo) *ClientMessage {
+	rejectedMessages.inc(c.route, e.Code)
+	wsLog.Info("rejected client message", "cid", c.cid, "err", e.Error())
+	return &ClientMessage{CID: c.cid, Error: e}
+}
+
+// reject answers a message the gateway won't publish with an error frame.
+func (c *Client) reject(e *ErrorInfo) {
+	c.hub.deliver(c, c.rejection(e))
+}
+
+// writeClient is the only goroutine writing to the client's connection. It
+// drains the send buffer filled by the hub and keeps the peer alive with pings.
+func writeClient(c *Client) {
+	var keepalive <-chan time.Time
+	if p := c.t.keepalive(); 0 != p {
+		ticker := time.NewTicker(p)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+	var retry <-chan time.Time
+	if nil != c.acks {
+		t := time.NewTicker(ackTimeout / 4)
+		defer t.Stop()
+		retry = t.C
+	}
+	defer func() {
+		c.t.close("")
+		if nil != c.acks {
+			for _, msg := range c.acks.abandon() {
+				c.undelivered(msg, "abandoned")
+			}
+		}
+	}()
 	for {
 		select {
-		case msg := <-cg.Messages():
-			// commit to zookeeper that message is read
-			// this prevent read message multiple times after restart
-			err := cg.CommitUpto(msg)
+		case msg := <-c.send:
+			var sp *span
+			if msg.sc.valid() {
+				sp = startSpan("deliver "+c.route, spanKindProducer, msg.sc)
+				sp.set("wsapigw.cid", c.cid)
+			}
+			// in ack mode the delivery completes with the ack instead
+			tracked := nil != c.acks && "" != msg.RecordID
+			if tracked {
+				msg = c.acks.track(msg)
+			}
+			frame, err := c.codec.Marshal(msg)
 			if err != nil {
-				log.Println("Error commit zookeeper: ", err.Error())
+				wsLog.Error("error encoding message for client", "cid", c.cid, "codec", c.codec.Name(), "err", err)
+				droppedMessages.inc(dropMarshal)
+				if tracked {
+					c.acks.ack(msg.Seq)
+				}
+				msg.d.fail(c)
+				sp.fail(err)
+				sp.finish()
+				continue
+			}
+			if err := c.t.write(frame); err != nil {
+				wsLog.Warn("error writing to client", "cid", c.cid, "transport", c.t.name(), "err", err)
+				if !tracked {
+					msg.d.fail(c)
+				}
+				sp.fail(err)
+				sp.finish()
+				return
+			}
+			if !tracked {
+				msg.d.finish()
+			}
+			sp.finish()
+			if "" != msg.topic {
+				outboundMessages.inc(c.route, msg.topic)
+			}
+			if !msg.ts.IsZero() {
+				deliveryLatency.since(msg.ts, c.route)
+			}
+		case now := <-retry:
+			resend, expired := c.acks.overdue(now)
+			for _, msg := range expired {
+				c.undelivered(msg, "expired")
+			}
+			for _, msg := range resend {
+				ackEvents.inc(c.route, "retried")
+				frame, err := c.codec.Marshal(msg)
+				if err != nil {
+					continue
+				}
+				if err := c.t.write(frame); err != nil {
+					wsLog.Warn("error writing to client", "cid", c.cid, "transport", c.t.name(), "err", err)
+					return
+				}
 			}
-			h.cmsg <- &ConsumerMessage{Value: string(msg.Value)}
+		case <-keepalive:
+			if err := c.t.ping(); err != nil {
+				return
+			}
+		case <-c.done:
+			return
 		}
 	}
 }
 
-func serveRA(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err)
-		return
+// consumeBroker forwards records from the connection's consumer group to the
+// hub until the connection fails or the consumer group shuts down.
+func consumeBroker(h *Hub, k *brokerConn) error {
+	cg := k.sub
+	for {
+		select {
+		case msg, ok := <-cg.Records():
+			if !ok {
+				return errConsumerClosed
+			}
+			cmsg := &ConsumerMessage{
+				Value:       string(msg.Value),
+				Topic:       msg.Topic,
+				Timestamp:   msg.Timestamp,
+				TraceParent: msg.Headers[traceparentHeader],
+				Partition:   msg.Partition,
+				Offset:      msg.Offset,
+			}
+			if h.afterDelivery {
+				cmsg.delivery = k.track(h, msg, cmsg)
+			} else {
+				// commit to zookeeper that message is read
+				// this prevent read message multiple times after restart
+				err := cg.Commit(msg)
+				if err != nil {
+					brokerLog.Error("error committing offset", "topic", msg.Topic, "partition", msg.Partition, "err", err)
+				}
+			}
+			h.markConsumed(msg.Topic, msg.Partition, msg.Offset)
+			if nil != registry {
+				registry.prefetch(msg.Value)
+			}
+			h.cmsg <- cmsg
+		case err, ok := <-cg.Errors():
+			if !ok {
+				return errConsumerClosed
+			}
+			brokerLog.Error("error consuming", "err", err)
+			h.health.consumerError(err)
+		case <-k.dead:
+			return k.err
+		}
 	}
-	client := &Client{hub: hub, conn: conn, Type: "RA"}
-	hub.register <- client
-
-	go handleClient(client)
-	go consumeKafka(hub, hub.consumers)
 }
 
-func serveFPA(hub *Hub, w http.ResponseWriter, r *http.Request) {
+// serveClient upgrades a request on one of the websocket endpoints and
+// starts the client's read and write goroutines.
+func serveClient(hub *Hub, w http.ResponseWriter, r *http.Request, ctype string) {
+	if refuseUnready(hub, w) {
+		return
+	}
+	user, refused := refuseUnauthenticated(w, r)
+	if refused {
+		return
+	}
+	release, refused := refuseOverLimit(w, r, r.URL.Path, user)
+	if refused {
+		return
+	}
 	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		release()
+		wsLog.Warn("upgrade failed", "remote", r.RemoteAddr, "err", err)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, Type: "FPA"}
+	codec := negotiateCodec(conn, r)
+	t := &wsTransport{conn: conn, ftype: codec.FrameType()}
+	client := newClient(hub, t, codec, r, r.URL.Path, ctype)
+	client.user = user
+	client.release = release
 	hub.register <- client
 
-	go handleClient(client)
-	go consumeKafka(hub, hub.consumers)
+	go writeClient(client)
+	go handleClient(client, conn)
 }
 
-func serveFPB(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	client := &Client{hub: hub, conn: conn, Type: "FPB"}
-	hub.register <- client
+func serveRA(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	serveClient(hub, w, r, "RA")
+}
+
+func serveFPA(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	serveClient(hub, w, r, "FPA")
+}
 
-	go handleClient(client)
-	go consumeKafka(hub, hub.consumers)
+func serveFPB(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	serveClient(hub, w, r, "FPB")
 }
 
 func main() {
 	flag.Parse()
-	addr := *ip + ":" + strconv.Itoa(*port)
+	c, src := initConfig()
+	addr := c.Server.IP + ":" + strconv.Itoa(c.Server.Port)
+	initLogging(c.Log)
+	rootLog.Info("config loaded", "file", src.File, "env", src.Env)
+	initTracing(c.Trace)
+	initCodecs(c.Codecs)
+	initRegistry(c.Registry)
+	initAuth(c.Auth)
+	initRateLimits(c.RateLimit)
+	initAdmission(c.Admission)
+	initIdempotency(c.Idempotency)
+	initAcks(c.Acks)
+	initIngest(c.Ingest, c.Topics.Consume)
+	initBroker(c.Broker)
 	hub := newHub()
-	go hub.run()
+	initOutbox(hub, c.Outbox)
+	go hub.run(c)
+	go serveAdmin(hub, c.Admin)
+	go serveGRPCListener(hub, c.GRPC)
 	http.HandleFunc("/ra", func(w http.ResponseWriter, r *http.Request) {
 		serveRA(hub, w, r)
 	})
@@ -155,9 +441,30 @@ func main() {
 	http.HandleFunc("/fpb", func(w http.ResponseWriter, r *http.Request) {
 		serveFPB(hub, w, r)
 	})
-	log.Print("websocket server started! Now listening at ", addr)
+	handleFallbacks(hub, "/ra", "RA")
+	handleFallbacks(hub, "/fpa", "FPA")
+	handleFallbacks(hub, "/fpb", "FPB")
+	if 0 != len(ingestIdentities) {
+		http.HandleFunc(ingestRoute, func(w http.ResponseWriter, r *http.Request) {
+			serveIngest(hub, w, r)
+		})
+	}
+	if 0 != len(ingestIdentities) && "" != replyTopic {
+		http.HandleFunc(requestRoute, func(w http.ResponseWriter, r *http.Request) {
+			serveRequest(hub, w, r)
+		})
+	}
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		serveMetrics(hub, w, r)
+	})
+	http.HandleFunc("/healthz", serveHealthz)
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		serveReadyz(hub, w, r)
+	})
+	wsLog.Info("websocket server started", "addr", addr)
 	err := http.ListenAndServe(addr, nil)
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		wsLog.Error("ListenAndServe", "err", err)
+		os.Exit(1)
 	}
 }